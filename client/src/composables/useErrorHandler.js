@@ -16,13 +16,13 @@ export function useErrorHandler() {
       if (status === 404) {
         message = 'Resource not found'
       } else if (status === 400) {
-        message = error.response.data?.message || 'Invalid request'
+        message = error.response.data?.error?.message || 'Invalid request'
       } else if (status === 500) {
         message = 'Server error occurred'
       } else if (status >= 500) {
         message = 'Server is unavailable'
       } else {
-        message = error.response.data?.message || `HTTP Error ${status}`
+        message = error.response.data?.error?.message || `HTTP Error ${status}`
       }
     } else if (error.code === 'NETWORK_ERROR' || error.message.includes('Network Error')) {
       message = 'Network connection failed'
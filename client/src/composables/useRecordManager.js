@@ -95,8 +95,8 @@ export function useRecordManager(tableManager) {
       clearAddForm()
     } catch (error) {
       console.error('Error creating record:', error)
-      if (error.response && error.response.status === 500 && error.response.data?.includes('validation failed')) {
-        showNotification(`Server validation error: ${error.response.data}`, 'error')
+      if (error.response?.data?.error?.code === 'VALIDATION_FAILED') {
+        error.response.data.error.details.forEach(detail => showNotification(`Server validation error: ${detail.message}`, 'error'))
       } else {
         showNotification('Error creating record. Please try again.', 'error')
       }
@@ -136,7 +136,9 @@ export function useRecordManager(tableManager) {
       
       if (tableManager.serverConnected.value) {
         // Server-side update
-        await recordAPI.updateRecord(editingRecord.value.id, recordData, tableManager.currentTable.value)
+        // Only editable columns are sent, so patch rather than replace the record
+        const updated = await recordAPI.patchRecord(editingRecord.value.id, recordData, tableManager.currentTable.value, editingRecord.value.row_version)
+        Object.assign(recordData, updated)
         showNotification('Record updated successfully!', 'success')
       } else {
         // Local-only update
@@ -157,8 +159,10 @@ export function useRecordManager(tableManager) {
     } catch (error) {
       console.error('Error updating record:', error)
       // Check if the error is from server-side validation
-      if (error.response && error.response.status === 500 && error.response.data?.includes('validation failed')) {
-        showNotification(`Server validation error: ${error.response.data}`, 'error')
+      if (error.response?.data?.error?.code === 'VALIDATION_FAILED') {
+        error.response.data.error.details.forEach(detail => showNotification(`Server validation error: ${detail.message}`, 'error'))
+      } else if (error.response?.status === 412) {
+        showNotification('This record was changed by someone else. Reload it and try again.', 'error')
       } else {
         showNotification('Error updating record. Please try again.', 'error')
       }
@@ -71,14 +71,23 @@ export function useTableManager() {
     try {
       const serverColumns = await columnAPI.getColumns(tableName)
       if (serverColumns && serverColumns.length > 0) {
-        // Transform server column names into column objects
-        const columnObjects = serverColumns.map(columnName => ({
-          key: columnName,
-          label: columnName.charAt(0).toUpperCase() + columnName.slice(1).replace(/_/g, ' '),
-          type: detectColumnType(columnName, null), // Will be refined when data is loaded
-          required: columnName === 'id',
-          editable: columnName !== 'id'
-        }))
+        // Server returns column metadata objects; older servers return bare names
+        const columnObjects = serverColumns.map(column => {
+          if (typeof column === 'object') {
+            return {
+              ...column,
+              type: column.type === 'phone' ? 'tel' : column.type,
+              editable: column.key !== 'id'
+            }
+          }
+          return {
+            key: column,
+            label: column.charAt(0).toUpperCase() + column.slice(1).replace(/_/g, ' '),
+            type: detectColumnType(column, null), // Will be refined when data is loaded
+            required: column === 'id',
+            editable: column !== 'id'
+          }
+        })
         
         tableColumns.value[tableName] = columnObjects
       }
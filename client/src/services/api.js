@@ -32,7 +32,7 @@ export const recordAPI = {
     }
   },
 
-  // Update record in a specific table
+  // Replace a record in a specific table; fields left out become null or their default
   async updateRecord(id, recordData, tableName) {
     try {
       const response = await api.put(`/records/${id}?table=${tableName}`, recordData)
@@ -43,6 +43,22 @@ export const recordAPI = {
     }
   },
 
+  // Change only the given fields of a record (JSON Merge Patch); null clears a field.
+  // With a version the server rejects the change (412) if someone else saved the record first.
+  async patchRecord(id, changes, tableName, version) {
+    try {
+      const headers = { 'Content-Type': 'application/merge-patch+json' }
+      if (version !== undefined && version !== null) {
+        headers['If-Match'] = `"${version}"`
+      }
+      const response = await api.patch(`/records/${id}?table=${tableName}`, changes, { headers })
+      return response.data
+    } catch (error) {
+      console.error('Error patching record:', error)
+      throw error
+    }
+  },
+
   // Delete record from a specific table
   async deleteRecord(id, tableName) {
     try {
@@ -57,7 +73,15 @@ export const recordAPI = {
   // Delete all records from a specific table
   async deleteAllRecords(tableName) {
     try {
-      await api.delete(`/records?table=${tableName}&bulk=true`)
+      // The server answers the first call with a confirmation token (428) that
+      // must be sent back to actually truncate the table
+      const response = await api.delete(`/records?table=${tableName}&bulk=true`, {
+        validateStatus: status => status === 428 || (status >= 200 && status < 300)
+      })
+      if (response.status === 428) {
+        const token = response.data.error.details.confirmationToken
+        await api.delete(`/records?table=${tableName}&bulk=true&confirm=${token}`)
+      }
       return true
     } catch (error) {
       console.error('Error deleting all records:', error)
@@ -65,6 +89,28 @@ export const recordAPI = {
     }
   },
 
+  // Changes made to a record, newest first
+  async getRecordHistory(id, tableName) {
+    try {
+      const response = await api.get(`/records/${tableName}/${id}/history`)
+      return response.data
+    } catch (error) {
+      console.error('Error fetching record history:', error)
+      throw error
+    }
+  },
+
+  // Put a record back the way it was at a version listed in its history
+  async revertRecord(id, tableName, version) {
+    try {
+      const response = await api.post(`/records/${tableName}/${id}/revert`, { version })
+      return response.data
+    } catch (error) {
+      console.error('Error reverting record:', error)
+      throw error
+    }
+  },
+
   // Bulk create records in a specific table
   async bulkCreateRecords(recordsData, tableName) {
     try {
@@ -103,15 +149,242 @@ export const tableAPI = {
     }
   },
 
-  // Drop/delete table
-  async dropTable(tableName) {
+  // Drop a table: it goes to the trash unless permanent is set
+  async dropTable(tableName, permanent = false) {
     try {
-      const response = await api.delete(`/tables/${tableName}`)
+      const response = await api.delete(`/tables/${tableName}${permanent ? '?permanent=true' : ''}`)
       return response.data
     } catch (error) {
       console.error('Error dropping table:', error)
       throw error
     }
+  },
+
+  // Rename table
+  async renameTable(tableName, newName) {
+    try {
+      const response = await api.patch(`/tables/${tableName}`, { name: newName })
+      return response.data
+    } catch (error) {
+      console.error('Error renaming table:', error)
+      throw error
+    }
+  },
+
+  // Set how unknown record fields are handled: 'dynamic', 'strict' or 'ignore'
+  async setSchemaMode(tableName, schemaMode) {
+    try {
+      const response = await api.patch(`/tables/${tableName}`, { schemaMode })
+      return response.data
+    } catch (error) {
+      console.error('Error updating schema mode:', error)
+      throw error
+    }
+  },
+
+  // Add the created_at, updated_at, created_by and updated_by columns the server maintains
+  async enableTimestamps(tableName) {
+    try {
+      const response = await api.patch(`/tables/${tableName}`, { timestamps: true })
+      return response.data
+    } catch (error) {
+      console.error('Error adding timestamp columns:', error)
+      throw error
+    }
+  },
+
+  // Make deleting a record move it to the trash (adds the deleted_at column)
+  async enableSoftDelete(tableName) {
+    try {
+      const response = await api.patch(`/tables/${tableName}`, { softDelete: true })
+      return response.data
+    } catch (error) {
+      console.error('Error enabling soft delete:', error)
+      throw error
+    }
+  },
+
+  // Copy a table's schema, and its rows when withData is set
+  async cloneTable(tableName, newName, withData = false) {
+    try {
+      const response = await api.post(`/tables/${tableName}/clone`, { name: newName, withData })
+      return response.data
+    } catch (error) {
+      console.error('Error cloning table:', error)
+      throw error
+    }
+  },
+
+  // Propose column types for records without creating anything
+  async previewSchema(records, tableName = '') {
+    try {
+      const response = await api.post('/tables/preview', { table: tableName, records })
+      return response.data
+    } catch (error) {
+      console.error('Error previewing schema:', error)
+      throw error
+    }
+  },
+
+  // Get column types, constraints, indexes and row estimate
+  async getTableSchema(tableName) {
+    try {
+      const response = await api.get(`/tables/${tableName}/schema`)
+      return response.data
+    } catch (error) {
+      console.error('Error fetching table schema:', error)
+      throw error
+    }
+  },
+
+  // Download rows as CSV; params take the filter[...], sort and fields of getRecords plus delimiter
+  async exportTable(tableName, params = {}) {
+    try {
+      const response = await api.get(`/tables/${tableName}/export`, { params: { format: 'csv', ...params }, responseType: 'blob' })
+      return response.data
+    } catch (error) {
+      console.error('Error exporting table:', error)
+      throw error
+    }
+  },
+
+  // List a table's indexes
+  async getIndexes(tableName) {
+    try {
+      const response = await api.get(`/tables/${tableName}/indexes`)
+      return response.data
+    } catch (error) {
+      console.error('Error fetching indexes:', error)
+      throw error
+    }
+  },
+
+  // Create an index: { columns, unique, method, where, name, concurrently }
+  async createIndex(tableName, indexData) {
+    try {
+      const response = await api.post(`/tables/${tableName}/indexes`, indexData)
+      return response.data
+    } catch (error) {
+      console.error('Error creating index:', error)
+      throw error
+    }
+  },
+
+  // Drop an index
+  async dropIndex(tableName, indexName) {
+    try {
+      const response = await api.delete(`/tables/${tableName}/indexes/${indexName}`)
+      return response.data
+    } catch (error) {
+      console.error('Error dropping index:', error)
+      throw error
+    }
+  }
+}
+
+// Trash API functions: deleted records of soft-delete tables and dropped tables
+export const trashAPI = {
+  // Archived tables and trashed record counts per table
+  async getTrash() {
+    try {
+      const response = await api.get('/trash')
+      return response.data
+    } catch (error) {
+      console.error('Error fetching trash:', error)
+      throw error
+    }
+  },
+
+  async getDeletedRecords(tableName) {
+    try {
+      const response = await api.get(`/trash/records/${tableName}`)
+      return response.data
+    } catch (error) {
+      console.error('Error fetching deleted records:', error)
+      throw error
+    }
+  },
+
+  async restoreRecord(id, tableName) {
+    try {
+      const response = await api.post(`/trash/records/${tableName}/${id}/restore`)
+      return response.data
+    } catch (error) {
+      console.error('Error restoring record:', error)
+      throw error
+    }
+  },
+
+  // Restore a dropped table, under newName when its old name has been taken
+  async restoreTable(archiveName, newName = '') {
+    try {
+      const response = await api.post(`/trash/tables/${archiveName}/restore`, newName ? { name: newName } : {})
+      return response.data
+    } catch (error) {
+      console.error('Error restoring table:', error)
+      throw error
+    }
+  },
+
+  async purgeTable(archiveName) {
+    try {
+      const response = await api.delete(`/trash/tables/${archiveName}`)
+      return response.data
+    } catch (error) {
+      console.error('Error purging table:', error)
+      throw error
+    }
+  },
+
+  // Permanently remove everything trashed longer ago than olderThan (e.g. '72h'),
+  // or than the server's retention period
+  async purge(olderThan = '') {
+    try {
+      const response = await api.post(`/trash/purge${olderThan ? `?olderThan=${olderThan}` : ''}`)
+      return response.data
+    } catch (error) {
+      console.error('Error purging trash:', error)
+      throw error
+    }
+  }
+}
+
+// Audit API functions
+export const auditAPI = {
+  // Recorded changes across tables; params: table, recordId, operation, actor, since, until, limit, offset
+  async getAuditLog(params = {}) {
+    try {
+      const response = await api.get('/audit', { params })
+      return response.data
+    } catch (error) {
+      console.error('Error fetching audit log:', error)
+      throw error
+    }
+  }
+}
+
+// Migration API functions
+export const migrationAPI = {
+  // Recorded schema changes, oldest first; params: table, operation, actor, since, until, limit, offset
+  async getMigrations(params = {}) {
+    try {
+      const response = await api.get('/migrations', { params })
+      return response.data
+    } catch (error) {
+      console.error('Error fetching migrations:', error)
+      throw error
+    }
+  },
+
+  // format is 'zip' (numbered up/down files), 'up' or 'down'; resolves to a Blob
+  async exportMigrations(format = 'zip', params = {}) {
+    try {
+      const response = await api.get('/migrations/export', { params: { ...params, format }, responseType: 'blob' })
+      return response.data
+    } catch (error) {
+      console.error('Error exporting migrations:', error)
+      throw error
+    }
   }
 }
 
@@ -127,6 +400,17 @@ export const columnAPI = {
     }
   },
 
+  // Rename and/or retype a column; changes is { name, type, sqlType, dryRun }
+  async updateColumn(tableName, columnKey, changes) {
+    try {
+      const response = await api.patch(`/columns?table=${tableName}&column=${columnKey}`, changes)
+      return response.data
+    } catch (error) {
+      console.error('Error updating column:', error)
+      throw error
+    }
+  },
+
   // Remove column from table
   async removeColumn(tableName, columnKey) {
     try {
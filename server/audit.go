@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Operations recorded in the audit log
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditRevert  = "revert"
+
+	// Bulk inserts and truncation are recorded as a single entry for the table; bulk
+	// deletes get a delete entry per record
+	auditBulkCreate = "bulk_create"
+	auditTruncate   = "truncate"
+)
+
+var auditOperations = []string{auditCreate, auditUpdate, auditDelete, auditRestore, auditRevert, auditBulkCreate, auditTruncate}
+
+// defaultAuditLimit is the page size of audit listings that don't set limit
+const defaultAuditLimit = 100
+
+// AuditEntry is one recorded change of a record. Before and After hold only the fields
+// the change touched, with their values before and after it; Version is the record's
+// row version after the change (before it, for a delete). A bulk insert or a truncation
+// is a single entry with RecordID 0 whose After summarizes what it did.
+type AuditEntry struct {
+	ID        int64                  `json:"id"`
+	Table     string                 `json:"table"`
+	RecordID  int64                  `json:"recordId"`
+	Operation string                 `json:"operation"`
+	Version   *int64                 `json:"version,omitempty"`
+	Before    map[string]interface{} `json:"before"`
+	After     map[string]interface{} `json:"after"`
+	Actor     string                 `json:"actor,omitempty"`
+	ChangedAt time.Time              `json:"changedAt"`
+}
+
+// auditQuery selects audit entries, newest first
+type auditQuery struct {
+	Table     string
+	RecordID  *int64
+	Operation string
+	Actor     string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+// parseAuditQuery reads the table, recordId, operation, actor, since, until, limit and
+// offset parameters of an audit listing
+func parseAuditQuery(params url.Values) (auditQuery, error) {
+	query := auditQuery{
+		Table:     params.Get("table"),
+		Operation: params.Get("operation"),
+		Actor:     params.Get("actor"),
+		Limit:     defaultAuditLimit,
+	}
+
+	if query.Operation != "" && !containsString(auditOperations, query.Operation) {
+		return query, fmt.Errorf("unknown operation '%s'", query.Operation)
+	}
+	if recordIDStr := params.Get("recordId"); recordIDStr != "" {
+		recordID, err := strconv.ParseInt(recordIDStr, 10, 64)
+		if err != nil {
+			return query, fmt.Errorf("invalid recordId '%s'", recordIDStr)
+		}
+		query.RecordID = &recordID
+	}
+	for name, target := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s '%s': use an RFC 3339 time", name, value)
+			}
+			*target = parsed
+		}
+	}
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("invalid limit '%s'", limitStr)
+		}
+		query.Limit = min(limit, maxPageLimit)
+	}
+	if offsetStr := params.Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return query, fmt.Errorf("invalid offset '%s'", offsetStr)
+		}
+		query.Offset = offset
+	}
+	return query, nil
+}
+
+// matches reports whether an entry is selected by the query's filters
+func (q auditQuery) matches(entry AuditEntry) bool {
+	return (q.Table == "" || entry.Table == q.Table) &&
+		(q.RecordID == nil || entry.RecordID == *q.RecordID) &&
+		(q.Operation == "" || entry.Operation == q.Operation) &&
+		(q.Actor == "" || entry.Actor == q.Actor) &&
+		(q.Since.IsZero() || !entry.ChangedAt.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.ChangedAt.Before(q.Until))
+}
+
+// newAuditEntry describes the change from before to after, either of which is nil for a
+// create or a hard delete. System columns other than deleted_at are left out of the diff:
+// the entry records the version, actor and time itself.
+func newAuditEntry(tableName string, id int64, operation string, before, after Record, actor string) (AuditEntry, error) {
+	entry := AuditEntry{
+		Table:     tableName,
+		RecordID:  id,
+		Operation: operation,
+		Before:    map[string]interface{}{},
+		After:     map[string]interface{}{},
+		Actor:     actor,
+		ChangedAt: time.Now().UTC(),
+	}
+	versioned := after
+	if versioned == nil {
+		versioned = before
+	}
+	if version, ok := recordVersion(versioned); ok {
+		entry.Version = &version
+	}
+
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return entry, err
+	}
+	beforeDoc, err := recordDocument(before)
+	if err != nil {
+		return entry, err
+	}
+	afterDoc, err := recordDocument(after)
+	if err != nil {
+		return entry, err
+	}
+	for _, doc := range []map[string]interface{}{beforeDoc, afterDoc} {
+		for key := range doc {
+			if key == "id" || (isSystemColumn(key, system) && key != deletedAtColumn) {
+				continue
+			}
+			if !reflect.DeepEqual(beforeDoc[key], afterDoc[key]) {
+				entry.Before[key] = beforeDoc[key]
+				entry.After[key] = afterDoc[key]
+			}
+		}
+	}
+	return entry, nil
+}
+
+// auditRecordChange adds a change to the audit log. The write itself has already
+// happened, so a failure to record it is logged rather than returned.
+func auditRecordChange(tableName string, id int64, operation string, before, after Record, actor string) {
+	entry, err := newAuditEntry(tableName, id, operation, before, after, actor)
+	if err == nil {
+		err = store.RecordAudit(entry)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to record %s of record %d in table %s in the audit log: %v", operation, id, tableName, err)
+	}
+}
+
+// auditDeletedRecords adds a delete entry for each record a bulk delete removed or, when
+// it has deleted_at set, moved to the trash
+func auditDeletedRecords(tableName string, deleted []Record, actor string) {
+	for _, record := range deleted {
+		id, _ := numericValue(record["id"])
+		before, after := record, Record(nil)
+		if record[deletedAtColumn] != nil {
+			before = make(Record, len(record))
+			for key, value := range record {
+				before[key] = value
+			}
+			before[deletedAtColumn] = nil
+			after = record
+		}
+		auditRecordChange(tableName, int64(id), auditDelete, before, after, actor)
+	}
+}
+
+// auditBulkChange adds a bulk operation on a table to the audit log. Like
+// auditRecordChange it only logs a failure.
+func auditBulkChange(tableName, operation string, summary map[string]interface{}, actor string) {
+	entry := AuditEntry{
+		Table:     tableName,
+		Operation: operation,
+		Before:    map[string]interface{}{},
+		After:     summary,
+		Actor:     actor,
+		ChangedAt: time.Now().UTC(),
+	}
+	if err := store.RecordAudit(entry); err != nil {
+		log.Printf("Warning: Failed to record %s of table %s in the audit log: %v", operation, tableName, err)
+	}
+}
+
+// auditHandler serves GET /audit
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	writeAuditEntries(w, query)
+}
+
+// recordHistoryHandler serves GET .../records/{id}/history, the audit entries of one
+// record, newest first
+func recordHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	tableName, id, ok := auditedRecord(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	params.Del("table")
+	params.Del("recordId")
+	query, err := parseAuditQuery(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	query.Table = tableName
+	query.RecordID = &id
+	writeAuditEntries(w, query)
+}
+
+func writeAuditEntries(w http.ResponseWriter, query auditQuery) {
+	entries, total, err := store.AuditEntries(query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// recordRevertHandler serves POST .../records/{id}/revert. The body names the state to
+// go back to, either {"version": n} or {"entry": auditEntryID}; changes recorded since
+// then are undone in a single update, which is itself recorded as a revert.
+func recordRevertHandler(w http.ResponseWriter, r *http.Request) {
+	tableName, id, ok := auditedRecord(w, r)
+	if !ok {
+		return
+	}
+
+	var revertRequest struct {
+		Version *int64 `json:"version"`
+		Entry   *int64 `json:"entry"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&revertRequest); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if (revertRequest.Version == nil) == (revertRequest.Entry == nil) {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Either version or entry is required")
+		return
+	}
+
+	history, _, err := store.AuditEntries(auditQuery{Table: tableName, RecordID: &id})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	target := -1
+	for i, entry := range history {
+		if entry.Operation == auditDelete {
+			continue
+		}
+		if (revertRequest.Entry != nil && entry.ID == *revertRequest.Entry) ||
+			(revertRequest.Version != nil && entry.Version != nil && *entry.Version == *revertRequest.Version) {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "No recorded state of the record matches the requested version")
+		return
+	}
+
+	record, err := revertRecordInTable(tableName, int(id), history[:target], r.Header.Get("If-Match"), requestActor(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	fmt.Printf("Table '%s' record %d reverted to audit entry %d\n", tableName, id, history[target].ID)
+	w.Header().Set("ETag", recordETag(record))
+	writeJSON(w, http.StatusOK, record)
+}
+
+// revertRecordInTable undoes the given changes, newest first, on the current record.
+// Fields whose column no longer exists are left alone.
+func revertRecordInTable(tableName string, id int, undo []AuditEntry, ifMatch, actor string) (Record, error) {
+	current, err := store.GetRecord(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	version, err := checkIfMatch(ifMatch, current)
+	if err != nil {
+		return nil, err
+	}
+	original, err := recordDocument(current)
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := make(map[string]interface{}, len(original))
+	for key, value := range original {
+		reverted[key] = value
+	}
+	for _, entry := range undo {
+		for key, value := range entry.Before {
+			if _, exists := original[key]; exists {
+				reverted[key] = value
+			}
+		}
+	}
+
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := patchChanges(original, reverted, system)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return current, nil
+	}
+	return updateRecordAs(auditRevert, tableName, id, changes, version, actor)
+}
+
+// auditedRecord resolves the table and id of a history or revert request
+func auditedRecord(w http.ResponseWriter, r *http.Request) (string, int64, bool) {
+	tableName := recordTableName(r)
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return "", 0, false
+	}
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return "", 0, false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
+		return "", 0, false
+	}
+	return tableName, id, true
+}
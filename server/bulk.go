@@ -0,0 +1,658 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bulkModeAtomic     = "atomic"
+	bulkModeBestEffort = "bestEffort"
+
+	// PostgreSQL accepts at most 65535 bind parameters per statement
+	maxBulkParams    = 65535
+	maxBulkChunkRows = 1000
+)
+
+// bulkRecordRequest is the payload accepted by POST /records/bulk.
+// The client sends rows under "users"; "records" is accepted as an alias.
+type bulkRecordRequest struct {
+	Table   string   `json:"table"`
+	Mode    string   `json:"mode"`
+	Users   []Record `json:"users"`
+	Records []Record `json:"records"`
+}
+
+// bulkRowResult reports the outcome for a single row of a bulk request
+type bulkRowResult struct {
+	Index  int          `json:"index"`
+	ID     int          `json:"id,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// bulkRecordHandler inserts many records into a table in a single transaction
+func bulkRecordHandler(w http.ResponseWriter, r *http.Request) {
+	var bulkRequest bulkRecordRequest
+	if err := json.NewDecoder(r.Body).Decode(&bulkRequest); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	tableName := bulkRequest.Table
+	if tableName == "" {
+		tableName = r.URL.Query().Get("table")
+	}
+	if tableName == "" {
+		tableName = "users"
+	}
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	mode := bulkRequest.Mode
+	if mode == "" {
+		mode = bulkModeAtomic
+	}
+	if mode != bulkModeAtomic && mode != bulkModeBestEffort {
+		writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid mode '%s': expected '%s' or '%s'", mode, bulkModeAtomic, bulkModeBestEffort))
+		return
+	}
+
+	rows := append(bulkRequest.Users, bulkRequest.Records...)
+	if len(rows) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "At least one record is required")
+		return
+	}
+
+	tableExists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !tableExists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+
+	results, committed, err := bulkCreateRecordsInTable(tableName, rows, mode, requestActor(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	created, failed := 0, 0
+	for _, result := range results {
+		if len(result.Errors) > 0 {
+			failed++
+		} else if committed {
+			created++
+		}
+	}
+
+	status := http.StatusCreated
+	if !committed {
+		status = http.StatusUnprocessableEntity
+	} else if failed > 0 {
+		status = http.StatusOK
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"table":     tableName,
+		"mode":      mode,
+		"committed": committed,
+		"created":   created,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// bulkCreateRecordsInTable validates every row and hands the valid ones to the store, which
+// inserts them inside one transaction. In atomic mode any failing row rolls back the whole
+// batch; in best-effort mode failing rows are reported and the rest are committed. The
+// returned bool reports whether the transaction was committed.
+func bulkCreateRecordsInTable(tableName string, rows []Record, mode, actor string) ([]bulkRowResult, bool, error) {
+	metadata, err := store.ColumnMetadata(tableName)
+	if err != nil {
+		return nil, false, err
+	}
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		return nil, false, err
+	}
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return nil, false, err
+	}
+	schemaMode, err := store.SchemaMode(tableName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	results := make([]bulkRowResult, len(rows))
+	invalid := 0
+	for i, row := range rows {
+		results[i].Index = i
+		stripSystemFields(row, system)
+		if fieldErrors := collidingFields(row); len(fieldErrors) > 0 {
+			results[i].Errors = fieldErrors
+			invalid++
+			continue
+		}
+		if fieldErrors := applySchemaMode(schemaMode, columns, row); len(fieldErrors) > 0 {
+			results[i].Errors = fieldErrors
+			invalid++
+			continue
+		}
+		applyColumnDefaults(metadata, row)
+		if fieldErrors := validateRecord(tableName, metadata, row, true, 0); len(fieldErrors) > 0 {
+			results[i].Errors = fieldErrors
+			invalid++
+			continue
+		}
+		stampRecord(row, system, actor, true)
+	}
+	invalid += checkBatchUniqueness(metadata, rows, results)
+	if invalid > 0 && mode == bulkModeAtomic {
+		return results, false, nil
+	}
+
+	committed, err := store.InsertRecords(tableName, rows, results, mode == bulkModeAtomic)
+	if err != nil {
+		return nil, false, err
+	}
+	if !committed {
+		for i := range results {
+			results[i].ID = 0
+		}
+		return results, false, nil
+	}
+	recordBulkColumns(tableName, columns, actor)
+
+	ids := []int{}
+	for _, result := range results {
+		if result.ID != 0 {
+			ids = append(ids, result.ID)
+		}
+	}
+	auditBulkChange(tableName, auditBulkCreate, map[string]interface{}{"created": len(ids), "ids": ids}, actor)
+	return results, true, nil
+}
+
+// recordBulkColumns adds the columns a bulk insert created to the migration log, reading
+// their types back from the table
+func recordBulkColumns(tableName string, previous []string, actor string) {
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		log.Printf("Warning: Failed to record new columns of table %s in the migration log: %v", tableName, err)
+		return
+	}
+	for _, column := range schema.Columns {
+		if containsString(previous, column.Name) {
+			continue
+		}
+		change := schemaChange{Actor: actor, Reason: fmt.Sprintf("new field '%s' in a bulk insert", column.Name)}
+		recordMigration(change, tableName, migrationAddColumn,
+			[]string{addColumnStatement(tableName, column.Name, column.Type)}, []string{dropColumnStatement(tableName, column.Name)})
+	}
+}
+
+// collidingFields flags the keys of a row that sanitize to the same column as another
+// key, such as "First Name" and "first_name", since only one of the values could be stored
+func collidingFields(row Record) []FieldError {
+	keys := make([]string, 0, len(row))
+	for key := range row {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var fieldErrors []FieldError
+	firstKey := make(map[string]string, len(keys))
+	for _, key := range keys {
+		col := sanitizeColumnName(key)
+		if first, seen := firstKey[col]; seen {
+			fieldErrors = append(fieldErrors, FieldError{Field: key, Code: codeDuplicateField, Message: fmt.Sprintf("'%s' and '%s' both map to column %s", first, key, col)})
+			continue
+		}
+		firstKey[col] = key
+	}
+	return fieldErrors
+}
+
+// planBulkColumns maps every key of the rows still eligible for insertion to its column
+// name. It returns that mapping, the sorted list of insert columns and the columns that
+// don't exist yet, typed from the first non-null sample of each key.
+func planBulkColumns(rows []Record, results []bulkRowResult, existingColumns []string) (map[string]string, []string, []columnDef, error) {
+	existing := make(map[string]bool, len(existingColumns))
+	for _, col := range existingColumns {
+		existing[col] = true
+	}
+
+	keyColumns := make(map[string]string)
+	samples := make(map[string][]interface{})
+	for i, row := range rows {
+		if len(results[i].Errors) > 0 {
+			continue
+		}
+		for key, value := range row {
+			if key == "id" {
+				continue
+			}
+			if _, seen := keyColumns[key]; !seen {
+				keyColumns[key] = sanitizeColumnName(key)
+			}
+			if value != nil && len(samples[key]) < maxInferenceSamples {
+				samples[key] = append(samples[key], value)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(keyColumns))
+	for key := range keyColumns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var insertColumns []string
+	var newColumns []columnDef
+	for _, key := range keys {
+		col := keyColumns[key]
+		if col == "id" {
+			delete(keyColumns, key)
+			continue
+		}
+		if !existing[col] {
+			if err := validateColumnName(col); err != nil {
+				return nil, nil, nil, err
+			}
+			newColumns = append(newColumns, columnDef{Name: col, Type: inferColumnType(col, samples[key])})
+			existing[col] = true
+		}
+		if !containsString(insertColumns, col) {
+			insertColumns = append(insertColumns, col)
+		}
+	}
+	return keyColumns, insertColumns, newColumns, nil
+}
+
+// prepareBulkColumns creates any missing columns once for the union of keys across valid rows.
+// It returns the mapping from record key to column name and the sorted list of insert columns.
+func prepareBulkColumns(tx *sql.Tx, tableName string, rows []Record, results []bulkRowResult) (map[string]string, []string, error) {
+	columns, err := getTableColumns(tx, tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyColumns, insertColumns, newColumns, err := planBulkColumns(rows, results, columns)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, col := range newColumns {
+		if err := addColumnWithType(tx, tableName, col.Name, col.Type); err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("Added new column '%s' to table '%s' during bulk insert\n", col.Name, tableName)
+	}
+	return keyColumns, insertColumns, nil
+}
+
+// pendingBulkRows returns the indexes of rows still eligible for insertion, flagging rows
+// that have no field mapping to a column
+func pendingBulkRows(rows []Record, results []bulkRowResult, keyColumns map[string]string) []int {
+	var pending []int
+	for i, row := range rows {
+		if len(results[i].Errors) > 0 {
+			continue
+		}
+		if !hasInsertableField(row, keyColumns) {
+			results[i].Errors = []FieldError{{Code: codeNoFields, Message: "no valid fields provided"}}
+			continue
+		}
+		pending = append(pending, i)
+	}
+	return pending
+}
+
+// bulkHasErrors reports whether any row of the batch failed
+func bulkHasErrors(results []bulkRowResult) bool {
+	for _, result := range results {
+		if len(result.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// insertBulkChunk inserts a chunk of rows with one multi-row INSERT. If the statement fails,
+// the chunk is retried row by row under savepoints so each failure can be attributed.
+func insertBulkChunk(tx *sql.Tx, tableName string, insertColumns []string, keyColumns map[string]string, rows []Record, indexes []int, results []bulkRowResult) error {
+	if _, err := tx.Exec("SAVEPOINT bulk_chunk"); err != nil {
+		return err
+	}
+
+	ids, err := insertBulkRows(tx, tableName, insertColumns, keyColumns, rows, indexes)
+	if err == nil {
+		for i, index := range indexes {
+			results[index].ID = ids[i]
+		}
+		_, err = tx.Exec("RELEASE SAVEPOINT bulk_chunk")
+		return err
+	}
+
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT bulk_chunk"); err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if _, err := tx.Exec("SAVEPOINT bulk_row"); err != nil {
+			return err
+		}
+		ids, err := insertBulkRows(tx, tableName, insertColumns, keyColumns, rows, []int{index})
+		if err != nil {
+			results[index].Errors = []FieldError{{Code: codeInsertFailed, Message: err.Error()}}
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT bulk_row"); err != nil {
+				return err
+			}
+			continue
+		}
+		results[index].ID = ids[0]
+		if _, err := tx.Exec("RELEASE SAVEPOINT bulk_row"); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("RELEASE SAVEPOINT bulk_chunk")
+	return err
+}
+
+// insertBulkRows runs a single multi-row INSERT and returns the new ids in row order.
+// Keys missing from a row are inserted as DEFAULT.
+func insertBulkRows(exec sqlExecutor, tableName string, insertColumns []string, keyColumns map[string]string, rows []Record, indexes []int) ([]int, error) {
+	var tuples []string
+	var values []interface{}
+	placeholderIndex := 1
+
+	for _, index := range indexes {
+		rowValues := make(map[string]interface{}, len(rows[index]))
+		for key, value := range rows[index] {
+			if col, ok := keyColumns[key]; ok {
+				rowValues[col] = value
+			}
+		}
+
+		placeholders := make([]string, len(insertColumns))
+		for i, col := range insertColumns {
+			value, exists := rowValues[col]
+			if !exists {
+				placeholders[i] = "DEFAULT"
+				continue
+			}
+			placeholders[i] = fmt.Sprintf("$%d", placeholderIndex)
+			values = append(values, columnValue(value))
+			placeholderIndex++
+		}
+		tuples = append(tuples, "("+strings.Join(placeholders, ", ")+")")
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s(%s) VALUES %s RETURNING id",
+		quoteIdentifier(tableName),
+		quoteIdentifiers(insertColumns),
+		strings.Join(tuples, ", "),
+	)
+
+	result, err := exec.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	ids := make([]int, 0, len(indexes))
+	for result.Next() {
+		var id int
+		if err := result.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) != len(indexes) {
+		return nil, fmt.Errorf("expected %d inserted rows, got %d", len(indexes), len(ids))
+	}
+	return ids, nil
+}
+
+// hasInsertableField reports whether a row has at least one key that maps to an insert column
+func hasInsertableField(row Record, keyColumns map[string]string) bool {
+	for key := range row {
+		if _, ok := keyColumns[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBatchUniqueness flags rows that repeat a value of a unique column already used by an
+// earlier row in the same batch, returning the number of newly invalidated rows
+func checkBatchUniqueness(metadata []ColumnMetadata, rows []Record, results []bulkRowResult) int {
+	invalid := 0
+	for _, meta := range metadata {
+		if !meta.Rules.Unique {
+			continue
+		}
+		seen := make(map[string]bool)
+		for i, row := range rows {
+			value, exists := row[meta.Key]
+			if !exists || isBlank(value) || len(results[i].Errors) > 0 {
+				continue
+			}
+			key := fmt.Sprint(value)
+			if seen[key] {
+				results[i].Errors = append(results[i].Errors, FieldError{Field: meta.Key, Code: codeNotUnique, Message: fmt.Sprintf("%s must be unique within the batch", meta.Label)})
+				invalid++
+				continue
+			}
+			seen[key] = true
+		}
+	}
+	return invalid
+}
+
+// truncateTokenTTL is how long a truncate confirmation token stays valid
+const truncateTokenTTL = 2 * time.Minute
+
+type truncateConfirmation struct {
+	tableName string
+	expires   time.Time
+}
+
+var (
+	truncateTokensMu sync.Mutex
+	truncateTokens   = map[string]truncateConfirmation{}
+)
+
+// issueTruncateToken creates a single-use token that confirms truncating tableName
+func issueTruncateToken(tableName string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	truncateTokensMu.Lock()
+	defer truncateTokensMu.Unlock()
+	now := time.Now()
+	for key, confirmation := range truncateTokens {
+		if now.After(confirmation.expires) {
+			delete(truncateTokens, key)
+		}
+	}
+	truncateTokens[token] = truncateConfirmation{tableName: tableName, expires: now.Add(truncateTokenTTL)}
+	return token, nil
+}
+
+// consumeTruncateToken reports whether token is a live confirmation for tableName and invalidates it
+func consumeTruncateToken(token, tableName string) bool {
+	truncateTokensMu.Lock()
+	defer truncateTokensMu.Unlock()
+	confirmation, ok := truncateTokens[token]
+	if !ok {
+		return false
+	}
+	delete(truncateTokens, token)
+	return confirmation.tableName == tableName && time.Now().Before(confirmation.expires)
+}
+
+// bulkDeleteHandler deletes many records at once. It accepts ids (query "ids=1,2" or body
+// {"ids": [...]}), filter[...] expressions as used by GET /records, or all=true to truncate
+// the table. Truncation must be confirmed with a token obtained from a first unconfirmed call.
+// On a soft-deleting table all=true moves every record to the trash instead, unless
+// permanent=true is given as well.
+func bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := recordTableName(r)
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	tableExists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !tableExists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+
+	params := r.URL.Query()
+
+	var body struct {
+		IDs []int `json:"ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+			return
+		}
+	}
+	ids := body.IDs
+	if idsStr := params.Get("ids"); idsStr != "" {
+		for _, part := range strings.Split(idsStr, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidID, fmt.Sprintf("Invalid record ID '%s'", part))
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	query, err := parseRecordQuery(params, columns)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	// The client's "delete all" sends bulk=true without ids or filters
+	deleteAll := params.Get("all") == "true" ||
+		(params.Get("bulk") == "true" && len(ids) == 0 && len(query.Filters) == 0)
+
+	if deleteAll {
+		if len(ids) > 0 || len(query.Filters) > 0 {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "all=true cannot be combined with ids or filters")
+			return
+		}
+
+		confirm := params.Get("confirm")
+		if confirm == "" || !consumeTruncateToken(confirm, tableName) {
+			token, err := issueTruncateToken(tableName)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeErrorDetails(w, http.StatusPreconditionRequired, codeConfirmationRequired,
+				fmt.Sprintf("Truncating table '%s' must be confirmed: repeat the request with confirm=<confirmationToken>", tableName),
+				map[string]interface{}{
+					"confirmationToken": token,
+					"expiresIn":         int(truncateTokenTTL.Seconds()),
+				})
+			return
+		}
+
+		// A soft-deleting table keeps its records in the trash unless permanent=true
+		soft, err := softDeletes(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if soft && params.Get("permanent") != "true" {
+			deleted, err := store.DeleteRecords(tableName, nil, recordQuery{})
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			auditDeletedRecords(tableName, deleted, requestActor(r))
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"message": fmt.Sprintf("Moved %d records of '%s' to the trash", len(deleted), tableName),
+				"deleted": len(deleted),
+			})
+			return
+		}
+
+		deleted, err := store.TruncateTable(tableName, params.Get("restartIdentity") == "true")
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		auditBulkChange(tableName, auditTruncate, map[string]interface{}{"deleted": deleted}, requestActor(r))
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"message": fmt.Sprintf("Table '%s' truncated", tableName),
+			"deleted": deleted,
+		})
+		return
+	}
+
+	if len(ids) == 0 && len(query.Filters) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Bulk delete requires ids, a filter or all=true")
+		return
+	}
+
+	deleted, err := store.DeleteRecords(tableName, ids, query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	auditDeletedRecords(tableName, deleted, requestActor(r))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("Deleted %d records from '%s'", len(deleted), tableName),
+		"deleted": len(deleted),
+	})
+}
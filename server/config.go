@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to every environment variable name read by loadConfig
+const envPrefix = "MOCK2_"
+
+const redacted = "REDACTED"
+
+// Config holds every runtime setting of the server
+type Config struct {
+	Database DatabaseConfig `yaml:"database"`
+	Server   ServerConfig   `yaml:"server"`
+	Trash    TrashConfig    `yaml:"trash"`
+	LogLevel string         `yaml:"logLevel"`
+}
+
+// DatabaseConfig holds the PostgreSQL connection and pool settings
+type DatabaseConfig struct {
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"sslMode"`
+	MaxOpenConns    int           `yaml:"maxOpenConns"`
+	MaxIdleConns    int           `yaml:"maxIdleConns"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
+}
+
+// ServerConfig holds the HTTP listener settings
+type ServerConfig struct {
+	Addr         string        `yaml:"addr"`
+	CORSOrigins  []string      `yaml:"corsOrigins"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+}
+
+// TrashConfig controls how long deleted records and dropped tables can be restored
+type TrashConfig struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purgeInterval"` // 0 disables the background purge
+}
+
+func defaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            5432,
+			User:            "postgres",
+			Name:            "mock2",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		Server: ServerConfig{
+			Addr:         ":8080",
+			CORSOrigins:  []string{"http://localhost:3001"},
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		Trash: TrashConfig{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		LogLevel: "info",
+	}
+}
+
+// setting ties a flag and an environment variable to the config field it sets
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(cfg *Config, value string) error
+}
+
+var settings = []setting{
+	{"db-host", "DB_HOST", "database host", func(cfg *Config, v string) error { cfg.Database.Host = v; return nil }},
+	{"db-port", "DB_PORT", "database port", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.Port) }},
+	{"db-user", "DB_USER", "database user", func(cfg *Config, v string) error { cfg.Database.User = v; return nil }},
+	{"db-password", "DB_PASSWORD", "database password", func(cfg *Config, v string) error { cfg.Database.Password = v; return nil }},
+	{"db-name", "DB_NAME", "database name", func(cfg *Config, v string) error { cfg.Database.Name = v; return nil }},
+	{"db-sslmode", "DB_SSLMODE", "database sslmode", func(cfg *Config, v string) error { cfg.Database.SSLMode = v; return nil }},
+	{"db-max-open-conns", "DB_MAX_OPEN_CONNS", "maximum open database connections", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.MaxOpenConns) }},
+	{"db-max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum idle database connections", func(cfg *Config, v string) error { return parseInt(v, &cfg.Database.MaxIdleConns) }},
+	{"db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "maximum lifetime of a database connection", func(cfg *Config, v string) error {
+		return parseDuration(v, &cfg.Database.ConnMaxLifetime)
+	}},
+	{"addr", "ADDR", "HTTP listen address", func(cfg *Config, v string) error { cfg.Server.Addr = v; return nil }},
+	{"cors-origins", "CORS_ORIGINS", "comma separated list of allowed CORS origins", func(cfg *Config, v string) error {
+		cfg.Server.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"read-timeout", "READ_TIMEOUT", "HTTP read timeout", func(cfg *Config, v string) error { return parseDuration(v, &cfg.Server.ReadTimeout) }},
+	{"write-timeout", "WRITE_TIMEOUT", "HTTP write timeout", func(cfg *Config, v string) error { return parseDuration(v, &cfg.Server.WriteTimeout) }},
+	{"idle-timeout", "IDLE_TIMEOUT", "HTTP idle timeout", func(cfg *Config, v string) error { return parseDuration(v, &cfg.Server.IdleTimeout) }},
+	{"trash-retention", "TRASH_RETENTION", "how long deleted records and dropped tables are kept", func(cfg *Config, v string) error {
+		return parseDuration(v, &cfg.Trash.Retention)
+	}},
+	{"trash-purge-interval", "TRASH_PURGE_INTERVAL", "how often expired trash is purged (0 disables)", func(cfg *Config, v string) error {
+		return parseDuration(v, &cfg.Trash.PurgeInterval)
+	}},
+	{"log-level", "LOG_LEVEL", "log level (debug, info, warn, error)", func(cfg *Config, v string) error { cfg.LogLevel = v; return nil }},
+}
+
+// loadConfig builds the configuration from, in increasing order of precedence: built-in
+// defaults, the YAML file named by -config or MOCK2_CONFIG, MOCK2_* environment variables
+// and command line flags. It also reports whether -print-config was given.
+func loadConfig(args []string) (Config, bool, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file (env "+envPrefix+"CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (env %s%s)", s.usage, envPrefix, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, false, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, false, fmt.Errorf("failed to parse config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(envPrefix + s.env); ok {
+			if err := s.apply(&cfg, value); err != nil {
+				return cfg, false, fmt.Errorf("invalid %s%s: %w", envPrefix, s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.apply(&cfg, *flagValues[s.flag]); err != nil {
+					flagErr = fmt.Errorf("invalid -%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, false, flagErr
+	}
+
+	if _, err := cfg.slogLevel(); err != nil {
+		return cfg, false, err
+	}
+	return cfg, *printConfig, nil
+}
+
+// DSN returns the lib/pq connection string for the database settings
+func (c DatabaseConfig) DSN() string {
+	parts := []string{
+		"host=" + quoteDSNValue(c.Host),
+		"port=" + strconv.Itoa(c.Port),
+		"user=" + quoteDSNValue(c.User),
+		"dbname=" + quoteDSNValue(c.Name),
+		"sslmode=" + quoteDSNValue(c.SSLMode),
+	}
+	if c.Password != "" {
+		parts = append(parts, "password="+quoteDSNValue(c.Password))
+	}
+	return strings.Join(parts, " ")
+}
+
+// redacted returns a copy of the configuration that is safe to print
+func (c Config) redacted() Config {
+	if c.Database.Password != "" {
+		c.Database.Password = redacted
+	}
+	return c
+}
+
+// writeConfig prints the configuration as YAML with secrets redacted
+func writeConfig(w io.Writer, cfg Config) error {
+	data, err := yaml.Marshal(cfg.redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// slogLevel converts the configured log level to a slog level
+func (c Config) slogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return level, fmt.Errorf("invalid log level '%s'", c.LogLevel)
+	}
+	return level, nil
+}
+
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+func parseInt(value string, target *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
+
+func parseDuration(value string, target *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
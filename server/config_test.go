@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		yaml    string
+		env     map[string]string
+		args    []string
+		wantErr string
+		check   func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg Config) {
+				if !reflect.DeepEqual(cfg, defaultConfig()) {
+					t.Errorf("expected the defaults, got %+v", cfg)
+				}
+				if !reflect.DeepEqual(cfg.Server.CORSOrigins, []string{"http://localhost:3001"}) {
+					t.Errorf("expected the dev client origin, got %v", cfg.Server.CORSOrigins)
+				}
+			},
+		},
+		{
+			name: "precedence",
+			yaml: "database:\n  host: yaml-host\n  port: 6000\n  user: yaml-user\nserver:\n  addr: \":9000\"\n",
+			env:  map[string]string{"MOCK2_DB_PORT": "7000", "MOCK2_DB_USER": "env-user", "MOCK2_ADDR": ":9100"},
+			args: []string{"-addr", ":9200"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.Name != "mock2" {
+					t.Errorf("expected the default name, got %s", cfg.Database.Name)
+				}
+				if cfg.Database.Host != "yaml-host" {
+					t.Errorf("expected the YAML host, got %s", cfg.Database.Host)
+				}
+				if cfg.Database.Port != 7000 || cfg.Database.User != "env-user" {
+					t.Errorf("expected the environment to override YAML, got %d %s", cfg.Database.Port, cfg.Database.User)
+				}
+				if cfg.Server.Addr != ":9200" {
+					t.Errorf("expected the flag to override the environment, got %s", cfg.Server.Addr)
+				}
+			},
+		},
+		{
+			name: "yaml durations",
+			yaml: "database:\n  connMaxLifetime: 45m\nserver:\n  readTimeout: 5s\ntrash:\n  retention: 48h\n  purgeInterval: 0s\n",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.ConnMaxLifetime != 45*time.Minute || cfg.Server.ReadTimeout != 5*time.Second {
+					t.Errorf("unexpected durations %v %v", cfg.Database.ConnMaxLifetime, cfg.Server.ReadTimeout)
+				}
+				if cfg.Trash.Retention != 48*time.Hour || cfg.Trash.PurgeInterval != 0 {
+					t.Errorf("unexpected trash durations %v %v", cfg.Trash.Retention, cfg.Trash.PurgeInterval)
+				}
+			},
+		},
+		{
+			name: "list settings",
+			env:  map[string]string{"MOCK2_CORS_ORIGINS": "http://a.example, http://b.example,"},
+			check: func(t *testing.T, cfg Config) {
+				if !reflect.DeepEqual(cfg.Server.CORSOrigins, []string{"http://a.example", "http://b.example"}) {
+					t.Errorf("unexpected origins %v", cfg.Server.CORSOrigins)
+				}
+			},
+		},
+		{name: "invalid yaml duration", yaml: "server:\n  readTimeout: soon\n", wantErr: "failed to parse config file"},
+		{name: "missing config file", args: []string{"-config", "missing.yaml"}, wantErr: "failed to read config file"},
+		{name: "invalid env value", env: map[string]string{"MOCK2_DB_PORT": "abc"}, wantErr: "invalid MOCK2_DB_PORT"},
+		{name: "invalid flag value", args: []string{"-write-timeout", "later"}, wantErr: "invalid -write-timeout"},
+		{name: "invalid log level", yaml: "logLevel: loud\n", wantErr: "invalid log level 'loud'"},
+		{name: "unknown flag", args: []string{"-nope"}, wantErr: "flag provided but not defined"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.yaml != "" {
+				t.Setenv("MOCK2_CONFIG", writeConfigFile(t, tc.yaml))
+			}
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			cfg, _, err := loadConfig(tc.args)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	t.Setenv("MOCK2_DB_PASSWORD", "hunter2")
+	cfg, printConfig, err := loadConfig([]string{"-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Fatal("expected -print-config to be reported")
+	}
+
+	var out bytes.Buffer
+	if err := writeConfig(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") || !strings.Contains(out.String(), "password: "+redacted) {
+		t.Errorf("expected the password to be redacted, got:\n%s", out.String())
+	}
+	if cfg.Database.Password != "hunter2" {
+		t.Errorf("redaction must not change the loaded config, got %q", cfg.Database.Password)
+	}
+}
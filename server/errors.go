@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Error codes returned in the "code" field of the error envelope
+const (
+	codeBadRequest           = "BAD_REQUEST"
+	codeInvalidJSON          = "INVALID_JSON"
+	codeInvalidIdentifier    = "INVALID_IDENTIFIER"
+	codeInvalidQuery         = "INVALID_QUERY"
+	codeInvalidID            = "INVALID_ID"
+	codeInvalidValue         = "INVALID_VALUE"
+	codeInvalidPatch         = "INVALID_PATCH"
+	codePatchTestFailed      = "PATCH_TEST_FAILED"
+	codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	codeNotFound             = "NOT_FOUND"
+	codeTableNotFound        = "TABLE_NOT_FOUND"
+	codeColumnNotFound       = "COLUMN_NOT_FOUND"
+	codeIndexNotFound        = "INDEX_NOT_FOUND"
+	codeRecordNotFound       = "RECORD_NOT_FOUND"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeForbidden            = "FORBIDDEN"
+	codeTableExists          = "TABLE_EXISTS"
+	codeColumnExists         = "COLUMN_EXISTS"
+	codeIndexExists          = "INDEX_EXISTS"
+	codeDuplicateValues      = "DUPLICATE_VALUES"
+	codeUniqueViolation      = "UNIQUE_VIOLATION"
+	codeNotNullViolation     = "NOT_NULL_VIOLATION"
+	codeForeignKeyViolation  = "FOREIGN_KEY_VIOLATION"
+	codeRecordReferenced     = "RECORD_REFERENCED"
+	codeTableReferenced      = "TABLE_REFERENCED"
+	codeUndefinedColumn      = "UNDEFINED_COLUMN"
+	codeValidationFailed     = "VALIDATION_FAILED"
+	codeConversionFailed     = "CONVERSION_FAILED"
+	codeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	codePreconditionFailed   = "PRECONDITION_FAILED"
+	codeInternal             = "INTERNAL_ERROR"
+)
+
+// errNoFields is returned by stores when a record has no field matching a column
+var errNoFields = errors.New("no valid fields provided")
+
+// errPreconditionFailed is returned when a conditional write finds the record changed
+var errPreconditionFailed = errors.New("record was changed since it was read")
+
+// errUnversioned is returned when a conditional write targets a table without
+// row_version, where the write couldn't check the precondition itself
+var errUnversioned = errors.New("table has no row_version column")
+
+// uniqueKeyPattern extracts the column list from a unique or foreign key violation
+// detail such as "Key (email)=(a@example.com) already exists."
+var uniqueKeyPattern = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+// APIError is the body of every error response, wrapped as {"error": {...}}
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// writeJSON responds with status and v encoded as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// writeError responds with the error envelope
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails responds with the error envelope including details
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	writeJSON(w, status, map[string]APIError{
+		"error": {Code: code, Message: message, Details: details},
+	})
+}
+
+// writeStoreError maps an error returned while handling a request to a status and code.
+// PostgreSQL errors are mapped by SQLSTATE; anything unrecognised is logged and reported
+// as a 500 without exposing the underlying message.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		writeValidationError(w, validationErr)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeRecordNotFound, "Record not found")
+		return
+	}
+	var duplicatesErr *duplicateValuesError
+	if errors.As(err, &duplicatesErr) {
+		message := fmt.Sprintf("Unique index '%s' can't be created: existing rows share the same values", duplicatesErr.Index)
+		writeErrorDetails(w, http.StatusConflict, codeDuplicateValues, message, duplicatesErr.Conflicts)
+		return
+	}
+	var patchErr *patchError
+	if errors.As(err, &patchErr) {
+		writeError(w, patchErr.status, patchErr.code, patchErr.message)
+		return
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, codePreconditionFailed, "The record was changed since it was read")
+		return
+	}
+	if errors.Is(err, errUnversioned) {
+		writeError(w, http.StatusPreconditionFailed, codePreconditionFailed, "The table has no row_version column, so If-Match can't be enforced")
+		return
+	}
+	if errors.Is(err, errNoFields) {
+		writeError(w, http.StatusBadRequest, codeNoFields, "No valid fields provided")
+		return
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			var details []FieldError
+			if match := uniqueKeyPattern.FindStringSubmatch(pqErr.Detail); match != nil {
+				details = append(details, FieldError{Field: match[1], Code: codeNotUnique, Message: pqErr.Detail})
+			}
+			writeErrorDetails(w, http.StatusConflict, codeUniqueViolation, "A record with the same value already exists", details)
+			return
+		case "not_null_violation":
+			details := []FieldError{{Field: pqErr.Column, Code: codeRequired, Message: fmt.Sprintf("%s is required", pqErr.Column)}}
+			writeErrorDetails(w, http.StatusUnprocessableEntity, codeNotNullViolation, "A required value is missing", details)
+			return
+		case "foreign_key_violation":
+			if strings.Contains(pqErr.Detail, "still referenced") {
+				writeError(w, http.StatusConflict, codeRecordReferenced, "The record is still referenced by other records")
+				return
+			}
+			var details []FieldError
+			if match := uniqueKeyPattern.FindStringSubmatch(pqErr.Detail); match != nil {
+				details = append(details, FieldError{Field: match[1], Code: codeInvalidLink, Message: pqErr.Detail})
+			}
+			writeErrorDetails(w, http.StatusUnprocessableEntity, codeForeignKeyViolation, "A linked record does not exist", details)
+			return
+		case "dependent_objects_still_exist", "feature_not_supported":
+			// TRUNCATE of a referenced table reports feature_not_supported
+			if pqErr.Code.Name() == "feature_not_supported" && !strings.Contains(pqErr.Message, "foreign key") {
+				break
+			}
+			message := pqErr.Message
+			if pqErr.Detail != "" {
+				message += ": " + pqErr.Detail
+			}
+			writeError(w, http.StatusConflict, codeTableReferenced, message)
+			return
+		case "undefined_column":
+			writeError(w, http.StatusBadRequest, codeUndefinedColumn, pqErr.Message)
+			return
+		case "undefined_table":
+			writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+			return
+		case "duplicate_table":
+			writeError(w, http.StatusConflict, codeTableExists, "Table already exists")
+			return
+		case "duplicate_column":
+			writeError(w, http.StatusConflict, codeColumnExists, "Column already exists")
+			return
+		case "invalid_object_definition", "wrong_object_type":
+			writeError(w, http.StatusBadRequest, codeBadRequest, pqErr.Message)
+			return
+		case "invalid_text_representation", "invalid_datetime_format", "datetime_field_overflow",
+			"numeric_value_out_of_range", "string_data_right_truncation":
+			writeError(w, http.StatusBadRequest, codeInvalidValue, pqErr.Message)
+			return
+		}
+	}
+
+	log.Printf("Internal error: %v", err)
+	writeError(w, http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// jsonMuxErrors replaces the plain text 404 and 405 responses the mux writes for
+// unmatched requests with the error envelope
+func jsonMuxErrors(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &muxErrorWriter{ResponseWriter: w}
+		}
+		mux.ServeHTTP(w, r)
+	}
+}
+
+type muxErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (w *muxErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, codeNotFound, "Not found")
+	case http.StatusMethodNotAllowed:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, codeMethodNotAllowed, "Method not allowed")
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
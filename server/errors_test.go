@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+type errorEnvelope struct {
+	Error struct {
+		Code    string       `json:"code"`
+		Message string       `json:"message"`
+		Details []FieldError `json:"details"`
+	} `json:"error"`
+}
+
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) errorEnvelope {
+	t.Helper()
+	expectStatus(t, rec, status)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected application/json, got %q", contentType)
+	}
+	var envelope errorEnvelope
+	decodeBody(t, rec, &envelope)
+	if envelope.Error.Code != code {
+		t.Fatalf("expected code %s, got %s (%s)", code, envelope.Error.Code, envelope.Error.Message)
+	}
+	return envelope
+}
+
+func TestWriteStoreErrorMapsSQLState(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&pq.Error{Code: "23505", Detail: "Key (email)=(ada@example.com) already exists."}, http.StatusConflict, codeUniqueViolation},
+		{&pq.Error{Code: "23502", Column: "name"}, http.StatusUnprocessableEntity, codeNotNullViolation},
+		{&pq.Error{Code: "42703", Message: `column "nope" does not exist`}, http.StatusBadRequest, codeUndefinedColumn},
+		{&pq.Error{Code: "22P02", Message: "invalid input syntax for type integer"}, http.StatusBadRequest, codeInvalidValue},
+		{fmt.Errorf("failed to create table: %w", &pq.Error{Code: "42P07"}), http.StatusConflict, codeTableExists},
+		{sql.ErrNoRows, http.StatusNotFound, codeRecordNotFound},
+		{errNoFields, http.StatusBadRequest, codeNoFields},
+		{&ValidationError{Errors: []FieldError{{Field: "email", Code: codeRequired}}}, http.StatusUnprocessableEntity, codeValidationFailed},
+		{&pq.Error{Code: "XX000", Message: "connection secret leaked"}, http.StatusInternalServerError, codeInternal},
+	}
+
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		writeStoreError(rec, tc.err)
+		envelope := expectError(t, rec, tc.status, tc.code)
+		if tc.code == codeUniqueViolation && (len(envelope.Error.Details) != 1 || envelope.Error.Details[0].Field != "email") {
+			t.Fatalf("expected unique violation details for email, got %+v", envelope.Error.Details)
+		}
+		if tc.code == codeInternal && envelope.Error.Message != "Internal server error" {
+			t.Fatalf("internal error leaked message %q", envelope.Error.Message)
+		}
+	}
+}
+
+func TestHandlersUseErrorEnvelope(t *testing.T) {
+	h := newTestServer(t)
+
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/missing/records", nil), http.StatusNotFound, codeTableNotFound)
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/users/records/42", nil), http.StatusNotFound, codeRecordNotFound)
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/users/records/abc", nil), http.StatusBadRequest, codeInvalidID)
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/users/records?sort=nope", nil), http.StatusBadRequest, codeInvalidQuery)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables", map[string]string{"name": "select"}), http.StatusBadRequest, codeInvalidIdentifier)
+	expectError(t, doRequest(t, h, http.MethodDelete, "/tables/users", nil), http.StatusForbidden, codeForbidden)
+	expectError(t, doRequest(t, h, http.MethodGet, "/nowhere", nil), http.StatusNotFound, codeNotFound)
+
+	rec := doRequest(t, h, http.MethodPatch, "/tables", nil)
+	expectError(t, rec, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if rec.Header().Get("Allow") == "" {
+		t.Fatal("expected Allow header on 405")
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name":    "people",
+		"columns": map[string]string{"code": "VARCHAR(3)"},
+	}), http.StatusCreated)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/people/records", map[string]interface{}{"code": "toolong"}), http.StatusBadRequest, codeInvalidValue)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/people/records", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected application/json on success, got %q", contentType)
+	}
+}
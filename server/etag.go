@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionColumn is the system column holding a row's version. Stores set it to 1 on
+// insert and bump it on every update, and record ETags are built from it.
+const versionColumn = "row_version"
+
+// versionColumnType starts new rows, and the existing rows of a table given the column
+// later, at version 1
+const versionColumnType = "INTEGER NOT NULL DEFAULT 1"
+
+// systemColumns picks out of a table's columns the ones maintained by the server, which
+// clients can read but not write: row_version, plus the timestampColumns and deleted_at
+// once the table has enabled timestamps or soft delete. Until then those names are
+// ordinary columns.
+func systemColumns(columns []string, timestamps, softDelete bool) []string {
+	var system []string
+	for _, column := range columns {
+		if column == versionColumn || (timestamps && isTimestampColumn(column)) || (softDelete && column == deletedAtColumn) {
+			system = append(system, column)
+		}
+	}
+	return system
+}
+
+// isSystemColumn reports whether a column is one of the system columns of a table.
+// row_version is reserved on every table.
+func isSystemColumn(name string, system []string) bool {
+	return name == versionColumn || containsString(system, name)
+}
+
+// stripSystemFields removes the fields of recordData that would write a system column
+func stripSystemFields(recordData Record, system []string) {
+	for key := range recordData {
+		if isSystemColumn(sanitizeColumnName(key), system) {
+			delete(recordData, key)
+		}
+	}
+}
+
+// recordVersion returns the version of a record read from a versioned table
+func recordVersion(record Record) (int64, bool) {
+	value, ok := record[versionColumn]
+	if !ok || value == nil {
+		return 0, false
+	}
+	version, ok := numericValue(value)
+	return int64(version), ok
+}
+
+// recordETag returns the entity tag of a record: its quoted version, or for tables created
+// before versioning a hash of its JSON form
+func recordETag(record Record) string {
+	if version, ok := recordVersion(record); ok {
+		return `"` + strconv.FormatInt(version, 10) + `"`
+	}
+	encoded, _ := json.Marshal(record)
+	sum := sha1.Sum(encoded)
+	return `"h` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value lists etag. "*"
+// matches any current record. Weak comparison, used for If-None-Match, ignores the W/
+// prefix; strong comparison never matches a weak tag.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces an If-Match header against the current record. It returns the
+// version the write must still find, or 0 when there is no header. Tables without
+// row_version can't make the write itself conditional, so they fail with errUnversioned.
+func checkIfMatch(ifMatch string, current Record) (int64, error) {
+	if ifMatch == "" {
+		return 0, nil
+	}
+	if !etagMatches(ifMatch, recordETag(current), false) {
+		return 0, errPreconditionFailed
+	}
+	version, ok := recordVersion(current)
+	if !ok {
+		return 0, errUnversioned
+	}
+	return version, nil
+}
+
+// ifMatchVersion checks the request's If-Match header against the stored record
+func ifMatchVersion(r *http.Request, tableName string, id int) (int64, error) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return 0, nil
+	}
+	current, err := store.GetRecord(tableName, id)
+	if err != nil {
+		return 0, err
+	}
+	return checkIfMatch(ifMatch, current)
+}
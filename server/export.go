@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// exportFlushRows is how many rows an export writes between flushes to the client
+const exportFlushRows = 500
+
+// parseDelimiter reads the delimiter parameter of an export: a single character other
+// than a quote or line break, or "tab". It defaults to a comma.
+func parseDelimiter(value string) (rune, error) {
+	switch value {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	delimiter, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || delimiter == utf8.RuneError || delimiter == '"' || delimiter == '\r' || delimiter == '\n' {
+		return 0, fmt.Errorf("invalid delimiter '%s': use a single character other than a quote or line break", value)
+	}
+	return delimiter, nil
+}
+
+// csvValue formats a column value for a CSV field. NULL is an empty field; JSON documents
+// are written as JSON.
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case map[string]interface{}, []interface{}:
+		if encoded, err := json.Marshal(v); err == nil {
+			return string(encoded)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// tableExportHandler serves GET /tables/{table}/export?format=csv. It takes the filter,
+// sort and fields parameters of GET /records, and limit and offset when given, and
+// streams the rows as RFC 4180 CSV with a header row, flushing as it goes instead of
+// loading the whole table.
+func tableExportHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := r.PathValue("table")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+	params := r.URL.Query()
+	if format := params.Get("format"); format != "" && format != "csv" {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("unsupported format '%s': use csv", format))
+		return
+	}
+	delimiter, err := parseDelimiter(params.Get("delimiter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	query, err := parseRecordQuery(params, columns)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	header := query.selectColumns(columns)
+
+	// A large export takes longer than the server's WriteTimeout allows a response
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Warning: Failed to lift the write deadline for the export of table %s: %v", tableName, err)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Comma = delimiter
+	writer.UseCRLF = true
+	flusher, _ := w.(http.Flusher)
+
+	// Nothing is sent until the first row is read, so a failing query still gets a
+	// proper error response
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8; header=present")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, tableName))
+		return writer.Write(header)
+	}
+
+	rows := 0
+	fields := make([]string, len(header))
+	err = store.StreamRecords(tableName, query, func(record Record) error {
+		if err := start(); err != nil {
+			return err
+		}
+		for i, column := range header {
+			fields[i] = csvValue(record[column])
+		}
+		if err := writer.Write(fields); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return writer.Error()
+		}
+		return nil
+	})
+	if err != nil && !started {
+		writeStoreError(w, err)
+		return
+	}
+	if err == nil {
+		err = start()
+	}
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		log.Printf("Warning: Export of table %s stopped after %d rows: %v", tableName, rows, err)
+		return
+	}
+	fmt.Printf("Table '%s' exported %d rows as CSV\n", tableName, rows)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// identifierPattern is the grammar accepted for table and column names
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// reservedWords are PostgreSQL reserved key words that may not be used as names
+var reservedWords = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true,
+	"as": true, "asc": true, "asymmetric": true, "authorization": true, "binary": true,
+	"both": true, "case": true, "cast": true, "check": true, "collate": true,
+	"collation": true, "column": true, "concurrently": true, "constraint": true,
+	"create": true, "cross": true, "current_catalog": true, "current_date": true,
+	"current_role": true, "current_schema": true, "current_time": true,
+	"current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true,
+	"false": true, "fetch": true, "for": true, "foreign": true, "freeze": true, "from": true,
+	"full": true, "grant": true, "group": true, "having": true, "ilike": true, "in": true,
+	"initially": true, "inner": true, "intersect": true, "into": true, "is": true,
+	"isnull": true, "join": true, "lateral": true, "leading": true, "left": true,
+	"like": true, "limit": true, "localtime": true, "localtimestamp": true, "natural": true,
+	"not": true, "notnull": true, "null": true, "offset": true, "on": true, "only": true,
+	"or": true, "order": true, "outer": true, "overlaps": true, "placing": true,
+	"primary": true, "references": true, "returning": true, "right": true, "select": true,
+	"session_user": true, "similar": true, "some": true, "symmetric": true,
+	"system_user": true, "table": true, "tablesample": true, "then": true, "to": true,
+	"trailing": true, "true": true, "union": true, "unique": true, "user": true,
+	"using": true, "variadic": true, "verbose": true, "when": true, "where": true,
+	"window": true, "with": true,
+}
+
+// allowedColumnTypes are the PostgreSQL types clients may request without parameters
+var allowedColumnTypes = map[string]bool{
+	"SMALLINT": true, "INTEGER": true, "BIGINT": true,
+	"REAL": true, "DOUBLE PRECISION": true, "NUMERIC": true, "DECIMAL": true,
+	"BOOLEAN": true, "TEXT": true, "DATE": true, "TIME": true,
+	"TIMESTAMP": true, "TIMESTAMPTZ": true, "TIMESTAMP WITH TIME ZONE": true,
+	"UUID": true, "JSON": true, "JSONB": true,
+}
+
+// parameterizedTypePattern matches the allowed types that take a length or precision
+var parameterizedTypePattern = regexp.MustCompile(`^(VARCHAR|CHAR|NUMERIC|DECIMAL)\((\d{1,4})(?:,\s*(\d{1,4}))?\)$`)
+
+// validateIdentifier checks that name is a safe table or column name
+func validateIdentifier(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is required", kind)
+	}
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name '%s': use lowercase letters, digits and underscores, starting with a letter or underscore (max 63 characters)", kind, name)
+	}
+	if reservedWords[name] {
+		return fmt.Errorf("invalid %s name '%s': reserved word", kind, name)
+	}
+	if strings.HasPrefix(name, "pg_") {
+		return fmt.Errorf("invalid %s name '%s': the pg_ prefix is reserved", kind, name)
+	}
+	return nil
+}
+
+func validateTableName(name string) error {
+	return validateIdentifier("table", name)
+}
+
+func validateColumnName(name string) error {
+	return validateIdentifier("column", name)
+}
+
+// quoteIdentifier quotes a name for safe interpolation into SQL
+func quoteIdentifier(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// quoteIdentifiers quotes each name and joins them into a comma separated list
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// normalizeColumnType checks a client supplied column type against the whitelist and
+// returns it in canonical upper case form
+func normalizeColumnType(columnType string) (string, error) {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(columnType), " "))
+	if allowedColumnTypes[normalized] {
+		return normalized, nil
+	}
+	if match := parameterizedTypePattern.FindStringSubmatch(normalized); match != nil {
+		if match[3] != "" && (match[1] == "VARCHAR" || match[1] == "CHAR") {
+			return "", fmt.Errorf("unsupported column type '%s'", columnType)
+		}
+		return normalized, nil
+	}
+	return "", fmt.Errorf("unsupported column type '%s'", columnType)
+}
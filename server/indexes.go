@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// concurrentIndexThreshold is the estimated row count from which indexes are built with
+// CREATE INDEX CONCURRENTLY unless the request says otherwise
+const concurrentIndexThreshold = 100000
+
+// maxIndexConflicts caps the duplicate groups reported when a unique index can't be built
+const maxIndexConflicts = 20
+
+// indexMethods are the index access methods clients may request
+var indexMethods = map[string]bool{"btree": true, "hash": true, "gin": true}
+
+// indexSpec describes an index to create
+type indexSpec struct {
+	Name         string
+	Columns      []string
+	Unique       bool
+	Method       string
+	Where        []filterClause
+	Concurrently bool
+}
+
+// indexConflict is a set of rows sharing the values a unique index would forbid
+type indexConflict struct {
+	Values map[string]interface{} `json:"values"`
+	Count  int                    `json:"count"`
+	IDs    []int64                `json:"ids"`
+}
+
+// duplicateValuesError is returned when a unique index fails because of existing rows
+type duplicateValuesError struct {
+	Index     string
+	Conflicts []indexConflict
+}
+
+func (e *duplicateValuesError) Error() string {
+	return fmt.Sprintf("could not create unique index \"%s\": %d groups of duplicate values", e.Index, len(e.Conflicts))
+}
+
+// defaultIndexName follows the Postgres naming scheme, e.g. users_email_key for a unique
+// index, trimmed to the 63 character identifier limit
+func defaultIndexName(tableName string, columns []string, unique bool) string {
+	suffix := "_idx"
+	if unique {
+		suffix = "_key"
+	}
+	name := tableName + "_" + strings.Join(columns, "_")
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	return name + suffix
+}
+
+// indexKey returns the key expression used for a column in an index of the given method.
+// GIN indexes jsonb, arrays and tsvectors directly and text through to_tsvector, so the
+// index can serve full text search; other types can't be GIN indexed.
+func indexKey(column ColumnSchema, method string) (string, bool) {
+	quoted := quoteIdentifier(column.Name)
+	if method != "gin" {
+		return quoted, true
+	}
+	switch column.DataType {
+	case "jsonb", "ARRAY", "tsvector":
+		return quoted, true
+	case "text", "character varying", "character":
+		return fmt.Sprintf("to_tsvector('simple', COALESCE(%s, ''))", quoted), true
+	}
+	return "", false
+}
+
+// indexPredicate renders filters as the literal WHERE clause of a partial index, which
+// can't take bind parameters. The conditions match whereClause's so list queries with the
+// same filters can use the index; whereFilters has already validated them.
+func indexPredicate(filters []filterClause) string {
+	conditions := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		if condition, err := filterCondition(filter, pq.QuoteLiteral); err == nil {
+			conditions = append(conditions, condition)
+		}
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// createIndexStatement builds the CREATE INDEX statement for spec over the key expressions
+func createIndexStatement(tableName string, spec indexSpec, keys []string) string {
+	var statement strings.Builder
+	statement.WriteString("CREATE ")
+	if spec.Unique {
+		statement.WriteString("UNIQUE ")
+	}
+	statement.WriteString("INDEX ")
+	if spec.Concurrently {
+		statement.WriteString("CONCURRENTLY ")
+	}
+	fmt.Fprintf(&statement, "%s ON %s USING %s (%s)", quoteIdentifier(spec.Name), quoteIdentifier(tableName), spec.Method, strings.Join(keys, ", "))
+	if len(spec.Where) > 0 {
+		statement.WriteString(" WHERE " + indexPredicate(spec.Where))
+	}
+	return statement.String()
+}
+
+// whereFilters turns {"column": {"operator": value}} into filter[column][operator]
+// parameters so partial index predicates are validated like list filters
+func whereFilters(where map[string]map[string]interface{}, columns []string) ([]filterClause, error) {
+	params := url.Values{}
+	for column, operators := range where {
+		for operator, value := range operators {
+			key := fmt.Sprintf("filter[%s][%s]", column, operator)
+			switch v := value.(type) {
+			case []interface{}:
+				values := make([]string, len(v))
+				for i, item := range v {
+					values[i] = fmt.Sprint(item)
+				}
+				params.Add(key, strings.Join(values, ","))
+			case nil:
+				return nil, fmt.Errorf("where value for '%s' cannot be null, use the null operator", column)
+			default:
+				params.Add(key, fmt.Sprint(v))
+			}
+		}
+	}
+	query, err := parseRecordQuery(params, columns)
+	if err != nil {
+		return nil, err
+	}
+	return query.Filters, nil
+}
+
+// tableIndexesHandler serves GET and POST /tables/{table}/indexes
+func tableIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := r.PathValue("table")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, schema.Indexes)
+		return
+	}
+
+	var indexRequest struct {
+		Name         string                            `json:"name"`
+		Columns      []string                          `json:"columns"`
+		Unique       bool                              `json:"unique"`
+		Method       string                            `json:"method"`
+		Where        map[string]map[string]interface{} `json:"where"`
+		Concurrently *bool                             `json:"concurrently"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&indexRequest); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	spec := indexSpec{
+		Name:    indexRequest.Name,
+		Columns: indexRequest.Columns,
+		Unique:  indexRequest.Unique,
+		Method:  strings.ToLower(indexRequest.Method),
+	}
+	if spec.Method == "" {
+		spec.Method = "btree"
+	}
+	if !indexMethods[spec.Method] {
+		writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Unsupported index method '%s'", indexRequest.Method))
+		return
+	}
+	if spec.Unique && spec.Method != "btree" {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Unique indexes must use the btree method")
+		return
+	}
+	if len(spec.Columns) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "At least one column is required")
+		return
+	}
+
+	columns := make(map[string]ColumnSchema, len(schema.Columns))
+	columnNames := make([]string, len(schema.Columns))
+	for i, column := range schema.Columns {
+		columns[column.Name] = column
+		columnNames[i] = column.Name
+	}
+	seen := make(map[string]bool, len(spec.Columns))
+	for _, name := range spec.Columns {
+		column, ok := columns[name]
+		if !ok {
+			writeError(w, http.StatusBadRequest, codeColumnNotFound, fmt.Sprintf("Column '%s' does not exist", name))
+			return
+		}
+		if seen[name] {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Column '%s' is listed more than once", name))
+			return
+		}
+		seen[name] = true
+		if _, ok := indexKey(column, spec.Method); !ok {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Column '%s' of type %s can't be used in a %s index", name, column.Type, spec.Method))
+			return
+		}
+	}
+
+	if spec.Where, err = whereFilters(indexRequest.Where, columnNames); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	if spec.Name == "" {
+		spec.Name = defaultIndexName(tableName, spec.Columns, spec.Unique)
+	} else if err := validateIdentifier("index", spec.Name); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+	spec.Concurrently = schema.RowEstimate >= concurrentIndexThreshold
+	if indexRequest.Concurrently != nil {
+		spec.Concurrently = *indexRequest.Concurrently
+	}
+
+	index, err := store.CreateIndex(tableName, spec)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "duplicate_table" {
+			writeError(w, http.StatusConflict, codeIndexExists, fmt.Sprintf("A relation named '%s' already exists", spec.Name))
+			return
+		}
+		writeStoreError(w, err)
+		return
+	}
+	fmt.Printf("Index '%s' created on table '%s'\n", index.Name, tableName)
+	recordMigration(requestSchemaChange(r), tableName, migrationCreateIndex,
+		[]string{index.Definition}, []string{"DROP INDEX " + quoteIdentifier(index.Name)})
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":      fmt.Sprintf("Index '%s' created", index.Name),
+		"index":        index,
+		"concurrently": spec.Concurrently,
+	})
+}
+
+// tableIndexHandler serves DELETE /tables/{table}/indexes/{index}
+func tableIndexHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := r.PathValue("table")
+	indexName := r.PathValue("index")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var found *IndexSchema
+	for i := range schema.Indexes {
+		if schema.Indexes[i].Name == indexName {
+			found = &schema.Indexes[i]
+		}
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, codeIndexNotFound, "Index not found")
+		return
+	}
+	if found.Primary {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "The primary key index cannot be dropped")
+		return
+	}
+
+	concurrently := r.URL.Query().Get("concurrently") == "true"
+	if err := store.DropIndex(tableName, indexName, concurrently); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	fmt.Printf("Index '%s' dropped from table '%s'\n", indexName, tableName)
+	recordMigration(requestSchemaChange(r), tableName, migrationDropIndex,
+		[]string{"DROP INDEX " + quoteIdentifier(indexName)}, []string{found.Definition})
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Index '%s' dropped", indexName),
+	})
+}
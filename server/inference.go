@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxInferenceSamples caps the values looked at per column when inferring its type
+const maxInferenceSamples = 1000
+
+var (
+	uuidPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	integerPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+	decimalPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)\.[0-9]+$`)
+)
+
+// valueKind is what a single sample value looks like
+type valueKind int
+
+const (
+	kindBlank valueKind = iota
+	kindInteger
+	kindBigInteger
+	kindDecimal
+	kindBoolean
+	kindDate
+	kindTimestamp
+	kindUUID
+	kindString
+	kindLongString
+	kindJSON
+)
+
+// classifyValue works out the kind of a decoded JSON value. Strings are looked into as
+// well, since CSV imports send every field as a string.
+func classifyValue(value interface{}) valueKind {
+	switch v := value.(type) {
+	case nil:
+		return kindBlank
+	case bool:
+		return kindBoolean
+	case int:
+		return integerKind(float64(v))
+	case int64:
+		return integerKind(float64(v))
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return kindDecimal
+		}
+		return integerKind(v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return integerKind(float64(n))
+		}
+		return kindDecimal
+	case map[string]interface{}, []interface{}:
+		return kindJSON
+	case string:
+		return classifyString(v)
+	}
+	return kindString
+}
+
+func integerKind(n float64) valueKind {
+	switch {
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return kindInteger
+	case n >= math.MinInt64 && n <= math.MaxInt64:
+		return kindBigInteger
+	}
+	return kindDecimal
+}
+
+func classifyString(s string) valueKind {
+	trimmed := strings.TrimSpace(s)
+	switch {
+	case trimmed == "":
+		return kindBlank
+	case integerPattern.MatchString(trimmed):
+		if n, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return integerKind(float64(n))
+		}
+		return kindDecimal
+	case decimalPattern.MatchString(trimmed):
+		return kindDecimal
+	case strings.EqualFold(trimmed, "true") || strings.EqualFold(trimmed, "false"):
+		return kindBoolean
+	case uuidPattern.MatchString(trimmed):
+		return kindUUID
+	}
+	if _, err := time.Parse("2006-01-02", trimmed); err == nil {
+		return kindDate
+	}
+	if _, err := time.Parse(time.RFC3339, trimmed); err == nil {
+		return kindTimestamp
+	}
+	if len(s) > 255 {
+		return kindLongString
+	}
+	return kindString
+}
+
+// typeForKinds picks the narrowest column type that holds every kind seen
+func typeForKinds(kinds map[valueKind]bool) string {
+	delete(kinds, kindBlank)
+	has := func(allowed ...valueKind) bool {
+		if len(kinds) == 0 {
+			return false
+		}
+		for kind := range kinds {
+			found := false
+			for _, a := range allowed {
+				found = found || kind == a
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case len(kinds) == 0:
+		return ""
+	case has(kindJSON):
+		return "JSONB"
+	case kinds[kindJSON]:
+		return "TEXT"
+	case has(kindInteger):
+		return "INTEGER"
+	case has(kindInteger, kindBigInteger):
+		return "BIGINT"
+	case has(kindInteger, kindBigInteger, kindDecimal):
+		return "NUMERIC"
+	case has(kindBoolean):
+		return "BOOLEAN"
+	case has(kindDate):
+		return "DATE"
+	case has(kindDate, kindTimestamp):
+		return "TIMESTAMPTZ"
+	case has(kindUUID):
+		return "UUID"
+	case kinds[kindLongString]:
+		return "TEXT"
+	}
+	return "VARCHAR(255)"
+}
+
+// inferColumnType chooses the PostgreSQL type for a column from its name and any number
+// of sample values. Name hints match whole words of the name. Hints for contact fields
+// only apply when the samples are strings or there are none, numeric hints when they
+// are numeric or there are none.
+func inferColumnType(columnName string, samples []interface{}) string {
+	columnLower := strings.ToLower(columnName)
+	words := strings.FieldsFunc(columnLower, func(r rune) bool { return r == '_' || r == ' ' || r == '-' })
+
+	kinds := make(map[valueKind]bool)
+	blankStrings := false
+	textual := true
+	for _, sample := range samples {
+		kind := classifyValue(sample)
+		s, ok := sample.(string)
+		if ok && kind == kindBlank && s == "" {
+			blankStrings = true
+		}
+		if !ok && sample != nil {
+			textual = false
+		}
+		kinds[kind] = true
+	}
+	inferred := typeForKinds(kinds)
+
+	if textual && (containsString(words, "email") || containsString(words, "mail")) {
+		return "VARCHAR(255)"
+	}
+	if textual && (containsString(words, "phone") || containsString(words, "tel")) {
+		return "VARCHAR(20)"
+	}
+	if textual && (containsString(words, "url") || containsString(words, "website")) {
+		return "TEXT"
+	}
+
+	numeric := inferred == "" || inferred == "INTEGER" || inferred == "BIGINT" || inferred == "NUMERIC"
+	if numeric && containsString(words, "age") {
+		return "INTEGER"
+	}
+	if numeric && (strings.Contains(columnLower, "salary") || strings.Contains(columnLower, "price") || strings.Contains(columnLower, "amount")) {
+		return "DECIMAL(12,2)"
+	}
+
+	switch {
+	case inferred != "":
+		return inferred
+	case blankStrings:
+		return "VARCHAR(255)"
+	}
+	return "TEXT"
+}
+
+// determineColumnType determines the PostgreSQL column type based on a single sample value
+func determineColumnType(columnName string, sampleValue interface{}) string {
+	return inferColumnType(columnName, []interface{}{sampleValue})
+}
+
+// sampleColumns collects up to maxInferenceSamples non-null values per record key
+func sampleColumns(records []Record) map[string][]interface{} {
+	samples := make(map[string][]interface{})
+	for _, record := range records {
+		for key, value := range record {
+			if _, seen := samples[key]; !seen {
+				samples[key] = nil
+			}
+			if value != nil && len(samples[key]) < maxInferenceSamples {
+				samples[key] = append(samples[key], value)
+			}
+		}
+	}
+	return samples
+}
+
+// ProposedColumn is one column of a schema preview
+type ProposedColumn struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Samples  int    `json:"samples"`
+	Nullable bool   `json:"nullable"`
+	Existing bool   `json:"existing"`
+}
+
+// schemaPreviewHandler serves POST /tables/preview, proposing column types for a set of
+// records without creating anything. With a table name, columns that already exist are
+// reported with their current type.
+func schemaPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var previewRequest struct {
+		Table   string   `json:"table"`
+		Records []Record `json:"records"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&previewRequest); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if len(previewRequest.Records) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "At least one record is required")
+		return
+	}
+
+	existing := make(map[string]string)
+	if previewRequest.Table != "" {
+		if err := validateTableName(previewRequest.Table); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+			return
+		}
+		exists, err := store.TableExists(previewRequest.Table)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if exists {
+			schema, err := store.TableSchema(previewRequest.Table)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			for _, column := range schema.Columns {
+				existing[column.Name] = column.Type
+			}
+		}
+	}
+
+	samples := sampleColumns(previewRequest.Records)
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	columns := []ProposedColumn{}
+	for _, key := range keys {
+		name := sanitizeColumnName(key)
+		if name == "id" {
+			continue
+		}
+		if err := validateColumnName(name); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+			return
+		}
+		column := ProposedColumn{
+			Key:      key,
+			Name:     name,
+			Samples:  len(samples[key]),
+			Nullable: len(samples[key]) < len(previewRequest.Records),
+		}
+		if currentType, ok := existing[name]; ok {
+			column.Type, column.Existing = currentType, true
+		} else {
+			column.Type = inferColumnType(name, samples[key])
+		}
+		columns = append(columns, column)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"table":   previewRequest.Table,
+		"records": len(previewRequest.Records),
+		"columns": columns,
+	})
+}
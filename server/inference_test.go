@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInferColumnType(t *testing.T) {
+	cases := []struct {
+		column  string
+		samples []interface{}
+		want    string
+	}{
+		{"count", []interface{}{float64(3), float64(7)}, "INTEGER"},
+		{"count", []interface{}{"3", "7", nil}, "INTEGER"},
+		{"views", []interface{}{float64(3), float64(5000000000)}, "BIGINT"},
+		{"ratio", []interface{}{float64(1), 2.5}, "NUMERIC"},
+		{"active", []interface{}{true, "false"}, "BOOLEAN"},
+		{"born", []interface{}{"1990-04-01", "2001-12-31"}, "DATE"},
+		{"seen", []interface{}{"1990-04-01", "2024-05-01T10:00:00Z"}, "TIMESTAMPTZ"},
+		{"token", []interface{}{"3f2504e0-4f89-11d3-9a0c-0305e82c3301"}, "UUID"},
+		{"settings", []interface{}{map[string]interface{}{"a": 1.0}}, "JSONB"},
+		{"settings", []interface{}{map[string]interface{}{"a": 1.0}, "x"}, "TEXT"},
+		{"tags", []interface{}{[]interface{}{"a"}}, "JSONB"},
+		{"zip", []interface{}{"02134", "10001"}, "VARCHAR(255)"},
+		{"notes", []interface{}{strings.Repeat("x", 300)}, "TEXT"},
+		{"mixed", []interface{}{float64(1), "one"}, "VARCHAR(255)"},
+		{"age", nil, "INTEGER"},
+		{"message", []interface{}{"hello"}, "VARCHAR(255)"},
+		{"price", []interface{}{float64(10)}, "DECIMAL(12,2)"},
+		{"contact_email", []interface{}{"ada@example.com"}, "VARCHAR(255)"},
+		{"contact_email", []interface{}{float64(1)}, "INTEGER"},
+		{"e-mail", nil, "VARCHAR(255)"},
+		{"phone", []interface{}{"5551234"}, "VARCHAR(20)"},
+		{"website", []interface{}{"https://example.com"}, "TEXT"},
+		{"hotel_id", []interface{}{float64(7)}, "INTEGER"},
+		{"hotel", []interface{}{"Ritz"}, "VARCHAR(255)"},
+		{"hourly_rate", []interface{}{float64(42)}, "INTEGER"},
+		{"hourly_rate", []interface{}{"fast"}, "VARCHAR(255)"},
+		{"email_verified", []interface{}{true}, "BOOLEAN"},
+		{"unknown", []interface{}{nil}, "TEXT"},
+	}
+
+	for _, tc := range cases {
+		if got := inferColumnType(tc.column, tc.samples); got != tc.want {
+			t.Errorf("inferColumnType(%q, %v) = %s, want %s", tc.column, tc.samples, got, tc.want)
+		}
+	}
+}
+
+func TestSchemaPreview(t *testing.T) {
+	h := newTestServer(t)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "members", "columns": map[string]string{"email": "VARCHAR(255)"}}), http.StatusCreated)
+
+	records := []map[string]interface{}{
+		{"id": 1, "email": "ada@example.com", "score": 10, "joined": "2024-01-02"},
+		{"email": "grace@example.com", "score": 12.5, "Nick Name": "gh"},
+	}
+	rec := doRequest(t, h, http.MethodPost, "/tables/preview", map[string]interface{}{"table": "members", "records": records})
+	expectStatus(t, rec, http.StatusOK)
+	var preview struct {
+		Columns []ProposedColumn `json:"columns"`
+	}
+	decodeBody(t, rec, &preview)
+
+	byName := make(map[string]ProposedColumn)
+	for _, column := range preview.Columns {
+		byName[column.Name] = column
+	}
+	if len(preview.Columns) != 4 {
+		t.Fatalf("expected 4 proposed columns, got %+v", preview.Columns)
+	}
+	if !byName["email"].Existing || byName["score"].Type != "NUMERIC" || byName["joined"].Type != "DATE" || !byName["joined"].Nullable {
+		t.Fatalf("unexpected preview: %+v", preview.Columns)
+	}
+	if column := byName["nick_name"]; column.Key != "Nick Name" || column.Type != "VARCHAR(255)" {
+		t.Fatalf("unexpected sanitized column: %+v", column)
+	}
+	if exists, _ := store.TableExists("preview"); exists {
+		t.Fatal("preview created a table")
+	}
+	if columns, _ := store.Columns("members"); containsString(columns, "score") {
+		t.Fatal("preview added a column")
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/preview", map[string]interface{}{"records": []interface{}{}}), http.StatusBadRequest)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metadataSchema holds the server's own bookkeeping tables so they never show up in /tables
+const metadataSchema = "mock2_meta"
+
+// Semantic column types understood by the metadata catalog
+const (
+	semanticText    = "text"
+	semanticEmail   = "email"
+	semanticPhone   = "phone"
+	semanticURL     = "url"
+	semanticDate    = "date"
+	semanticNumber  = "number"
+	semanticBoolean = "boolean"
+	semanticLink    = "link"
+)
+
+// foreignKeyActions maps the onDelete values accepted for link columns to their SQL form
+var foreignKeyActions = map[string]string{
+	"no action": "NO ACTION",
+	"restrict":  "RESTRICT",
+	"cascade":   "CASCADE",
+	"set null":  "SET NULL",
+}
+
+// ColumnMetadata describes a column as presented to clients
+type ColumnMetadata struct {
+	Key          string      `json:"key"`
+	Label        string      `json:"label"`
+	Type         string      `json:"type"`
+	Required     bool        `json:"required"`
+	DefaultValue *string     `json:"defaultValue,omitempty"`
+	Position     int         `json:"position"`
+	Description  string      `json:"description,omitempty"`
+	Rules        ColumnRules `json:"rules"`
+	Editable     bool        `json:"editable"`
+	Link         *ColumnLink `json:"link,omitempty"`
+
+	// pattern is Rules.Pattern compiled when the rules are loaded, nil when it is unset or
+	// doesn't compile
+	pattern *regexp.Regexp
+
+	// declared is set for columns with a catalog entry or a foreign key. Only those are
+	// validated against their type and rules; inferred types are for display.
+	declared bool
+}
+
+// ColumnLink is the table a link column references by id, read back from its foreign key
+type ColumnLink struct {
+	Table    string `json:"table"`
+	OnDelete string `json:"onDelete"`
+}
+
+// foreignKeyAction spells out pg_constraint.confdeltype
+func foreignKeyAction(code string) string {
+	switch code {
+	case "r":
+		return "RESTRICT"
+	case "c":
+		return "CASCADE"
+	case "n":
+		return "SET NULL"
+	case "d":
+		return "SET DEFAULT"
+	}
+	return "NO ACTION"
+}
+
+// normalizeForeignKeyAction accepts "cascade", "set_null", "SET NULL" and the like and
+// returns the SQL form, defaulting to NO ACTION
+func normalizeForeignKeyAction(action string) (string, error) {
+	normalized := strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(action, "_", " ")), " "))
+	if normalized == "" {
+		return "NO ACTION", nil
+	}
+	if sqlAction, ok := foreignKeyActions[normalized]; ok {
+		return sqlAction, nil
+	}
+	return "", fmt.Errorf("unsupported onDelete action '%s'", action)
+}
+
+// ensureMetadataCatalog creates the metadata and archive schemas and the catalog tables
+// if they don't exist
+func ensureMetadataCatalog(exec sqlExecutor) error {
+	statements := []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", metadataSchema),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.column_metadata (
+			table_name    TEXT NOT NULL,
+			column_name   TEXT NOT NULL,
+			label         TEXT NOT NULL DEFAULT '',
+			semantic_type TEXT NOT NULL DEFAULT 'text',
+			required      BOOLEAN NOT NULL DEFAULT FALSE,
+			default_value TEXT,
+			position      INTEGER NOT NULL DEFAULT 0,
+			description   TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (table_name, column_name)
+		)`, metadataSchema),
+		fmt.Sprintf("ALTER TABLE %s.column_metadata ADD COLUMN IF NOT EXISTS rules JSONB NOT NULL DEFAULT '{}'", metadataSchema),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.table_settings (
+			table_name  TEXT PRIMARY KEY,
+			schema_mode TEXT NOT NULL DEFAULT 'dynamic'
+		)`, metadataSchema),
+		fmt.Sprintf("ALTER TABLE %s.table_settings ADD COLUMN IF NOT EXISTS timestamps BOOLEAN NOT NULL DEFAULT FALSE", metadataSchema),
+		fmt.Sprintf("ALTER TABLE %s.table_settings ADD COLUMN IF NOT EXISTS soft_delete BOOLEAN NOT NULL DEFAULT FALSE", metadataSchema),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.audit_log (
+			id            BIGSERIAL PRIMARY KEY,
+			table_name    TEXT NOT NULL,
+			record_id     BIGINT NOT NULL,
+			operation     TEXT NOT NULL,
+			version       BIGINT,
+			before_values JSONB NOT NULL DEFAULT '{}',
+			after_values  JSONB NOT NULL DEFAULT '{}',
+			actor         TEXT,
+			changed_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, metadataSchema),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS audit_log_record_idx ON %s.audit_log (table_name, record_id)", metadataSchema),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS audit_log_changed_at_idx ON %s.audit_log (changed_at)", metadataSchema),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.schema_migrations (
+			id         BIGSERIAL PRIMARY KEY,
+			table_name TEXT NOT NULL,
+			operation  TEXT NOT NULL,
+			up_sql     TEXT NOT NULL,
+			down_sql   TEXT NOT NULL DEFAULT '',
+			actor      TEXT,
+			reason     TEXT,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, metadataSchema),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS schema_migrations_table_idx ON %s.schema_migrations (table_name)", metadataSchema),
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", archiveSchema),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.archived_tables (
+			archive_name TEXT PRIMARY KEY,
+			table_name   TEXT NOT NULL,
+			dropped_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`, metadataSchema),
+	}
+	for _, statement := range statements {
+		if _, err := exec.Exec(statement); err != nil {
+			return fmt.Errorf("failed to initialize metadata catalog: %w", err)
+		}
+	}
+	return nil
+}
+
+// normalizeSemanticType maps client input types onto the catalog's semantic types
+func normalizeSemanticType(inputType string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(inputType)) {
+	case "", "text", "string":
+		return semanticText, nil
+	case "email":
+		return semanticEmail, nil
+	case "phone", "tel":
+		return semanticPhone, nil
+	case "url":
+		return semanticURL, nil
+	case "date":
+		return semanticDate, nil
+	case "number":
+		return semanticNumber, nil
+	case "boolean", "checkbox":
+		return semanticBoolean, nil
+	case "link", "reference":
+		return semanticLink, nil
+	}
+	return "", fmt.Errorf("unsupported column type '%s'", inputType)
+}
+
+// columnTypeForSemanticType returns the PostgreSQL type used for a semantic type
+func columnTypeForSemanticType(semanticType string) string {
+	switch semanticType {
+	case semanticEmail:
+		return "VARCHAR(255)"
+	case semanticPhone:
+		return "VARCHAR(20)"
+	case semanticURL:
+		return "TEXT"
+	case semanticDate:
+		return "DATE"
+	case semanticNumber:
+		return "DECIMAL(12,2)"
+	case semanticBoolean:
+		return "BOOLEAN"
+	case semanticLink:
+		return "INTEGER"
+	default:
+		return "VARCHAR(255)"
+	}
+}
+
+// inferSemanticType guesses a semantic type for columns that have no catalog entry
+func inferSemanticType(columnName, dataType string) string {
+	columnLower := strings.ToLower(columnName)
+	switch {
+	case strings.Contains(columnLower, "email") || strings.Contains(columnLower, "mail"):
+		return semanticEmail
+	case strings.Contains(columnLower, "phone") || strings.Contains(columnLower, "tel"):
+		return semanticPhone
+	case strings.Contains(columnLower, "url") || strings.Contains(columnLower, "website"):
+		return semanticURL
+	}
+
+	switch dataType {
+	case "integer", "bigint", "smallint", "numeric", "real", "double precision":
+		return semanticNumber
+	case "boolean":
+		return semanticBoolean
+	case "date", "timestamp without time zone", "timestamp with time zone":
+		return semanticDate
+	}
+	return semanticText
+}
+
+// defaultColumnLabel turns a column name like "first_name" into "First name"
+func defaultColumnLabel(columnName string) string {
+	if columnName == "" {
+		return ""
+	}
+	label := strings.ReplaceAll(columnName, "_", " ")
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+// saveColumnMetadata inserts or replaces the catalog entry for a column
+func saveColumnMetadata(exec sqlExecutor, tableName string, meta ColumnMetadata) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %s.column_metadata
+			(table_name, column_name, label, semantic_type, required, default_value, position, description, rules)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (table_name, column_name) DO UPDATE SET
+			label = EXCLUDED.label,
+			semantic_type = EXCLUDED.semantic_type,
+			required = EXCLUDED.required,
+			default_value = EXCLUDED.default_value,
+			position = EXCLUDED.position,
+			description = EXCLUDED.description,
+			rules = EXCLUDED.rules`, metadataSchema)
+
+	var defaultValue sql.NullString
+	if meta.DefaultValue != nil {
+		defaultValue = sql.NullString{String: *meta.DefaultValue, Valid: true}
+	}
+	rules, err := json.Marshal(meta.Rules)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec(query, tableName, meta.Key, meta.Label, meta.Type, meta.Required, defaultValue, meta.Position, meta.Description, string(rules))
+	return err
+}
+
+// deleteColumnMetadata removes the catalog entry for a single column
+func deleteColumnMetadata(exec sqlExecutor, tableName, columnName string) error {
+	query := fmt.Sprintf("DELETE FROM %s.column_metadata WHERE table_name = $1 AND column_name = $2", metadataSchema)
+	_, err := exec.Exec(query, tableName, columnName)
+	return err
+}
+
+// renameColumnMetadata moves the catalog entry for a column to its new name
+func renameColumnMetadata(exec sqlExecutor, tableName, columnName, newName string) error {
+	query := fmt.Sprintf("UPDATE %s.column_metadata SET column_name = $3 WHERE table_name = $1 AND column_name = $2", metadataSchema)
+	_, err := exec.Exec(query, tableName, columnName, newName)
+	return err
+}
+
+// renameTableMetadata moves every catalog entry and the audit log of a table to its new name
+func renameTableMetadata(exec sqlExecutor, tableName, newName string) error {
+	for _, catalog := range []string{"column_metadata", "table_settings", "audit_log"} {
+		query := fmt.Sprintf("UPDATE %s.%s SET table_name = $2 WHERE table_name = $1", metadataSchema, catalog)
+		if _, err := exec.Exec(query, tableName, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTableMetadata duplicates every catalog entry of a table for another table
+func copyTableMetadata(exec sqlExecutor, tableName, newName string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %[1]s.column_metadata
+			(table_name, column_name, label, semantic_type, required, default_value, position, description, rules)
+		SELECT $2, column_name, label, semantic_type, required, default_value, position, description, rules
+		FROM %[1]s.column_metadata
+		WHERE table_name = $1`, metadataSchema)
+	if _, err := exec.Exec(query, tableName, newName); err != nil {
+		return err
+	}
+	query = fmt.Sprintf(`
+		INSERT INTO %[1]s.table_settings (table_name, schema_mode, timestamps, soft_delete)
+		SELECT $2, schema_mode, timestamps, soft_delete FROM %[1]s.table_settings WHERE table_name = $1`, metadataSchema)
+	_, err := exec.Exec(query, tableName, newName)
+	return err
+}
+
+// deleteTableMetadata removes every catalog entry for a table
+func deleteTableMetadata(exec sqlExecutor, tableName string) error {
+	for _, catalog := range []string{"column_metadata", "table_settings"} {
+		query := fmt.Sprintf("DELETE FROM %s.%s WHERE table_name = $1", metadataSchema, catalog)
+		if _, err := exec.Exec(query, tableName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSchemaMode reads a table's schema mode, which defaults to dynamic
+func getSchemaMode(exec sqlExecutor, tableName string) (string, error) {
+	var mode string
+	query := fmt.Sprintf("SELECT schema_mode FROM %s.table_settings WHERE table_name = $1", metadataSchema)
+	err := exec.QueryRow(query, tableName).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return schemaModeDynamic, nil
+	}
+	return mode, err
+}
+
+// saveSchemaMode records a table's schema mode
+func saveSchemaMode(exec sqlExecutor, tableName, mode string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %s.table_settings (table_name, schema_mode) VALUES ($1, $2)
+		ON CONFLICT (table_name) DO UPDATE SET schema_mode = EXCLUDED.schema_mode`, metadataSchema)
+	_, err := exec.Exec(query, tableName, mode)
+	return err
+}
+
+// getSystemColumns returns which of a table's columns are maintained by the server:
+// row_version, plus the timestamp columns and deleted_at when table_settings enables them
+func getSystemColumns(exec sqlExecutor, tableName string, columns []string) ([]string, error) {
+	var timestamps, softDelete bool
+	query := fmt.Sprintf("SELECT timestamps, soft_delete FROM %s.table_settings WHERE table_name = $1", metadataSchema)
+	err := exec.QueryRow(query, tableName).Scan(&timestamps, &softDelete)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return systemColumns(columns, timestamps, softDelete), nil
+}
+
+// enableTableSetting turns on one of the boolean table_settings, timestamps or soft_delete
+func enableTableSetting(exec sqlExecutor, tableName, setting string) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %[1]s.table_settings (table_name, %[2]s) VALUES ($1, TRUE)
+		ON CONFLICT (table_name) DO UPDATE SET %[2]s = TRUE`, metadataSchema, setting)
+	_, err := exec.Exec(query, tableName)
+	return err
+}
+
+// nextColumnPosition returns the position to assign to a newly added column
+func nextColumnPosition(tableName string) (int, error) {
+	metadata, err := store.ColumnMetadata(tableName)
+	if err != nil {
+		return 0, err
+	}
+	position := 0
+	for _, meta := range metadata {
+		if meta.Position >= position {
+			position = meta.Position + 1
+		}
+	}
+	return position, nil
+}
+
+// getColumnMetadata returns metadata for every physical column of a table, filling in
+// inferred values for columns that were created without a catalog entry
+func getColumnMetadata(exec sqlExecutor, tableName string) ([]ColumnMetadata, error) {
+	columns, err := getTableColumns(exec, tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(exec, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT c.column_name, c.data_type, c.ordinal_position,
+			m.label, m.semantic_type, m.required, m.default_value, m.position, m.description, m.rules,
+			fk.table_name, fk.on_delete
+		FROM information_schema.columns c
+		LEFT JOIN %s.column_metadata m
+			ON m.table_name = c.table_name AND m.column_name = c.column_name
+		LEFT JOIN LATERAL (
+			SELECT ref.relname AS table_name, con.confdeltype AS on_delete
+			FROM pg_constraint con
+			JOIN pg_class ref ON ref.oid = con.confrelid
+			JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = con.conkey[1]
+			WHERE con.conrelid = to_regclass(quote_ident(c.table_name)) AND con.contype = 'f'
+				AND array_length(con.conkey, 1) = 1 AND a.attname = c.column_name
+			LIMIT 1
+		) fk ON true
+		WHERE c.table_name = $1 AND c.table_schema = 'public'
+		ORDER BY COALESCE(m.position, c.ordinal_position), c.ordinal_position`, metadataSchema)
+
+	rows, err := exec.Query(query, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metadata []ColumnMetadata
+	for rows.Next() {
+		var (
+			columnName, dataType string
+			ordinal              int
+			label, semanticType  sql.NullString
+			required             sql.NullBool
+			defaultValue         sql.NullString
+			position             sql.NullInt64
+			description          sql.NullString
+			rules                []byte
+			linkTable, onDelete  sql.NullString
+		)
+		if err := rows.Scan(&columnName, &dataType, &ordinal, &label, &semanticType, &required, &defaultValue, &position, &description, &rules, &linkTable, &onDelete); err != nil {
+			return nil, err
+		}
+
+		meta := inferredColumnMetadata(columnName, dataType, ordinal, system)
+		meta.declared = semanticType.Valid || linkTable.Valid
+		if linkTable.Valid {
+			meta.Type = semanticLink
+			meta.Link = &ColumnLink{Table: linkTable.String, OnDelete: foreignKeyAction(onDelete.String)}
+		}
+		if semanticType.Valid {
+			if label.String != "" {
+				meta.Label = label.String
+			}
+			meta.Type = semanticType.String
+			meta.Required = required.Bool
+			meta.Position = int(position.Int64)
+			meta.Description = description.String
+			if defaultValue.Valid {
+				value := defaultValue.String
+				meta.DefaultValue = &value
+			}
+			if len(rules) > 0 {
+				if err := json.Unmarshal(rules, &meta.Rules); err != nil {
+					return nil, fmt.Errorf("invalid rules for column %s: %w", columnName, err)
+				}
+				meta.compilePattern()
+			}
+		}
+		metadata = append(metadata, meta)
+	}
+	return metadata, rows.Err()
+}
+
+// inferredColumnMetadata returns the metadata reported for a column without a catalog
+// entry; system lists the table's system columns
+func inferredColumnMetadata(columnName, dataType string, ordinal int, system []string) ColumnMetadata {
+	return ColumnMetadata{
+		Key:      columnName,
+		Label:    defaultColumnLabel(columnName),
+		Type:     inferSemanticType(columnName, dataType),
+		Required: columnName == "id",
+		Position: ordinal,
+		Editable: columnName != "id" && !isSystemColumn(columnName, system),
+	}
+}
+
+// applyColumnDefaults fills in catalog defaults for columns missing from a new record
+func applyColumnDefaults(metadata []ColumnMetadata, recordData Record) {
+	for _, meta := range metadata {
+		if meta.Key == "id" || meta.DefaultValue == nil {
+			continue
+		}
+		if value, exists := recordData[meta.Key]; !exists || value == nil {
+			recordData[meta.Key] = *meta.DefaultValue
+		}
+	}
+}
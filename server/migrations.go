@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Operations recorded in the migration log
+const (
+	migrationCreateTable  = "create_table"
+	migrationDropTable    = "drop_table"
+	migrationRenameTable  = "rename_table"
+	migrationCloneTable   = "clone_table"
+	migrationArchiveTable = "archive_table"
+	migrationRestoreTable = "restore_table"
+	migrationPurgeTable   = "purge_table"
+	migrationAddColumn    = "add_column"
+	migrationDropColumn   = "drop_column"
+	migrationAlterColumn  = "alter_column"
+	migrationCreateIndex  = "create_index"
+	migrationDropIndex    = "drop_index"
+)
+
+var migrationOperations = []string{
+	migrationCreateTable, migrationDropTable, migrationRenameTable, migrationCloneTable,
+	migrationArchiveTable, migrationRestoreTable, migrationPurgeTable, migrationAddColumn,
+	migrationDropColumn, migrationAlterColumn, migrationCreateIndex, migrationDropIndex,
+}
+
+// defaultMigrationLimit is the page size of migration listings that don't set limit
+const defaultMigrationLimit = 100
+
+// reasonHeader lets a client say why it changes the schema
+const reasonHeader = "X-Change-Reason"
+
+// Migration is one recorded schema change. Up is the DDL that made it and Down the DDL
+// that undoes it, empty when the change can't be undone (a purge, say).
+type Migration struct {
+	ID        int64     `json:"id"`
+	Table     string    `json:"table"`
+	Operation string    `json:"operation"`
+	Up        string    `json:"up"`
+	Down      string    `json:"down"`
+	Actor     string    `json:"actor,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// migrationQuery selects migrations, oldest first. A zero Limit selects all of them.
+type migrationQuery struct {
+	Table     string
+	Operation string
+	Actor     string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+	Offset    int
+}
+
+// parseMigrationQuery reads the table, operation, actor, since, until, limit and offset
+// parameters of a migration listing
+func parseMigrationQuery(params url.Values) (migrationQuery, error) {
+	query := migrationQuery{
+		Table:     params.Get("table"),
+		Operation: params.Get("operation"),
+		Actor:     params.Get("actor"),
+		Limit:     defaultMigrationLimit,
+	}
+
+	if query.Operation != "" && !containsString(migrationOperations, query.Operation) {
+		return query, fmt.Errorf("unknown operation '%s'", query.Operation)
+	}
+	for name, target := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s '%s': use an RFC 3339 time", name, value)
+			}
+			*target = parsed
+		}
+	}
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("invalid limit '%s'", limitStr)
+		}
+		query.Limit = min(limit, maxPageLimit)
+	}
+	if offsetStr := params.Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return query, fmt.Errorf("invalid offset '%s'", offsetStr)
+		}
+		query.Offset = offset
+	}
+	return query, nil
+}
+
+// matches reports whether a migration is selected by the query's filters
+func (q migrationQuery) matches(migration Migration) bool {
+	return (q.Table == "" || migration.Table == q.Table) &&
+		(q.Operation == "" || migration.Operation == q.Operation) &&
+		(q.Actor == "" || migration.Actor == q.Actor) &&
+		(q.Since.IsZero() || !migration.AppliedAt.Before(q.Since)) &&
+		(q.Until.IsZero() || migration.AppliedAt.Before(q.Until))
+}
+
+// schemaChange says who makes a schema change and why
+type schemaChange struct {
+	Actor  string
+	Reason string
+}
+
+// requestSchemaChange reads the actor and X-Change-Reason headers of a request
+func requestSchemaChange(r *http.Request) schemaChange {
+	reason := strings.TrimSpace(r.Header.Get(reasonHeader))
+	if len(reason) > 1000 {
+		reason = reason[:1000]
+	}
+	return schemaChange{Actor: requestActor(r), Reason: reason}
+}
+
+// recordMigration adds a schema change to the migration log. The change has already been
+// made, so a failure to record it is logged rather than returned.
+func recordMigration(change schemaChange, tableName, operation string, up, down []string) {
+	migration := Migration{
+		Table:     tableName,
+		Operation: operation,
+		Up:        sqlScript(up),
+		Down:      sqlScript(down),
+		Actor:     change.Actor,
+		Reason:    change.Reason,
+		AppliedAt: time.Now().UTC(),
+	}
+	if err := store.RecordMigration(migration); err != nil {
+		log.Printf("Warning: Failed to record %s of table %s in the migration log: %v", operation, tableName, err)
+	}
+}
+
+// sqlScript terminates each statement and puts it on its own line
+func sqlScript(statements []string) string {
+	var script strings.Builder
+	for _, statement := range statements {
+		script.WriteString(statement)
+		script.WriteString(";\n")
+	}
+	return script.String()
+}
+
+// createTableStatement creates a table with the id and row_version columns every table
+// starts with, followed by the given columns
+func createTableStatement(tableName string, columns []columnDef) string {
+	columnDefs := []string{"id SERIAL PRIMARY KEY", quoteIdentifier(versionColumn) + " " + versionColumnType}
+	for _, col := range columns {
+		columnDefs = append(columnDefs, fmt.Sprintf("%s %s", quoteIdentifier(col.Name), col.Type))
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdentifier(tableName), strings.Join(columnDefs, ", "))
+}
+
+// createTableStatements create a table together with the columns its options add
+func createTableStatements(tableName string, columns []columnDef, options tableOptions) []string {
+	statements := []string{createTableStatement(tableName, columns)}
+	if options.Timestamps {
+		for _, col := range timestampColumns {
+			statements = append(statements, timestampColumnStatements(tableName, col)...)
+		}
+	}
+	if options.SoftDelete {
+		statements = append(statements, softDeleteStatements(tableName)...)
+	}
+	return statements
+}
+
+func dropTableStatement(tableName string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(tableName))
+}
+
+func addColumnStatement(tableName, columnName, columnType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteIdentifier(tableName), quoteIdentifier(columnName), columnType)
+}
+
+func dropColumnStatement(tableName, columnName string) string {
+	return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdentifier(tableName), quoteIdentifier(columnName))
+}
+
+// alterColumnTypeStatement converts existing values with a cast from the current type
+func alterColumnTypeStatement(tableName, columnName, newType string) string {
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s",
+		quoteIdentifier(tableName), quoteIdentifier(columnName), newType, quoteIdentifier(columnName), newType)
+}
+
+func renameColumnStatement(tableName, columnName, newName string) string {
+	return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s",
+		quoteIdentifier(tableName), quoteIdentifier(columnName), quoteIdentifier(newName))
+}
+
+// columnIndexStatement creates the default single-column index
+func columnIndexStatement(tableName, columnName string) string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s (%s)", quoteIdentifier(defaultIndexName(tableName, []string{columnName}, false)),
+		quoteIdentifier(tableName), quoteIdentifier(columnName))
+}
+
+// foreignKeyStatement adds the foreign key of a link column
+func foreignKeyStatement(tableName, columnName string, link ColumnLink) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (id) ON DELETE %s",
+		quoteIdentifier(tableName), quoteIdentifier(tableName+"_"+columnName+"_fkey"), quoteIdentifier(columnName),
+		quoteIdentifier(link.Table), link.OnDelete)
+}
+
+// cloneTableStatements copy a table definition, give the copy its own id sequence and
+// re-create the foreign keys, which LIKE leaves out
+func cloneTableStatements(schema TableSchema, newName string) []string {
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", quoteIdentifier(newName), quoteIdentifier(schema.Name)),
+		fmt.Sprintf("CREATE SEQUENCE %s OWNED BY %s.id", quoteIdentifier(newName+"_id_seq"), quoteIdentifier(newName)),
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN id SET DEFAULT nextval(%s)", quoteIdentifier(newName), pq.QuoteLiteral(quoteIdentifier(newName+"_id_seq"))),
+	}
+	for _, column := range schema.Columns {
+		if fk := column.ForeignKey; fk != nil {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE %s",
+				quoteIdentifier(newName), quoteIdentifier(newName+"_"+column.Name+"_fkey"), quoteIdentifier(column.Name),
+				quoteIdentifier(fk.Table), quoteIdentifier(fk.Column), fk.OnDelete))
+		}
+	}
+	return statements
+}
+
+// renameTableStatements rename a table, its id sequence and those of its indexes whose
+// name starts with the table name, as RenameTable does
+func renameTableStatements(tableName, newName string, indexes []string) []string {
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdentifier(tableName), quoteIdentifier(newName)),
+		fmt.Sprintf("ALTER SEQUENCE IF EXISTS %s RENAME TO %s", quoteIdentifier(tableName+"_id_seq"), quoteIdentifier(newName+"_id_seq")),
+	}
+	for _, index := range indexes {
+		if renamed, ok := renamedIndex(index, tableName, newName); ok {
+			statements = append(statements, fmt.Sprintf("ALTER INDEX %s RENAME TO %s", quoteIdentifier(index), quoteIdentifier(renamed)))
+		}
+	}
+	return statements
+}
+
+// renamedIndex is the name an index of the table gets when the table is renamed
+func renamedIndex(index, tableName, newName string) (string, bool) {
+	if !strings.HasPrefix(index, tableName+"_") {
+		return index, false
+	}
+	return newName + strings.TrimPrefix(index, tableName), true
+}
+
+// renamedIndexes maps index names through renamedIndex
+func renamedIndexes(indexes []string, tableName, newName string) []string {
+	renamed := make([]string, len(indexes))
+	for i, index := range indexes {
+		renamed[i], _ = renamedIndex(index, tableName, newName)
+	}
+	return renamed
+}
+
+// tableStatements recreate a table as introspected: its columns with their types,
+// defaults and foreign keys, then its indexes. Rows are not part of it.
+func tableStatements(schema TableSchema) []string {
+	var columns []string
+	for _, column := range schema.Columns {
+		if column.PrimaryKey && column.Name == "id" {
+			columns = append(columns, "id SERIAL PRIMARY KEY")
+			continue
+		}
+		columns = append(columns, columnDefinition(column, true))
+	}
+	statements := []string{fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdentifier(schema.Name), strings.Join(columns, ", "))}
+	for _, index := range schema.Indexes {
+		if !index.Primary {
+			statements = append(statements, index.Definition)
+		}
+	}
+	return statements
+}
+
+// columnDefinition spells out an introspected column for CREATE TABLE or ADD COLUMN.
+// NOT NULL is left out when the column is added back to a table that may have rows.
+func columnDefinition(column ColumnSchema, notNull bool) string {
+	definition := quoteIdentifier(column.Name) + " " + column.Type
+	if notNull && !column.Nullable {
+		definition += " NOT NULL"
+	}
+	if column.Default != nil {
+		definition += " DEFAULT " + *column.Default
+	}
+	if fk := column.ForeignKey; fk != nil {
+		definition += fmt.Sprintf(" REFERENCES %s (%s) ON DELETE %s", quoteIdentifier(fk.Table), quoteIdentifier(fk.Column), fk.OnDelete)
+	}
+	return definition
+}
+
+// alterColumnStatements change a column's type and/or name and change it back.
+// column is the column as it was before.
+func alterColumnStatements(tableName string, column ColumnSchema, change columnChange) (up, down []string) {
+	if change.NewType != "" {
+		up = append(up, alterColumnTypeStatement(tableName, column.Name, change.NewType))
+	}
+	if change.NewName != "" && change.NewName != column.Name {
+		up = append(up, renameColumnStatement(tableName, column.Name, change.NewName))
+		down = append(down, renameColumnStatement(tableName, change.NewName, column.Name))
+	}
+	if change.NewType != "" {
+		down = append(down, alterColumnTypeStatement(tableName, column.Name, column.Type))
+	}
+	return up, down
+}
+
+// dropColumnStatements drop a column and add it back with its type, default, foreign key
+// and the indexes it was part of. The values it held are not restored.
+func dropColumnStatements(tableName string, schema TableSchema, column ColumnSchema) (up, down []string) {
+	up = []string{dropColumnStatement(tableName, column.Name)}
+	down = []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteIdentifier(tableName), columnDefinition(column, false))}
+	for _, index := range schema.Indexes {
+		if !index.Primary && containsString(index.Columns, column.Name) {
+			down = append(down, index.Definition)
+		}
+	}
+	return up, down
+}
+
+// schemaColumn finds a column of an introspected table
+func schemaColumn(schema TableSchema, columnName string) (ColumnSchema, bool) {
+	for _, column := range schema.Columns {
+		if column.Name == columnName {
+			return column, true
+		}
+	}
+	return ColumnSchema{}, false
+}
+
+// indexNames lists the names of the indexes in a schema
+func indexNames(schema TableSchema) []string {
+	names := make([]string, len(schema.Indexes))
+	for i, index := range schema.Indexes {
+		names[i] = index.Name
+	}
+	return names
+}
+
+// archivedTableName qualifies a table of the archive schema
+func archivedTableName(archiveName string) string {
+	return archiveSchema + "." + quoteIdentifier(archiveName)
+}
+
+// archiveStatements move a table, renamed to archiveName, into the archive schema and
+// back out under newName. indexes are the names of its indexes while archived.
+func archiveStatements(archiveName, newName string, indexes []string) (archive, restore []string) {
+	archive = append(renameTableStatements(newName, archiveName, renamedIndexes(indexes, archiveName, newName)),
+		fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s", quoteIdentifier(archiveName), archiveSchema))
+	restore = append([]string{fmt.Sprintf("ALTER TABLE %s SET SCHEMA public", archivedTableName(archiveName))},
+		renameTableStatements(archiveName, newName, indexes)...)
+	return archive, restore
+}
+
+// addTimestampColumns adds the timestamp columns a table lacks and records the change
+func addTimestampColumns(tableName string, change schemaChange) ([]string, error) {
+	added, err := store.AddTimestampColumns(tableName)
+	if err != nil || len(added) == 0 {
+		return added, err
+	}
+	var up, down []string
+	for _, col := range timestampColumns {
+		if containsString(added, col.Name) {
+			up = append(up, timestampColumnStatements(tableName, col)...)
+			down = append([]string{dropColumnStatement(tableName, col.Name)}, down...)
+		}
+	}
+	recordMigration(change, tableName, migrationAddColumn, up, down)
+	return added, nil
+}
+
+// enableSoftDelete adds the deleted_at column if the table lacks it and records the change
+func enableSoftDelete(tableName string, change schemaChange) (bool, error) {
+	added, err := store.EnableSoftDelete(tableName)
+	if err != nil || !added {
+		return added, err
+	}
+	recordMigration(change, tableName, migrationAddColumn, softDeleteStatements(tableName),
+		[]string{dropColumnStatement(tableName, deletedAtColumn)})
+	return true, nil
+}
+
+// migrationsHandler serves GET /migrations, oldest first
+func migrationsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMigrationQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	migrations, total, err := store.Migrations(query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, migrations)
+}
+
+// migrationsExportHandler serves GET /migrations/export. By default it returns a zip of
+// numbered NNNN_operation_table.up.sql and .down.sql files; format=up returns every up
+// migration as one script and format=down every down migration, newest first. The
+// filters of GET /migrations apply, limit and offset aside.
+func migrationsExportHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "up" && format != "down" {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("unsupported format '%s': use zip, up or down", format))
+		return
+	}
+	params.Del("limit")
+	params.Del("offset")
+	query, err := parseMigrationQuery(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	query.Limit = 0
+
+	migrations, _, err := store.Migrations(query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	if format != "zip" {
+		w.Header().Set("Content-Type", "application/sql; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="migrations.%s.sql"`, format))
+		for i := range migrations {
+			migration := migrations[i]
+			if format == "down" {
+				migration = migrations[len(migrations)-1-i]
+			}
+			fmt.Fprintf(w, "%s\n", migrationFile(migration, format == "up"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="migrations.zip"`)
+	archive := zip.NewWriter(w)
+	for _, migration := range migrations {
+		for _, up := range []bool{true, false} {
+			file, err := archive.Create(migrationFileName(migration, up))
+			if err == nil {
+				_, err = file.Write([]byte(migrationFile(migration, up)))
+			}
+			if err != nil {
+				log.Printf("Warning: Failed to export migration %d: %v", migration.ID, err)
+				return
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Warning: Failed to export migrations: %v", err)
+	}
+}
+
+// migrationFileName numbers the files of an export by migration id so they sort in the
+// order they were applied
+func migrationFileName(migration Migration, up bool) string {
+	direction := "down"
+	if up {
+		direction = "up"
+	}
+	return fmt.Sprintf("%04d_%s_%s.%s.sql", migration.ID, migration.Operation, migration.Table, direction)
+}
+
+// migrationFile is the up or down script of a migration under a comment header saying
+// what it is, when and by whom it was applied and why
+func migrationFile(migration Migration, up bool) string {
+	var file strings.Builder
+	fmt.Fprintf(&file, "-- Migration %d: %s of table %s\n", migration.ID, migration.Operation, migration.Table)
+	fmt.Fprintf(&file, "-- Applied %s", migration.AppliedAt.UTC().Format(time.RFC3339))
+	if migration.Actor != "" {
+		fmt.Fprintf(&file, " by %s", strings.ReplaceAll(migration.Actor, "\n", " "))
+	}
+	file.WriteString("\n")
+	if migration.Reason != "" {
+		fmt.Fprintf(&file, "-- Reason: %s\n", strings.ReplaceAll(migration.Reason, "\n", " "))
+	}
+	switch {
+	case up:
+		file.WriteString(migration.Up)
+	case migration.Down == "":
+		file.WriteString("-- Irreversible: this change can't be undone\n")
+	default:
+		file.WriteString(migration.Down)
+	}
+	return file.String()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Media types accepted by PATCH on a record
+const (
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// patchError is returned when a patch document is malformed or can't be applied
+type patchError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+func invalidPatch(format string, args ...interface{}) *patchError {
+	return &patchError{status: http.StatusBadRequest, code: codeInvalidPatch, message: fmt.Sprintf(format, args...)}
+}
+
+// jsonPatchOperation is one operation of an RFC 6902 JSON Patch document. Value is kept
+// raw so an explicit null can be told apart from a missing value.
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// recordDocument converts a record to its JSON form, which is what patches operate on
+func recordDocument(record Record) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(encoded, &doc)
+	return doc, err
+}
+
+// patchRecord applies a patch body to a record document according to its content type
+// and returns the patched copy
+func patchRecord(doc map[string]interface{}, contentType string, body []byte) (map[string]interface{}, error) {
+	mediaType := "application/json"
+	if contentType != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, &patchError{status: http.StatusUnsupportedMediaType, code: codeUnsupportedMediaType, message: "Invalid Content-Type: " + err.Error()}
+		}
+		mediaType = parsed
+	}
+
+	var patched interface{}
+	switch mediaType {
+	case mediaTypeMergePatch, "application/json":
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, invalidPatch("Invalid merge patch: %v", err)
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, invalidPatch("A merge patch for a record must be a JSON object")
+		}
+		patched = mergePatch(doc, patch)
+	case mediaTypeJSONPatch:
+		var operations []jsonPatchOperation
+		if err := json.Unmarshal(body, &operations); err != nil {
+			return nil, invalidPatch("Invalid JSON Patch: %v", err)
+		}
+		var err error
+		if patched, err = applyJSONPatch(doc, operations); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &patchError{
+			status:  http.StatusUnsupportedMediaType,
+			code:    codeUnsupportedMediaType,
+			message: fmt.Sprintf("Unsupported Content-Type '%s': use %s or %s", mediaType, mediaTypeMergePatch, mediaTypeJSONPatch),
+		}
+	}
+
+	result, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, invalidPatch("The patched record must be a JSON object")
+	}
+	return result, nil
+}
+
+// patchChanges compares a patched document with the record it came from and returns the
+// fields to update, leaving out the table's system columns. Fields the patch removed are
+// set to null.
+func patchChanges(original, patched map[string]interface{}, system []string) (Record, error) {
+	if !reflect.DeepEqual(original["id"], patched["id"]) {
+		return nil, invalidPatch("The id of a record cannot be changed")
+	}
+
+	changes := make(Record)
+	for key, value := range patched {
+		if key == "id" || isSystemColumn(key, system) {
+			continue
+		}
+		if previous, ok := original[key]; !ok || !reflect.DeepEqual(previous, value) {
+			changes[key] = value
+		}
+	}
+	for key, previous := range original {
+		if _, ok := patched[key]; !ok && previous != nil && !isSystemColumn(key, system) {
+			changes[key] = nil
+		}
+	}
+	return changes, nil
+}
+
+// mergePatch applies an RFC 7396 JSON Merge Patch: objects are merged recursively, null
+// removes a member and anything else replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	result := make(map[string]interface{}, len(targetObject))
+	for key, value := range targetObject {
+		result[key] = value
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(result, key)
+			continue
+		}
+		result[key] = mergePatch(result[key], value)
+	}
+	return result
+}
+
+// applyJSONPatch applies the operations of an RFC 6902 JSON Patch in order. The patch is
+// atomic: on error doc is left as it was.
+func applyJSONPatch(doc interface{}, operations []jsonPatchOperation) (interface{}, error) {
+	doc = deepCopyJSON(doc)
+	for i, operation := range operations {
+		var err error
+		if doc, err = applyJSONPatchOperation(doc, operation); err != nil {
+			if patchErr, ok := err.(*patchError); ok {
+				patchErr.message = fmt.Sprintf("Operation %d (%s): %s", i, operation.Op, patchErr.message)
+				return nil, patchErr
+			}
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func applyJSONPatchOperation(doc interface{}, operation jsonPatchOperation) (interface{}, error) {
+	if operation.Path == nil {
+		return nil, invalidPatch("path is required")
+	}
+	path, err := parseJSONPointer(*operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (interface{}, error) {
+		if operation.Value == nil {
+			return nil, invalidPatch("value is required")
+		}
+		var v interface{}
+		if err := json.Unmarshal(operation.Value, &v); err != nil {
+			return nil, invalidPatch("invalid value: %v", err)
+		}
+		return v, nil
+	}
+	from := func() ([]string, error) {
+		if operation.From == nil {
+			return nil, invalidPatch("from is required")
+		}
+		return parseJSONPointer(*operation.From)
+	}
+
+	switch operation.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, v)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, v)
+	case "move":
+		fromPath, err := from()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(fromPath) && reflect.DeepEqual(path[:len(fromPath)], fromPath) {
+			return nil, invalidPatch("cannot move a value into one of its children")
+		}
+		doc, moved, err := pointerRemove(doc, fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, moved)
+	case "copy":
+		fromPath, err := from()
+		if err != nil {
+			return nil, err
+		}
+		copied, err := pointerGet(doc, fromPath)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopyJSON(copied))
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, v) {
+			return nil, &patchError{status: http.StatusConflict, code: codePatchTestFailed, message: fmt.Sprintf("value at '%s' does not match", *operation.Path)}
+		}
+		return doc, nil
+	}
+	return nil, invalidPatch("unknown operation '%s'", operation.Op)
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalidPatch("invalid JSON Pointer '%s'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves an array reference token; "-" is only valid when allowEnd is set
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, invalidPatch("invalid array index '%s'", token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, invalidPatch("array index %d is out of range", index)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, invalidPatch("path '/%s' does not exist", strings.Join(path, "/"))
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, invalidPatch("path '/%s' does not exist", strings.Join(path, "/"))
+		}
+	}
+	return current, nil
+}
+
+// pointerAdd adds value at path, returning the updated document
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return pointerSet(doc, path[:len(path)-1], node)
+	}
+	return nil, invalidPatch("path '/%s' does not exist", strings.Join(path, "/"))
+}
+
+// pointerRemove removes the value at path, returning the updated document and the value
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, invalidPatch("the whole record cannot be removed")
+	}
+	removed, err := pointerGet(doc, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	parent, _ := pointerGet(doc, path[:len(path)-1])
+	token := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		delete(node, token)
+		return doc, removed, nil
+	case []interface{}:
+		index, _ := arrayIndex(token, len(node), false)
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = pointerSet(doc, path[:len(path)-1], node)
+		return doc, removed, err
+	}
+	return nil, nil, invalidPatch("path '/%s' does not exist", strings.Join(path, "/"))
+}
+
+// pointerSet replaces the value at an existing path; arrays change length on add and
+// remove, so the new slice has to be stored back in its parent
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[token] = value
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	}
+	return doc, nil
+}
+
+// deepCopyJSON copies a decoded JSON value so patches never modify shared maps or slices
+func deepCopyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopyJSON(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopyJSON(item)
+		}
+		return copied
+	}
+	return value
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxPageLimit = 1000
+
+// filterParamPattern matches filter[column] and filter[column][operator] query keys
+var filterParamPattern = regexp.MustCompile(`^filter\[([^\[\]]+)\](?:\[([a-z]+)\])?$`)
+
+// filterOperators maps the operators accepted in filter[column][op] to their SQL form
+var filterOperators = map[string]string{
+	"eq":    "=",
+	"neq":   "<>",
+	"gt":    ">",
+	"gte":   ">=",
+	"lt":    "<",
+	"lte":   "<=",
+	"like":  "LIKE",
+	"ilike": "ILIKE",
+	"in":    "IN",
+	"null":  "IS NULL",
+}
+
+type sortField struct {
+	Column     string
+	Descending bool
+}
+
+type filterClause struct {
+	Column   string
+	Operator string
+	Value    string
+}
+
+// recordQuery holds the pagination, sorting and filtering options for listing records
+type recordQuery struct {
+	Limit   int
+	Offset  int
+	After   *int
+	Sort    []sortField
+	Filters []filterClause
+	Fields  []string // columns to return, in order; all of them when empty
+	Trashed bool     // list the soft-deleted rows instead of the live ones
+}
+
+// parseRecordQuery reads limit, offset, after, sort, fields and filter[...] parameters
+// and validates every referenced column against the table's columns
+func parseRecordQuery(params url.Values, columns []string) (recordQuery, error) {
+	var query recordQuery
+
+	known := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		known[col] = true
+	}
+
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return query, fmt.Errorf("invalid limit '%s'", limitStr)
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		query.Limit = limit
+	}
+
+	if offsetStr := params.Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return query, fmt.Errorf("invalid offset '%s'", offsetStr)
+		}
+		query.Offset = offset
+	}
+
+	if sortStr := params.Get("sort"); sortStr != "" {
+		for _, part := range strings.Split(sortStr, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			field := sortField{Column: part}
+			if strings.HasPrefix(part, "-") {
+				field = sortField{Column: part[1:], Descending: true}
+			}
+			if !known[field.Column] {
+				return query, fmt.Errorf("unknown sort column '%s'", field.Column)
+			}
+			query.Sort = append(query.Sort, field)
+		}
+	}
+
+	if fieldsStr := params.Get("fields"); fieldsStr != "" {
+		for _, field := range strings.Split(fieldsStr, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" || containsString(query.Fields, field) {
+				continue
+			}
+			if !known[field] {
+				return query, fmt.Errorf("unknown field '%s'", field)
+			}
+			query.Fields = append(query.Fields, field)
+		}
+	}
+
+	if afterStr := params.Get("after"); afterStr != "" {
+		after, err := strconv.Atoi(afterStr)
+		if err != nil {
+			return query, fmt.Errorf("invalid cursor '%s'", afterStr)
+		}
+		if query.Offset > 0 {
+			return query, fmt.Errorf("after and offset cannot be combined")
+		}
+		if !query.sortedByID() {
+			return query, fmt.Errorf("cursor pagination requires sorting by id")
+		}
+		query.After = &after
+	}
+
+	for key, values := range params {
+		match := filterParamPattern.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		column, operator := match[1], match[2]
+		if operator == "" {
+			operator = "eq"
+		}
+		if !known[column] {
+			return query, fmt.Errorf("unknown filter column '%s'", column)
+		}
+		if _, ok := filterOperators[operator]; !ok {
+			return query, fmt.Errorf("unknown filter operator '%s'", operator)
+		}
+		for _, value := range values {
+			if _, err := strconv.ParseBool(value); operator == "null" && err != nil {
+				return query, fmt.Errorf("filter[%s][null] expects true or false", column)
+			}
+			query.Filters = append(query.Filters, filterClause{Column: column, Operator: operator, Value: value})
+		}
+	}
+
+	return query, nil
+}
+
+// sortedByID reports whether the query orders by id only, which cursor pagination needs
+func (q recordQuery) sortedByID() bool {
+	return len(q.Sort) == 0 || (len(q.Sort) == 1 && q.Sort[0].Column == "id")
+}
+
+// descendingByID reports whether the query orders by id descending
+func (q recordQuery) descendingByID() bool {
+	return len(q.Sort) == 1 && q.Sort[0].Column == "id" && q.Sort[0].Descending
+}
+
+// selectColumns returns the columns a listing returns: the selected fields, or every
+// column of the table
+func (q recordQuery) selectColumns(columns []string) []string {
+	if len(q.Fields) > 0 {
+		return q.Fields
+	}
+	return columns
+}
+
+// scoped restricts the query to live rows, or to trashed rows when Trashed is set, if
+// deleted_at is among the table's system columns
+func (q recordQuery) scoped(system []string) recordQuery {
+	if !containsString(system, deletedAtColumn) {
+		return q
+	}
+	filters := append([]filterClause(nil), q.Filters...)
+	q.Filters = append(filters, filterClause{Column: deletedAtColumn, Operator: "null", Value: strconv.FormatBool(!q.Trashed)})
+	return q
+}
+
+// whereClause builds the parameterized WHERE clause for the filters and cursor,
+// numbering placeholders from startIndex
+func (q recordQuery) whereClause(startIndex int) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	placeholderIndex := startIndex
+
+	for _, filter := range q.Filters {
+		condition, err := filterCondition(filter, func(value string) string {
+			args = append(args, value)
+			placeholderIndex++
+			return fmt.Sprintf("$%d", placeholderIndex-1)
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if q.After != nil {
+		if q.descendingByID() {
+			conditions = append(conditions, fmt.Sprintf("id < $%d", placeholderIndex))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("id > $%d", placeholderIndex))
+		}
+		args = append(args, *q.After)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// filterCondition renders one filter as a SQL condition, calling bind for each value to get
+// the placeholder or literal that stands for it
+func filterCondition(filter filterClause, bind func(value string) string) (string, error) {
+	column := quoteIdentifier(filter.Column)
+	switch filter.Operator {
+	case "null":
+		isNull, err := strconv.ParseBool(filter.Value)
+		if err != nil {
+			return "", fmt.Errorf("filter[%s][null] expects true or false", filter.Column)
+		}
+		if isNull {
+			return fmt.Sprintf("%s IS NULL", column), nil
+		}
+		return fmt.Sprintf("%s IS NOT NULL", column), nil
+	case "in":
+		var values []string
+		for _, value := range strings.Split(filter.Value, ",") {
+			values = append(values, bind(value))
+		}
+		return fmt.Sprintf("%s::text IN (%s)", column, strings.Join(values, ", ")), nil
+	case "like", "ilike":
+		return fmt.Sprintf("%s::text %s %s", column, filterOperators[filter.Operator], bind(filter.Value)), nil
+	}
+	return fmt.Sprintf("%s %s %s", column, filterOperators[filter.Operator], bind(filter.Value)), nil
+}
+
+// orderClause builds the ORDER BY clause, always ending with id so pages are stable
+func (q recordQuery) orderClause() string {
+	var parts []string
+	hasID := false
+	for _, field := range q.Sort {
+		direction := "ASC"
+		if field.Descending {
+			direction = "DESC"
+		}
+		if field.Column == "id" {
+			hasID = true
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", quoteIdentifier(field.Column), direction))
+	}
+	if !hasID {
+		parts = append(parts, "id ASC")
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+// limitClause builds the LIMIT/OFFSET clause
+func (q recordQuery) limitClause() string {
+	clause := ""
+	if q.Limit > 0 {
+		clause += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	if q.Offset > 0 {
+		clause += fmt.Sprintf(" OFFSET %d", q.Offset)
+	}
+	return clause
+}
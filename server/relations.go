@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Keys under which expanded and included records are embedded in a record
+const (
+	expandKey  = "_expand"
+	includeKey = "_include"
+)
+
+// relationLookupChunk bounds the number of values sent in one IN filter
+const relationLookupChunk = 500
+
+// recordRelations are the links to resolve for a page of records: expand embeds the record
+// a link column points at, include embeds the records of another table linking back
+type recordRelations struct {
+	expand  []ColumnSchema
+	include []reverseLink
+}
+
+// reverseLink is a link column in another table that points at the listed table
+type reverseLink struct {
+	key    string
+	table  string
+	column string
+}
+
+// listParam splits a comma separated, possibly repeated, query parameter
+func listParam(params url.Values, name string) []string {
+	var values []string
+	for _, value := range params[name] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// parseRecordRelations reads expand=column,... and include=table[.column],... for
+// tableName and checks every name against the foreign keys in the catalog
+func parseRecordRelations(tableName string, params url.Values) (recordRelations, error) {
+	var relations recordRelations
+	expand, include := listParam(params, "expand"), listParam(params, "include")
+	if len(expand) == 0 && len(include) == 0 {
+		return relations, nil
+	}
+
+	if len(expand) > 0 {
+		schema, err := store.TableSchema(tableName)
+		if err != nil {
+			return relations, err
+		}
+		for _, name := range expand {
+			var found *ColumnSchema
+			for i := range schema.Columns {
+				if schema.Columns[i].Name == name {
+					found = &schema.Columns[i]
+				}
+			}
+			if found == nil || found.ForeignKey == nil {
+				return relations, fmt.Errorf("cannot expand '%s': not a link column", name)
+			}
+			relations.expand = append(relations.expand, *found)
+		}
+	}
+
+	for _, key := range include {
+		childTable, column, _ := strings.Cut(key, ".")
+		if err := validateTableName(childTable); err != nil {
+			return relations, err
+		}
+		exists, err := store.TableExists(childTable)
+		if err != nil {
+			return relations, err
+		}
+		if !exists {
+			return relations, fmt.Errorf("cannot include '%s': table not found", key)
+		}
+		schema, err := store.TableSchema(childTable)
+		if err != nil {
+			return relations, err
+		}
+
+		var candidates []string
+		for _, col := range schema.Columns {
+			if col.ForeignKey != nil && col.ForeignKey.Table == tableName && (column == "" || col.Name == column) {
+				candidates = append(candidates, col.Name)
+			}
+		}
+		switch {
+		case len(candidates) == 0:
+			return relations, fmt.Errorf("cannot include '%s': it has no link to %s", key, tableName)
+		case len(candidates) > 1:
+			return relations, fmt.Errorf("cannot include '%s': several columns link to %s, use %s.<column>", key, tableName, childTable)
+		}
+		relations.include = append(relations.include, reverseLink{key: key, table: childTable, column: candidates[0]})
+	}
+	return relations, nil
+}
+
+// apply embeds the related records into records
+func (rel recordRelations) apply(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	for _, column := range rel.expand {
+		var ids []string
+		for _, record := range records {
+			if value := record[column.Name]; value != nil {
+				ids = append(ids, fmt.Sprint(value))
+			}
+		}
+		linked, err := recordsByValues(column.ForeignKey.Table, "id", ids)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]Record, len(linked))
+		for _, record := range linked {
+			byID[fmt.Sprint(record["id"])] = record
+		}
+		for _, record := range records {
+			var target interface{}
+			if value := record[column.Name]; value != nil {
+				if linkedRecord, ok := byID[fmt.Sprint(value)]; ok {
+					target = linkedRecord
+				}
+			}
+			embed(record, expandKey, column.Name, target)
+		}
+	}
+
+	for _, link := range rel.include {
+		ids := make([]string, len(records))
+		for i, record := range records {
+			ids[i] = fmt.Sprint(record["id"])
+		}
+		children, err := recordsByValues(link.table, link.column, ids)
+		if err != nil {
+			return err
+		}
+		byParent := make(map[string][]Record)
+		for _, child := range children {
+			parent := fmt.Sprint(child[link.column])
+			byParent[parent] = append(byParent[parent], child)
+		}
+		for _, record := range records {
+			included := byParent[fmt.Sprint(record["id"])]
+			if included == nil {
+				included = []Record{}
+			}
+			embed(record, includeKey, link.key, included)
+		}
+	}
+	return nil
+}
+
+// embed sets record[group][name] = value, creating the group on first use
+func embed(record Record, group, name string, value interface{}) {
+	embedded, ok := record[group].(map[string]interface{})
+	if !ok {
+		embedded = make(map[string]interface{})
+		record[group] = embedded
+	}
+	embedded[name] = value
+}
+
+// recordsByValues lists the records of tableName whose column is one of values, in
+// chunks so large pages don't exceed the bind parameter limit
+func recordsByValues(tableName, column string, values []string) ([]Record, error) {
+	var records []Record
+	seen := make(map[string]bool, len(values))
+	unique := values[:0:0]
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+
+	for start := 0; start < len(unique); start += relationLookupChunk {
+		end := start + relationLookupChunk
+		if end > len(unique) {
+			end = len(unique)
+		}
+		query := recordQuery{Filters: []filterClause{{Column: column, Operator: "in", Value: strings.Join(unique[start:end], ",")}}}
+		chunk, _, err := store.ListRecords(tableName, query)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, chunk...)
+	}
+	return records, nil
+}
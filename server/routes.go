@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// newRouter registers every route on a method-aware ServeMux. Requests whose path matches
+// but whose method doesn't are answered by the mux with 405 and an Allow header; both
+// that and the mux's 404 use the JSON error envelope.
+func newRouter(cfg ServerConfig) http.Handler {
+	mux := http.NewServeMux()
+
+	// Records: legacy query-parameter form (?table=name) and table-in-path forms
+	mux.HandleFunc("POST /records/bulk", bulkRecordHandler)
+	for _, prefix := range []string{"/records", "/tables/{table}/records"} {
+		mux.HandleFunc("GET "+prefix, recordHandler)
+		mux.HandleFunc("POST "+prefix, recordHandler)
+		mux.HandleFunc("DELETE "+prefix, bulkDeleteHandler)
+		mux.HandleFunc("GET "+prefix+"/{id}", recordHandler)
+		mux.HandleFunc("PUT "+prefix+"/{id}", recordHandler)
+		mux.HandleFunc("PATCH "+prefix+"/{id}", recordHandler)
+		mux.HandleFunc("DELETE "+prefix+"/{id}", recordHandler)
+		mux.HandleFunc("GET "+prefix+"/{id}/history", recordHistoryHandler)
+		mux.HandleFunc("POST "+prefix+"/{id}/revert", recordRevertHandler)
+	}
+	mux.HandleFunc("GET /records/{table}/{id}", recordHandler)
+	mux.HandleFunc("PUT /records/{table}/{id}", recordHandler)
+	mux.HandleFunc("PATCH /records/{table}/{id}", recordHandler)
+	mux.HandleFunc("DELETE /records/{table}/{id}", recordHandler)
+	mux.HandleFunc("GET /records/{table}/{id}/history", recordHistoryHandler)
+	mux.HandleFunc("POST /records/{table}/{id}/revert", recordRevertHandler)
+	mux.HandleFunc("GET /audit", auditHandler)
+
+	// Tables
+	mux.HandleFunc("GET /tables", tableHandler)
+	mux.HandleFunc("POST /tables", tableHandler)
+	mux.HandleFunc("PATCH /tables/{table}", tableHandler)
+	mux.HandleFunc("DELETE /tables/{table}", tableHandler)
+	mux.HandleFunc("POST /tables/preview", schemaPreviewHandler)
+	mux.HandleFunc("POST /tables/{table}/clone", tableCloneHandler)
+	mux.HandleFunc("GET /tables/{table}/schema", tableSchemaHandler)
+	mux.HandleFunc("GET /tables/{table}/export", tableExportHandler)
+	mux.HandleFunc("GET /tables/{table}/indexes", tableIndexesHandler)
+	mux.HandleFunc("POST /tables/{table}/indexes", tableIndexesHandler)
+	mux.HandleFunc("DELETE /tables/{table}/indexes/{index}", tableIndexHandler)
+
+	// Columns
+	mux.HandleFunc("GET /columns", columnHandler)
+	mux.HandleFunc("POST /columns", columnHandler)
+	mux.HandleFunc("PUT /columns", columnHandler)
+	mux.HandleFunc("PATCH /columns", columnHandler)
+	mux.HandleFunc("DELETE /columns", columnHandler)
+
+	// Migrations: the DDL behind every schema change
+	mux.HandleFunc("GET /migrations", migrationsHandler)
+	mux.HandleFunc("GET /migrations/export", migrationsExportHandler)
+
+	// Trash: soft-deleted records and dropped tables
+	mux.HandleFunc("GET /trash", trashHandler)
+	mux.HandleFunc("POST /trash/purge", trashPurgeHandler)
+	mux.HandleFunc("GET /trash/tables", trashTablesHandler)
+	mux.HandleFunc("POST /trash/tables/{name}/restore", trashTableHandler)
+	mux.HandleFunc("DELETE /trash/tables/{name}", trashTableHandler)
+	mux.HandleFunc("GET /trash/records/{table}", trashRecordsHandler)
+	mux.HandleFunc("POST /trash/records/{table}/{id}/restore", trashRecordRestoreHandler)
+
+	return withCORS(cfg.CORSOrigins, trimTrailingSlash(jsonMuxErrors(mux)))
+}
+
+// trimTrailingSlash lets "/records/5/" reach the same route as "/records/5"
+func trimTrailingSlash(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// recordTableName resolves the table for a record request from the path, then the
+// legacy ?table= parameter, defaulting to "users"
+func recordTableName(r *http.Request) string {
+	if tableName := r.PathValue("table"); tableName != "" {
+		return tableName
+	}
+	if tableName := r.URL.Query().Get("table"); tableName != "" {
+		return tableName
+	}
+	return "users"
+}
+
+// Values of the Prefer return preference (RFC 7240)
+const (
+	preferReturnMinimal        = "minimal"
+	preferReturnRepresentation = "representation"
+)
+
+// preferredReturn reads "Prefer: return=minimal|representation", falling back to
+// fallback when the header doesn't state a (valid) return preference
+func preferredReturn(r *http.Request, fallback string) (string, bool) {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+			switch value = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`)); value {
+			case preferReturnMinimal, preferReturnRepresentation:
+				return value, true
+			}
+		}
+	}
+	return fallback, false
+}
+
+// writeRecordResult responds with record, or with an empty body when the client asked
+// for return=minimal; emptyStatus is used then instead of status
+func writeRecordResult(w http.ResponseWriter, r *http.Request, status, emptyStatus int, record Record, fallback string) {
+	preference, requested := preferredReturn(r, fallback)
+	if requested {
+		w.Header().Set("Preference-Applied", "return="+preference)
+	}
+	if preference == preferReturnMinimal {
+		w.WriteHeader(emptyStatus)
+		return
+	}
+	writeJSON(w, status, record)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// schemaCacheTTL bounds how long a cached schema is served, so changes made outside the
+// server (and row-count estimates) eventually show up
+const schemaCacheTTL = 30 * time.Second
+
+// TableSchema describes a table as reported by the database catalog
+type TableSchema struct {
+	Name        string         `json:"name"`
+	Columns     []ColumnSchema `json:"columns"`
+	Indexes     []IndexSchema  `json:"indexes"`
+	RowEstimate int64          `json:"rowEstimate"`
+	SchemaMode  string         `json:"schemaMode,omitempty"`
+}
+
+// ColumnSchema describes a single column and the constraints that apply to it
+type ColumnSchema struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	DataType   string            `json:"dataType"`
+	Nullable   bool              `json:"nullable"`
+	Default    *string           `json:"default,omitempty"`
+	Position   int               `json:"position"`
+	PrimaryKey bool              `json:"primaryKey"`
+	Unique     bool              `json:"unique"`
+	ForeignKey *ForeignKeySchema `json:"foreignKey,omitempty"`
+}
+
+// ForeignKeySchema describes the column a foreign key references
+type ForeignKeySchema struct {
+	Constraint string `json:"constraint"`
+	Table      string `json:"table"`
+	Column     string `json:"column"`
+	OnDelete   string `json:"onDelete"`
+}
+
+// IndexSchema describes an index on a table
+type IndexSchema struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	Unique     bool     `json:"unique"`
+	Primary    bool     `json:"primary"`
+	Method     string   `json:"method"`
+	Predicate  string   `json:"predicate,omitempty"`
+	Definition string   `json:"definition"`
+}
+
+// schemaCache keeps introspected schemas per table until they expire or the table's
+// structure is changed through the store
+type schemaCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]schemaCacheEntry
+}
+
+type schemaCacheEntry struct {
+	schema  TableSchema
+	expires time.Time
+}
+
+func newSchemaCache(ttl time.Duration) *schemaCache {
+	return &schemaCache{ttl: ttl, entries: make(map[string]schemaCacheEntry)}
+}
+
+func (c *schemaCache) get(tableName string) (TableSchema, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[tableName]
+	if !ok || time.Now().After(entry.expires) {
+		return TableSchema{}, false
+	}
+	return entry.schema, true
+}
+
+func (c *schemaCache) put(tableName string, schema TableSchema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[tableName] = schemaCacheEntry{schema: schema, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidate drops the cached schemas of the given tables
+func (c *schemaCache) invalidate(tableNames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tableName := range tableNames {
+		delete(c.entries, tableName)
+	}
+}
+
+// tableSchemaHandler serves GET /tables/{table}/schema
+func tableSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := r.PathValue("table")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if schema.SchemaMode, err = store.SchemaMode(tableName); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schema)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema modes decide what happens to record fields that have no column
+const (
+	schemaModeDynamic = "dynamic" // add a column for the field
+	schemaModeStrict  = "strict"  // reject the record
+	schemaModeIgnore  = "ignore"  // drop the field
+)
+
+// normalizeSchemaMode checks a client supplied schema mode
+func normalizeSchemaMode(mode string) (string, error) {
+	switch normalized := strings.ToLower(strings.TrimSpace(mode)); normalized {
+	case schemaModeDynamic, schemaModeStrict, schemaModeIgnore:
+		return normalized, nil
+	}
+	return "", fmt.Errorf("invalid schema mode '%s': expected '%s', '%s' or '%s'", mode, schemaModeDynamic, schemaModeStrict, schemaModeIgnore)
+}
+
+// applySchemaMode deals with the fields of recordData that match no column. In strict
+// mode they are returned as field errors, in ignore mode they are removed from
+// recordData, and in dynamic mode they are left for the caller to add as columns.
+func applySchemaMode(mode string, columns []string, recordData Record) []FieldError {
+	if mode == schemaModeDynamic {
+		return nil
+	}
+
+	var errors []FieldError
+	for key := range recordData {
+		if key == "id" || containsString(columns, sanitizeColumnName(key)) {
+			continue
+		}
+		if mode == schemaModeIgnore {
+			delete(recordData, key)
+			continue
+		}
+		errors = append(errors, FieldError{Field: key, Code: codeUnknownField, Message: fmt.Sprintf("%s is not a column of this table", key)})
+	}
+	sort.Slice(errors, func(i, j int) bool { return errors[i].Field < errors[j].Field })
+	return errors
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,17 +20,31 @@ import (
 
 type Record map[string]interface{}
 
-var db *sql.DB
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx so helpers can run
+// inside or outside a transaction.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
 var (
 	emailPattern = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 )
 
-func withCORS(h http.HandlerFunc) http.HandlerFunc {
+func withCORS(origins []string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if containsString(origins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); containsString(origins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Prefer, If-Match, If-None-Match, "+actorHeader+", "+reasonHeader)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, Preference-Applied, ETag")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Server is ready to handle CORS preflight requests"))
@@ -36,162 +55,265 @@ func withCORS(h http.HandlerFunc) http.HandlerFunc {
 }
 
 func main() {
-	connStr := "host=localhost port=5432 user=namph1 password=1234 dbname=mock2 sslmode=disable"
-	var err error
-	db, err = sql.Open("postgres", connStr)
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	if printConfig {
+		if err := writeConfig(os.Stdout, cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	level, _ := cfg.slogLevel()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	// SetDefault routes the log package through the handler at INFO; keep log.Printf
+	// warnings and log.Fatal messages visible whatever the level
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+
+	db, err := sql.Open("postgres", cfg.Database.DSN())
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
 	if err = db.Ping(); err != nil {
 		log.Fatal("Failed to ping database:", err)
 	}
 	fmt.Println("Connected to database successfully")
 
+	pgStore, err := newPostgresStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = pgStore
+
 	// Initialize default tables
 	initializeDefaultTables()
 
-	// Register handlers
-	http.HandleFunc("/records/", withCORS(recordHandler))
-	http.HandleFunc("/records", withCORS(recordHandler))
-	http.HandleFunc("/tables/", withCORS(tableHandler))
-	http.HandleFunc("/tables", withCORS(tableHandler))
-	http.HandleFunc("/columns/", withCORS(columnHandler))
-	http.HandleFunc("/columns", withCORS(columnHandler))
+	trashRetention = cfg.Trash.Retention
+	if cfg.Trash.PurgeInterval > 0 {
+		go purgeTrashPeriodically(cfg.Trash.PurgeInterval)
+	}
 
-	log.Println("Server is running on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{
+		Addr:         cfg.Server.Addr,
+		Handler:      newRouter(cfg.Server),
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+
+	log.Printf("Server is running on %s", cfg.Server.Addr)
+	log.Fatal(server.ListenAndServe())
 }
 
 // Enhanced record handler to work with any table
 func recordHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract table name from query parameter, default to "users"
-	tableName := r.URL.Query().Get("table")
-	if tableName == "" {
-		tableName = "users"
+	tableName := recordTableName(r)
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
 	}
 
 	// Check if table exists
-	tableExists, err := checkTableExists(tableName)
+	tableExists, err := store.TableExists(tableName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
 	if !tableExists {
-		http.Error(w, "Table not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
 		return
 	}
 
-	idStr := ""
-	if len(r.URL.Path) > len("/users/") {
-		idStr = r.URL.Path[len("/users/"):]
-	}
+	idStr := r.PathValue("id")
 
 	switch r.Method {
 	case http.MethodGet:
-		if idStr == "" || idStr == "/" {
-			// List all records from specified table
-			records, err := getTableData(tableName)
+		relations, err := parseRecordRelations(tableName, r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+			return
+		}
+
+		if idStr == "" {
+			// List records from specified table with optional pagination, sorting and filtering
+			columns, err := store.Columns(tableName)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			query, err := parseRecordQuery(r.URL.Query(), columns)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
 				return
 			}
-			json.NewEncoder(w).Encode(records)
+
+			records, total, err := store.ListRecords(tableName, query)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if err := relations.apply(records); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+
+			w.Header().Set("X-Total-Count", strconv.Itoa(total))
+			// Only an id ordering can be continued with after=
+			if query.Limit > 0 && len(records) == query.Limit && query.sortedByID() {
+				if lastID, ok := records[len(records)-1]["id"].(int64); ok {
+					w.Header().Set("X-Next-Cursor", strconv.FormatInt(lastID, 10))
+				}
+			}
+			writeJSON(w, http.StatusOK, records)
 			return
 		}
 
 		// Get record by id from specified table
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			http.Error(w, "Invalid record ID", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
 			return
 		}
 
-		record, err := getRecordFromTable(tableName, id)
-		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
+		record, err := store.GetRecord(tableName, id)
+		if err != nil {
+			writeStoreError(w, err)
 			return
-		} else if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		// Embedded records change without the record's version, so expanded reads
+		// aren't tagged
+		if len(relations.expand) == 0 && len(relations.include) == 0 {
+			etag := recordETag(record)
+			w.Header().Set("ETag", etag)
+			if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if err := relations.apply([]Record{record}); err != nil {
+			writeStoreError(w, err)
 			return
 		}
 
-		json.NewEncoder(w).Encode(record)
+		writeJSON(w, http.StatusOK, record)
 
 	case http.MethodPost:
-		if idStr != "" && idStr != "/" {
-			http.Error(w, "POST not allowed on specific record", http.StatusMethodNotAllowed)
+		if idStr != "" {
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST not allowed on specific record")
 			return
 		}
 
 		var recordData Record
 		if err := json.NewDecoder(r.Body).Decode(&recordData); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
 			return
 		}
 
-		newRecord, err := createRecordInTable(tableName, recordData)
+		newRecord, err := createRecordInTable(tableName, recordData, requestActor(r))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
-
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(newRecord)
+		w.Header().Set("ETag", recordETag(newRecord))
+		writeRecordResult(w, r, http.StatusCreated, http.StatusCreated, newRecord, preferReturnRepresentation)
 
 	case http.MethodPut:
-		if idStr == "" || idStr == "/" {
-			http.Error(w, "PUT requires record ID", http.StatusBadRequest)
+		if idStr == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "PUT requires record ID")
 			return
 		}
 
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			http.Error(w, "Invalid record ID", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
 			return
 		}
 
 		var recordData Record
 		if err := json.NewDecoder(r.Body).Decode(&recordData); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+			return
+		}
+
+		version, err := ifMatchVersion(r, tableName, id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		record, err := replaceRecordInTable(tableName, id, recordData, version, requestActor(r))
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", recordETag(record))
+		writeRecordResult(w, r, http.StatusOK, http.StatusNoContent, record, preferReturnRepresentation)
+
+	case http.MethodPatch:
+		if idStr == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "PATCH requires record ID")
 			return
 		}
 
-		err = updateRecordInTable(tableName, id, recordData)
+		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Could not read request body")
+			return
+		}
+
+		record, err := patchRecordInTable(tableName, id, r.Header.Get("If-Match"), r.Header.Get("Content-Type"), body, requestActor(r))
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", recordETag(record))
+		writeRecordResult(w, r, http.StatusOK, http.StatusNoContent, record, preferReturnRepresentation)
 
 	case http.MethodDelete:
-		if idStr == "" || idStr == "/" {
-			http.Error(w, "DELETE requires record ID", http.StatusBadRequest)
+		if idStr == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "DELETE requires record ID")
 			return
 		}
 		id, err := strconv.Atoi(idStr)
 		if err != nil {
-			http.Error(w, "Invalid record ID", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
 			return
 		}
 
-		err = deleteRecordFromTable(tableName, id)
+		version, err := ifMatchVersion(r, tableName, id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		record, err := deleteRecordFromTable(tableName, id, version, requestActor(r))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		writeRecordResult(w, r, http.StatusOK, http.StatusNoContent, record, preferReturnMinimal)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 	}
 }
 
 // Table handler for creating tables dynamically
 func tableHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract table name from URL path for DELETE operations
-	tableName := ""
-	if strings.HasPrefix(r.URL.Path, "/tables/") {
-		tableName = strings.TrimPrefix(r.URL.Path, "/tables/")
-	}
+	// Extract table name from URL path for DELETE and PATCH operations
+	tableName := r.PathValue("table")
 
 	switch r.Method {
 	case http.MethodPost:
@@ -199,48 +321,105 @@ func tableHandler(w http.ResponseWriter, r *http.Request) {
 			Name       string                 `json:"name"`
 			Columns    map[string]string      `json:"columns,omitempty"`    // Optional: column_name -> column_type
 			SampleData map[string]interface{} `json:"sampleData,omitempty"` // Optional: column_name -> sample_value
+			SchemaMode string                 `json:"schemaMode,omitempty"` // Optional: dynamic (default), strict or ignore
+			Timestamps bool                   `json:"timestamps,omitempty"` // Optional: add created_at, updated_at, created_by and updated_by
+			SoftDelete bool                   `json:"softDelete,omitempty"` // Optional: move deleted records to the trash
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&tableRequest); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
 			return
 		}
 
 		if tableRequest.Name == "" {
-			http.Error(w, "Table name is required", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Table name is required")
+			return
+		}
+		if err := validateTableName(tableRequest.Name); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
 			return
 		}
+		schemaMode := schemaModeDynamic
+		if tableRequest.SchemaMode != "" {
+			var err error
+			if schemaMode, err = normalizeSchemaMode(tableRequest.SchemaMode); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+		}
+
+		for colName, colType := range tableRequest.Columns {
+			if colName == "id" {
+				continue
+			}
+			if err := validateColumnName(sanitizeColumnName(colName)); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+				return
+			}
+			if _, err := normalizeColumnType(colType); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+		}
+		for colName := range tableRequest.SampleData {
+			if colName == "id" {
+				continue
+			}
+			if err := validateColumnName(sanitizeColumnName(colName)); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+				return
+			}
+		}
+		// The timestamp and deleted_at names are only taken when those features are asked for
+		var requested []string
+		for colName := range tableRequest.Columns {
+			requested = append(requested, sanitizeColumnName(colName))
+		}
+		for colName := range tableRequest.SampleData {
+			requested = append(requested, sanitizeColumnName(colName))
+		}
+		for _, colName := range systemColumns(requested, tableRequest.Timestamps, tableRequest.SoftDelete) {
+			if colName != versionColumn {
+				writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Column '%s' is maintained by the server on tables with timestamps or softDelete", colName))
+				return
+			}
+		}
 
 		// Check if table already exists
-		exists, err := checkTableExists(tableRequest.Name)
+		exists, err := store.TableExists(tableRequest.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
 
 		if exists {
-			http.Error(w, "Table already exists", http.StatusConflict)
+			writeError(w, http.StatusConflict, codeTableExists, "Table already exists")
 			return
 		}
 
-		// Create the table with optional columns or sample data
+		// Create the table with optional columns or sample data, and its settings
+		change := requestSchemaChange(r)
+		options := tableOptions{SchemaMode: schemaMode, Timestamps: tableRequest.Timestamps, SoftDelete: tableRequest.SoftDelete}
 		var err2 error
 		if len(tableRequest.Columns) > 0 {
-			err2 = createTableWithColumns(tableRequest.Name, tableRequest.Columns)
+			err2 = createTableWithColumns(tableRequest.Name, tableRequest.Columns, options, change)
 		} else if len(tableRequest.SampleData) > 0 {
-			err2 = createDynamicTable(tableRequest.Name, tableRequest.SampleData)
+			err2 = createDynamicTable(tableRequest.Name, tableRequest.SampleData, options, change)
 		} else {
-			err2 = createTable(tableRequest.Name)
+			err2 = createTable(tableRequest.Name, options, change)
 		}
 
 		if err2 != nil {
-			http.Error(w, err2.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err2)
 			return
 		}
 
 		response := map[string]interface{}{
-			"message": fmt.Sprintf("Table '%s' created successfully", tableRequest.Name),
-			"name":    tableRequest.Name,
+			"message":    fmt.Sprintf("Table '%s' created successfully", tableRequest.Name),
+			"name":       tableRequest.Name,
+			"schemaMode": schemaMode,
+			"timestamps": tableRequest.Timestamps,
+			"softDelete": tableRequest.SoftDelete,
 		}
 
 		if len(tableRequest.Columns) > 0 {
@@ -249,145 +428,321 @@ func tableHandler(w http.ResponseWriter, r *http.Request) {
 			response["columns"] = len(tableRequest.SampleData)
 		}
 
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(response)
+		writeJSON(w, http.StatusCreated, response)
 
 	case http.MethodGet:
-		tables, err := getAllTables()
+		tables, err := store.ListTables()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
-		json.NewEncoder(w).Encode(tables)
+		writeJSON(w, http.StatusOK, tables)
 
 	case http.MethodDelete:
 		if tableName == "" {
-			http.Error(w, "Table name is required for DELETE", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Table name is required for DELETE")
+			return
+		}
+
+		if err := validateTableName(tableName); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
 			return
 		}
 
 		// Prevent deletion of the default users table
 		if tableName == "users" {
-			http.Error(w, "Cannot delete the default 'users' table", http.StatusForbidden)
+			writeError(w, http.StatusForbidden, codeForbidden, "Cannot delete the default 'users' table")
 			return
 		}
 
 		// Check if table exists
-		exists, err := checkTableExists(tableName)
+		exists, err := store.TableExists(tableName)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
 
 		if !exists {
-			http.Error(w, "Table not found", http.StatusNotFound)
+			writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
 			return
 		}
 
-		// Drop the table
-		err = dropTable(tableName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Dropped tables go to the trash unless permanent=true
+		if r.URL.Query().Get("permanent") == "true" {
+			if err := dropTable(tableName, requestSchemaChange(r)); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{
+				"message": fmt.Sprintf("Table '%s' dropped successfully", tableName),
+				"name":    tableName,
+			})
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"message": fmt.Sprintf("Table '%s' dropped successfully", tableName),
-			"name":    tableName,
+		archived, err := archiveTable(tableName, requestSchemaChange(r))
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"message":    fmt.Sprintf("Table '%s' moved to trash", tableName),
+			"name":       tableName,
+			"archivedAs": archived.Name,
 		})
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-// Get all tables in the database
-func getAllTables() ([]string, error) {
-	query := `
-		SELECT table_name 
-		FROM information_schema.tables 
-		WHERE table_schema = 'public' AND table_type = 'BASE TABLE'
-		ORDER BY table_name`
+	case http.MethodPatch:
+		var patchRequest struct {
+			Name       string `json:"name"`
+			SchemaMode string `json:"schemaMode"`
+			Timestamps *bool  `json:"timestamps"`
+			SoftDelete *bool  `json:"softDelete"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patchRequest); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+			return
+		}
 
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+		if err := validateTableName(tableName); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+			return
+		}
+		if patchRequest.Name == "" && patchRequest.SchemaMode == "" && patchRequest.Timestamps == nil && patchRequest.SoftDelete == nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "A new table name, schema mode, timestamps or softDelete is required")
+			return
+		}
+		if patchRequest.Timestamps != nil && !*patchRequest.Timestamps {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Timestamp columns can't be removed once added")
+			return
+		}
+		if patchRequest.SoftDelete != nil && !*patchRequest.SoftDelete {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Soft delete can't be turned off once enabled")
+			return
+		}
+		renaming := patchRequest.Name != "" && patchRequest.Name != tableName
+		if renaming {
+			if err := validateTableName(patchRequest.Name); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+				return
+			}
+			// The default users table is recreated on startup, so it can't be renamed away
+			if tableName == "users" {
+				writeError(w, http.StatusForbidden, codeForbidden, "Cannot rename the default 'users' table")
+				return
+			}
+		}
+		var schemaMode string
+		if patchRequest.SchemaMode != "" {
+			var err error
+			if schemaMode, err = normalizeSchemaMode(patchRequest.SchemaMode); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+		}
 
-	var tables []string
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, err
+		exists, err := store.TableExists(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+			return
 		}
-		tables = append(tables, tableName)
-	}
 
-	return tables, nil
-}
+		change := requestSchemaChange(r)
+		currentName := tableName
+		response := map[string]interface{}{"name": tableName}
+		if renaming {
+			exists, err = store.TableExists(patchRequest.Name)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if exists {
+				writeError(w, http.StatusConflict, codeTableExists, "Table already exists")
+				return
+			}
 
-// Validation functions using regex patterns
-func validateRecordData(recordData Record) []string {
-	var errors []string
+			if err := renameTable(tableName, patchRequest.Name, change); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			fmt.Printf("Table '%s' renamed to '%s'\n", tableName, patchRequest.Name)
+			response["message"] = fmt.Sprintf("Table '%s' renamed to '%s'", tableName, patchRequest.Name)
+			response["name"] = patchRequest.Name
+			response["previousName"] = tableName
+			currentName = patchRequest.Name
+		}
 
-	// Validate email
-	if email, exists := recordData["email"]; exists {
-		if emailStr, ok := email.(string); ok {
-			if !emailPattern.MatchString(emailStr) {
-				errors = append(errors, "Invalid email format")
+		if schemaMode != "" {
+			if err := store.SetSchemaMode(currentName, schemaMode); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			fmt.Printf("Table '%s' schema mode set to '%s'\n", currentName, schemaMode)
+			if !renaming {
+				response["message"] = fmt.Sprintf("Table '%s' updated", tableName)
+			}
+		}
+		if patchRequest.Timestamps != nil {
+			added, err := addTimestampColumns(currentName, change)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if len(added) > 0 {
+				fmt.Printf("Table '%s' timestamp columns added: %s\n", currentName, strings.Join(added, ", "))
+			} else {
+				added = []string{}
+			}
+			if !renaming {
+				response["message"] = fmt.Sprintf("Table '%s' updated", tableName)
+			}
+			response["timestampsAdded"] = added
+		}
+		if patchRequest.SoftDelete != nil {
+			added, err := enableSoftDelete(currentName, change)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if added {
+				fmt.Printf("Table '%s' soft delete enabled\n", currentName)
 			}
+			if !renaming {
+				response["message"] = fmt.Sprintf("Table '%s' updated", tableName)
+			}
+			response["softDelete"] = true
+		}
+		if response["schemaMode"], err = store.SchemaMode(currentName); err != nil {
+			writeStoreError(w, err)
+			return
 		}
+
+		writeJSON(w, http.StatusOK, response)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 	}
-	return errors
 }
 
-func checkTableExists(tableName string) (bool, error) {
-	var exists bool
-	query := `
-        SELECT EXISTS (
-            SELECT 1 FROM information_schema.tables 
-            WHERE table_name = $1 AND table_schema = 'public'
-        )`
-	err := db.QueryRow(query, tableName).Scan(&exists)
-	return exists, err
+// tableCloneHandler copies a table's schema, and optionally its rows, into a new table.
+// filter[...] query parameters restrict which rows are copied.
+func tableCloneHandler(w http.ResponseWriter, r *http.Request) {
+	tableName := r.PathValue("table")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	var cloneRequest struct {
+		Name     string `json:"name"`
+		WithData bool   `json:"withData"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cloneRequest); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+		return
+	}
+	if cloneRequest.Name == "" {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Table name is required")
+		return
+	}
+	if err := validateTableName(cloneRequest.Name); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return
+	}
+	exists, err = store.TableExists(cloneRequest.Name)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if exists {
+		writeError(w, http.StatusConflict, codeTableExists, "Table already exists")
+		return
+	}
+
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	query, err := parseRecordQuery(r.URL.Query(), columns)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	if len(query.Filters) > 0 && !cloneRequest.WithData {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Filters require withData")
+		return
+	}
+
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	copied, err := store.CloneTable(tableName, cloneRequest.Name, cloneRequest.WithData, recordQuery{Filters: query.Filters})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	fmt.Printf("Table '%s' cloned to '%s' with %d rows\n", tableName, cloneRequest.Name, copied)
+	recordMigration(requestSchemaChange(r), cloneRequest.Name, migrationCloneTable,
+		cloneTableStatements(schema, cloneRequest.Name), []string{dropTableStatement(cloneRequest.Name)})
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":  fmt.Sprintf("Table '%s' cloned to '%s'", tableName, cloneRequest.Name),
+		"name":     cloneRequest.Name,
+		"source":   tableName,
+		"withData": cloneRequest.WithData,
+		"rows":     copied,
+	})
 }
 
-func createTable(tableName string) error {
-	return createDynamicTable(tableName, nil)
+func createTable(tableName string, options tableOptions, change schemaChange) error {
+	return createDynamicTable(tableName, nil, options, change)
 }
 
 // createDynamicTable creates a table with optional predefined columns
-func createDynamicTable(tableName string, columns map[string]interface{}) error {
-	var columnDefs []string
+func createDynamicTable(tableName string, columns map[string]interface{}, options tableOptions, change schemaChange) error {
+	if err := validateTableName(tableName); err != nil {
+		return err
+	}
 
-	// Always add id column first
-	columnDefs = append(columnDefs, "id SERIAL PRIMARY KEY")
+	var columnDefs []columnDef
 
 	// Add predefined columns if provided
-	if len(columns) > 0 {
-		for colName, sampleValue := range columns {
-			if colName == "id" {
-				continue
-			}
-
-			// Sanitize column name
-			safeColName := strings.ToLower(strings.ReplaceAll(colName, " ", "_"))
-			safeColName = regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(safeColName, "_")
+	for colName, sampleValue := range columns {
+		if colName == "id" || sanitizeColumnName(colName) == versionColumn {
+			continue
+		}
 
-			// Determine column type
-			columnType := determineColumnType(safeColName, sampleValue)
-			columnDefs = append(columnDefs, fmt.Sprintf("%s %s", safeColName, columnType))
+		// Sanitize column name
+		safeColName := sanitizeColumnName(colName)
+		if err := validateColumnName(safeColName); err != nil {
+			return err
 		}
-	}
 
-	query := fmt.Sprintf("CREATE TABLE %s (%s)", tableName, strings.Join(columnDefs, ", "))
+		// Determine column type
+		columnType := determineColumnType(safeColName, sampleValue)
+		columnDefs = append(columnDefs, columnDef{Name: safeColName, Type: columnType})
+	}
 
-	_, err := db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+	if err := store.CreateTable(tableName, columnDefs, options); err != nil {
+		return err
 	}
+	recordTableCreation(tableName, columnDefs, options, change)
 
 	if len(columns) > 0 {
 		fmt.Printf("Table '%s' created successfully with %d predefined columns\n", tableName, len(columns))
@@ -397,126 +752,96 @@ func createDynamicTable(tableName string, columns map[string]interface{}) error
 	return nil
 }
 
-// determineColumnType determines the PostgreSQL column type based on sample value
-func determineColumnType(columnName string, sampleValue interface{}) string {
-	// Check column name patterns first
-	columnLower := strings.ToLower(columnName)
-
-	if strings.Contains(columnLower, "email") || strings.Contains(columnLower, "mail") {
-		return "VARCHAR(255)"
-	}
-	if strings.Contains(columnLower, "phone") || strings.Contains(columnLower, "tel") {
-		return "VARCHAR(20)"
-	}
-	if strings.Contains(columnLower, "url") || strings.Contains(columnLower, "website") {
-		return "TEXT"
-	}
-	if strings.Contains(columnLower, "age") {
-		return "INTEGER"
-	}
-	if strings.Contains(columnLower, "salary") || strings.Contains(columnLower, "price") || strings.Contains(columnLower, "amount") {
-		return "DECIMAL(12,2)"
-	}
-
-	// Check sample value type
-	switch v := sampleValue.(type) {
-	case string:
-		if emailPattern.MatchString(v) {
-			return "VARCHAR(255)"
-		} else if len(v) > 255 {
-			return "TEXT"
-		} else {
-			return "VARCHAR(255)"
-		}
-	case int, int64:
-		return "INTEGER"
-	case float64:
-		return "DECIMAL(10,2)"
-	case bool:
-		return "BOOLEAN"
-	default:
-		return "TEXT" // Default fallback
-	}
-}
-
 // createTableWithColumns creates a table with specified columns
-func createTableWithColumns(tableName string, columns map[string]string) error {
+func createTableWithColumns(tableName string, columns map[string]string, options tableOptions, change schemaChange) error {
 	if len(columns) == 0 {
 		// If no columns specified, create with default structure
-		return createTable(tableName)
+		return createTable(tableName, options, change)
 	}
 
-	var columnDefs []string
+	if err := validateTableName(tableName); err != nil {
+		return err
+	}
 
-	// Always add id column first
-	columnDefs = append(columnDefs, "id SERIAL PRIMARY KEY")
+	var columnDefs []columnDef
 
 	// Add custom columns
 	for colName, colType := range columns {
-		if colName == "id" {
+		if colName == "id" || sanitizeColumnName(colName) == versionColumn {
 			continue
 		}
 
-		safeColName := strings.ToLower(strings.ReplaceAll(colName, " ", "_"))
-		safeColName = regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(safeColName, "_")
+		safeColName := sanitizeColumnName(colName)
+		if err := validateColumnName(safeColName); err != nil {
+			return err
+		}
+
+		safeColType, err := normalizeColumnType(colType)
+		if err != nil {
+			return err
+		}
 
-		columnDefs = append(columnDefs, fmt.Sprintf("%s %s", safeColName, colType))
+		columnDefs = append(columnDefs, columnDef{Name: safeColName, Type: safeColType})
 	}
 
-	query := fmt.Sprintf("CREATE TABLE %s (%s)", tableName, strings.Join(columnDefs, ", "))
-
-	_, err := db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("failed to create table with columns: %w", err)
+	if err := store.CreateTable(tableName, columnDefs, options); err != nil {
+		return err
 	}
+	recordTableCreation(tableName, columnDefs, options, change)
 
 	fmt.Printf("Table '%s' created successfully with %d custom columns\n", tableName, len(columns))
 	return nil
 }
 
-func dropTable(tableName string) error {
-	// Prevent dropping the default users table
-	if tableName == "users" {
-		return fmt.Errorf("cannot drop the default 'users' table")
-	}
+// recordTableCreation adds a created table to the migration log
+func recordTableCreation(tableName string, columns []columnDef, options tableOptions, change schemaChange) {
+	recordMigration(change, tableName, migrationCreateTable,
+		createTableStatements(tableName, columns, options), []string{dropTableStatement(tableName)})
+}
 
-	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName)
-	_, err := db.Exec(query)
+// renameTable renames a table and records the change
+func renameTable(tableName, newName string, change schemaChange) error {
+	schema, err := store.TableSchema(tableName)
 	if err != nil {
-		return fmt.Errorf("failed to drop table: %w", err)
+		return err
 	}
-
-	fmt.Printf("Table '%s' dropped successfully\n", tableName)
+	if err := store.RenameTable(tableName, newName); err != nil {
+		return err
+	}
+	indexes := indexNames(schema)
+	recordMigration(change, newName, migrationRenameTable, renameTableStatements(tableName, newName, indexes),
+		renameTableStatements(newName, tableName, renamedIndexes(indexes, tableName, newName)))
 	return nil
 }
 
-func getTableColumns(tableName string) ([]string, error) {
-	query := `
-        SELECT column_name
-        FROM information_schema.columns
-        WHERE table_name = $1
-        ORDER BY ordinal_position`
+// dropTable drops a table for good. The migration log gets its definition, as it was
+// just before, to recreate it with.
+func dropTable(tableName string, change schemaChange) error {
+	// Prevent dropping the default users table
+	if tableName == "users" {
+		return fmt.Errorf("cannot drop the default 'users' table")
+	}
 
-	rows, err := db.Query(query, tableName)
-	if err != nil {
-		return nil, err
+	if err := validateTableName(tableName); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var columns []string
-	for rows.Next() {
-		var column string
-		if err := rows.Scan(&column); err != nil {
-			return nil, err
-		}
-		columns = append(columns, column)
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		return err
+	}
+	if err := store.DropTable(tableName); err != nil {
+		return err
 	}
-	return columns, nil
+	recordMigration(change, tableName, migrationDropTable, []string{dropTableStatement(tableName)}, tableStatements(schema))
+
+	fmt.Printf("Table '%s' dropped successfully\n", tableName)
+	return nil
 }
 
 // addColumnToTable dynamically adds a new column to an existing table
-func addColumnToTable(tableName, columnName string, sampleValue interface{}) error {
-	actualColumnName, err := addColumnToTableWithReturn(tableName, columnName, sampleValue)
+func addColumnToTable(tableName, columnName string, sampleValue interface{}, change schemaChange) error {
+	actualColumnName, err := addColumnToTableWithReturn(tableName, columnName, sampleValue, change)
 	if err != nil {
 		return err
 	}
@@ -525,212 +850,266 @@ func addColumnToTable(tableName, columnName string, sampleValue interface{}) err
 }
 
 // addColumnToTableWithReturn dynamically adds a new column and returns the actual column name created
-func addColumnToTableWithReturn(tableName, columnName string, sampleValue interface{}) (string, error) {
-	safeColumnName := strings.ToLower(strings.ReplaceAll(columnName, " ", "_"))
-	safeColumnName = regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(safeColumnName, "_")
+func addColumnToTableWithReturn(tableName, columnName string, sampleValue interface{}, change schemaChange) (string, error) {
+	safeColumnName := sanitizeColumnName(columnName)
+	if err := validateColumnName(safeColumnName); err != nil {
+		return "", err
+	}
 
 	columnType := determineColumnType(safeColumnName, sampleValue)
-
-	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, safeColumnName, columnType)
-	_, err := db.Exec(query)
-	if err != nil {
-		return "", fmt.Errorf("failed to add column %s to table %s: %w", safeColumnName, tableName, err)
+	if err := store.AddColumn(tableName, safeColumnName, columnType, nil); err != nil {
+		return "", err
 	}
-
+	recordMigration(change, tableName, migrationAddColumn,
+		[]string{addColumnStatement(tableName, safeColumnName, columnType)}, []string{dropColumnStatement(tableName, safeColumnName)})
 	return safeColumnName, nil
 }
 
-func getTableData(tableName string) ([]Record, error) {
-	columns, err := getTableColumns(tableName)
+// sanitizeColumnName converts a client-supplied key into the column name used in the table
+func sanitizeColumnName(columnName string) string {
+	safeColumnName := strings.ToLower(strings.ReplaceAll(columnName, " ", "_"))
+	return regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(safeColumnName, "_")
+}
+
+func createRecordInTable(tableName string, recordData Record, actor string) (Record, error) {
+	columns, err := store.Columns(tableName)
 	if err != nil {
 		return nil, err
 	}
-
-	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY id", strings.Join(columns, ", "), tableName)
-	rows, err := db.Query(query)
+	system, err := store.SystemColumns(tableName)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var records []Record
-	for rows.Next() {
-		values := make([]interface{}, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-		for i := range values {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			return nil, err
-		}
-
-		record := make(Record)
-		for i, col := range columns {
-			if values[i] != nil {
-				record[col] = values[i]
-			}
-		}
-		records = append(records, record)
-	}
-	return records, nil
-}
-
-func getRecordFromTable(tableName string, id int) (Record, error) {
-	columns, err := getTableColumns(tableName)
+	stripSystemFields(recordData, system)
+	mode, err := store.SchemaMode(tableName)
 	if err != nil {
 		return nil, err
 	}
-
-	query := fmt.Sprintf("SELECT %s FROM %s WHERE id=$1", strings.Join(columns, ", "), tableName)
-	values := make([]interface{}, len(columns))
-	valuePtrs := make([]interface{}, len(columns))
-	for i := range values {
-		valuePtrs[i] = &values[i]
+	if fieldErrors := applySchemaMode(mode, columns, recordData); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
 	}
 
-	err = db.QueryRow(query, id).Scan(valuePtrs...)
+	metadata, err := store.ColumnMetadata(tableName)
 	if err != nil {
 		return nil, err
 	}
+	applyColumnDefaults(metadata, recordData)
 
-	record := make(Record)
-	for i, col := range columns {
-		if values[i] != nil {
-			record[col] = values[i]
-		}
+	if fieldErrors := validateRecord(tableName, metadata, recordData, true, 0); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
 	}
-	return record, nil
-}
+	addRecordColumns(tableName, columns, recordData, actor)
+	stampRecord(recordData, system, actor, true)
 
-func createRecordInTable(tableName string, recordData Record) (Record, error) {
-	if errors := validateRecordData(recordData); len(errors) > 0 {
-		return nil, fmt.Errorf("validation failed: %s", strings.Join(errors, "; "))
+	newID, err := store.InsertRecord(tableName, recordData)
+	if err != nil {
+		return nil, err
 	}
-
-	columns, err := getTableColumns(tableName)
+	record, err := store.GetRecord(tableName, newID)
 	if err != nil {
 		return nil, err
 	}
+	auditRecordChange(tableName, int64(newID), auditCreate, nil, record, actor)
+	return record, nil
+}
 
+// addRecordColumns adds a column for every field of recordData the table doesn't have yet
+// and moves each field under its sanitized column name
+func addRecordColumns(tableName string, columns []string, recordData Record, actor string) {
 	for col := range recordData {
 		if col == "id" {
 			continue
 		}
 
-		columnExists := false
-		for _, existingCol := range columns {
-			if existingCol == col {
-				columnExists = true
-				break
-			}
-		}
-
-		if !columnExists {
-			err = addColumnToTable(tableName, col, recordData[col])
+		// Keys are stored under their sanitized column name
+		safeCol := sanitizeColumnName(col)
+		if !containsString(columns, safeCol) {
+			change := schemaChange{Actor: actor, Reason: fmt.Sprintf("new field '%s' in a record", col)}
+			err := addColumnToTable(tableName, col, recordData[col], change)
 			if err != nil {
 				log.Printf("Warning: Failed to add column %s to table %s: %v", col, tableName, err)
 				continue
 			}
-			columns = append(columns, col)
-			log.Printf("Added new column '%s' to table '%s'", col, tableName)
+			columns = append(columns, safeCol)
+			log.Printf("Added new column '%s' to table '%s'", safeCol, tableName)
+		}
+		if safeCol != col {
+			recordData[safeCol] = recordData[col]
+			delete(recordData, col)
 		}
 	}
+}
 
-	// Filter out id column for insert
-	var insertColumns []string
-	var values []interface{}
-	var placeholders []string
-	placeholderIndex := 1
+// updateRecordInTable changes only the fields present in recordData; a null value sets
+// the column to NULL. A non-zero version makes the update conditional.
+func updateRecordInTable(tableName string, id int, recordData Record, version int64, actor string) (Record, error) {
+	return updateRecordAs(auditUpdate, tableName, id, recordData, version, actor)
+}
 
-	for _, col := range columns {
-		if col == "id" {
-			continue
-		}
-		if value, exists := recordData[col]; exists {
-			insertColumns = append(insertColumns, col)
-			values = append(values, value)
-			placeholders = append(placeholders, fmt.Sprintf("$%d", placeholderIndex))
-			placeholderIndex++
-		}
+// updateRecordAs is updateRecordInTable recording the change as the given operation
+func updateRecordAs(operation, tableName string, id int, recordData Record, version int64, actor string) (Record, error) {
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(insertColumns) == 0 {
-		return nil, fmt.Errorf("no valid fields provided")
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	stripSystemFields(recordData, system)
+	mode, err := store.SchemaMode(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if fieldErrors := applySchemaMode(mode, columns, recordData); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
 	}
 
-	query := fmt.Sprintf(
-		"INSERT INTO %s(%s) VALUES(%s) RETURNING id",
-		tableName,
-		strings.Join(insertColumns, ", "),
-		strings.Join(placeholders, ", "),
-	)
-
-	var newID int
-	err = db.QueryRow(query, values...).Scan(&newID)
+	metadata, err := store.ColumnMetadata(tableName)
 	if err != nil {
 		return nil, err
 	}
+	if fieldErrors := validateRecord(tableName, metadata, recordData, false, id); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
+	}
+	addRecordColumns(tableName, columns, recordData, actor)
+	stampRecord(recordData, system, actor, false)
 
-	recordData["id"] = newID
-	return recordData, nil
+	return auditedUpdate(operation, tableName, id, recordData, version, actor)
 }
 
-func updateRecordInTable(tableName string, id int, recordData Record) error {
-	columns, err := getTableColumns(tableName)
+// replaceRecordInTable replaces the whole record: columns missing from recordData get
+// their catalog default, or NULL when there is none
+func replaceRecordInTable(tableName string, id int, recordData Record, version int64, actor string) (Record, error) {
+	columns, err := store.Columns(tableName)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	stripSystemFields(recordData, system)
+	mode, err := store.SchemaMode(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if fieldErrors := applySchemaMode(mode, columns, recordData); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
 	}
 
-	var setClauses []string
-	var values []interface{}
-	placeholderIndex := 1
-
+	metadata, err := store.ColumnMetadata(tableName)
+	if err != nil {
+		return nil, err
+	}
+	defaults := make(map[string]*string, len(metadata))
+	for _, meta := range metadata {
+		defaults[meta.Key] = meta.DefaultValue
+	}
+	present := make(map[string]bool, len(recordData))
+	for key := range recordData {
+		present[sanitizeColumnName(key)] = true
+	}
 	for _, col := range columns {
-		if col == "id" {
+		if col == "id" || isSystemColumn(col, system) || present[col] {
 			continue
 		}
-		if value, exists := recordData[col]; exists {
-			setClauses = append(setClauses, fmt.Sprintf("%s=$%d", col, placeholderIndex))
-			values = append(values, value)
-			placeholderIndex++
+		if defaultValue := defaults[col]; defaultValue != nil {
+			recordData[col] = *defaultValue
+		} else {
+			recordData[col] = nil
 		}
 	}
 
-	if len(setClauses) == 0 {
-		return fmt.Errorf("no valid fields to update")
+	if fieldErrors := validateRecord(tableName, metadata, recordData, true, id); len(fieldErrors) > 0 {
+		return nil, &ValidationError{Errors: fieldErrors}
+	}
+	addRecordColumns(tableName, columns, recordData, actor)
+	stampRecord(recordData, system, actor, false)
+
+	return auditedUpdate(auditUpdate, tableName, id, recordData, version, actor)
+}
+
+// auditedUpdate updates a record and records the change in the audit log
+func auditedUpdate(operation, tableName string, id int, recordData Record, version int64, actor string) (Record, error) {
+	before, err := store.GetRecord(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	record, err := store.UpdateRecord(tableName, id, recordData, version)
+	if err != nil {
+		return nil, err
 	}
+	auditRecordChange(tableName, int64(id), operation, before, record, actor)
+	return record, nil
+}
 
-	values = append(values, id)
-	query := fmt.Sprintf(
-		"UPDATE %s SET %s WHERE id=$%d",
-		tableName,
-		strings.Join(setClauses, ", "),
-		placeholderIndex,
-	)
+// patchRecordInTable applies a JSON Merge Patch or JSON Patch body to a record and
+// returns the record as stored afterwards. With ifMatch the record must still have the
+// ETag the patch was made against.
+func patchRecordInTable(tableName string, id int, ifMatch, contentType string, body []byte, actor string) (Record, error) {
+	current, err := store.GetRecord(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	version, err := checkIfMatch(ifMatch, current)
+	if err != nil {
+		return nil, err
+	}
+	original, err := recordDocument(current)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := patchRecord(original, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := patchChanges(original, patched, system)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = db.Exec(query, values...)
-	return err
+	if len(changes) == 0 {
+		return current, nil
+	}
+	return updateRecordInTable(tableName, id, changes, version, actor)
 }
 
-func deleteRecordFromTable(tableName string, id int) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id=$1", tableName)
-	_, err := db.Exec(query, id)
-	return err
+// deleteRecordFromTable deletes a record, or moves it to the trash when the table soft
+// deletes, and returns the deleted row
+func deleteRecordFromTable(tableName string, id int, version int64, actor string) (Record, error) {
+	before, err := store.GetRecord(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := store.DeleteRecord(tableName, id, version)
+	if err != nil {
+		return nil, err
+	}
+	var after Record
+	if deleted[deletedAtColumn] != nil {
+		after = deleted
+	}
+	auditRecordChange(tableName, int64(id), auditDelete, before, after, actor)
+	return deleted, nil
 }
 
 func initializeDefaultTables() {
 	tables := []string{"users"}
 
 	for _, tableName := range tables {
-		exists, err := checkTableExists(tableName)
+		exists, err := store.TableExists(tableName)
 		if err != nil {
 			log.Printf("Error checking if table %s exists: %v", tableName, err)
 			continue
 		}
 
 		if !exists {
-			err := createTable(tableName)
+			err := createTable(tableName, tableOptions{}, schemaChange{Reason: "default table"})
 			if err != nil {
 				log.Printf("Error creating table %s: %v", tableName, err)
 			}
@@ -741,111 +1120,369 @@ func initializeDefaultTables() {
 func columnHandler(w http.ResponseWriter, r *http.Request) {
 	tableName := r.URL.Query().Get("table")
 	if tableName == "" {
-		http.Error(w, "Table name is required", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "Table name is required")
+		return
+	}
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
 		return
 	}
 
 	// Check if table exists
-	tableExists, err := checkTableExists(tableName)
+	tableExists, err := store.TableExists(tableName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
 	if !tableExists {
-		http.Error(w, "Table not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
 		return
 	}
 
 	switch r.Method {
 	case http.MethodPost:
 		var columnData struct {
-			Key          string `json:"key"`
-			Label        string `json:"label"`
-			Type         string `json:"type"`
-			Required     bool   `json:"required"`
-			DefaultValue string `json:"defaultValue"`
+			Key          string      `json:"key"`
+			Label        string      `json:"label"`
+			Type         string      `json:"type"`
+			Required     bool        `json:"required"`
+			DefaultValue *string     `json:"defaultValue"`
+			Position     *int        `json:"position"`
+			Description  string      `json:"description"`
+			Rules        ColumnRules `json:"rules"`
+			Link         *ColumnLink `json:"link"`
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&columnData); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
 			return
 		}
 
 		if columnData.Key == "" {
-			http.Error(w, "Column key is required", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Column key is required")
+			return
+		}
+
+		if err := validateColumnName(sanitizeColumnName(columnData.Key)); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+			return
+		}
+
+		if columnExists(tableName, sanitizeColumnName(columnData.Key)) {
+			writeError(w, http.StatusConflict, codeColumnExists, "Column already exists")
+			return
+		}
+
+		semanticType, err := normalizeSemanticType(columnData.Type)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+
+		if columnData.DefaultValue != nil && *columnData.DefaultValue == "" {
+			columnData.DefaultValue = nil
+		}
+		if err := checkColumnRules(columnData.Rules); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 
-		if columnExists(tableName, columnData.Key) {
-			http.Error(w, "Column already exists", http.StatusConflict)
+		if semanticType == semanticLink {
+			if columnData.Link == nil || columnData.Link.Table == "" {
+				writeError(w, http.StatusBadRequest, codeBadRequest, "Link columns require link.table")
+				return
+			}
+			if err := validateTableName(columnData.Link.Table); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+				return
+			}
+			linkedExists, err := store.TableExists(columnData.Link.Table)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			if !linkedExists {
+				writeError(w, http.StatusBadRequest, codeTableNotFound, fmt.Sprintf("Linked table '%s' does not exist", columnData.Link.Table))
+				return
+			}
+			if columnData.Link.OnDelete, err = normalizeForeignKeyAction(columnData.Link.OnDelete); err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+		} else if columnData.Link != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "link is only allowed on link columns")
+			return
+		}
+
+		meta := ColumnMetadata{
+			Key:          sanitizeColumnName(columnData.Key),
+			Label:        columnData.Label,
+			Type:         semanticType,
+			Required:     columnData.Required,
+			DefaultValue: columnData.DefaultValue,
+			Description:  columnData.Description,
+			Rules:        columnData.Rules,
+			Editable:     true,
+			Link:         columnData.Link,
+		}
+		if meta.Label == "" {
+			meta.Label = defaultColumnLabel(meta.Key)
+		}
+		if columnData.DefaultValue != nil {
+			if fieldErrors := validateValue(meta, *columnData.DefaultValue); len(fieldErrors) > 0 {
+				writeValidationError(w, &ValidationError{Errors: fieldErrors})
+				return
+			}
+		}
+
+		position := 0
+		if columnData.Position != nil {
+			position = *columnData.Position
+		} else if position, err = nextColumnPosition(tableName); err != nil {
+			writeStoreError(w, err)
 			return
 		}
 
-		// Add column to table
-		actualColumnName, err := addColumnToTableWithReturn(tableName, columnData.Key, columnData.DefaultValue)
+		// Infer the storage type from the key unless the client picked a semantic type
+		columnType := determineColumnType(sanitizeColumnName(columnData.Key), "")
+		if columnData.Type != "" {
+			columnType = columnTypeForSemanticType(semanticType)
+		}
+
+		columnType, err = normalizeColumnType(columnType)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error adding column: %v", err), http.StatusInternalServerError)
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		// Add column to table and record its metadata in the same transaction
+		actualColumnName := meta.Key
+		meta.Position = position
+		if err := store.AddColumn(tableName, actualColumnName, columnType, &meta); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		up := []string{addColumnStatement(tableName, actualColumnName, columnType)}
+		if meta.Link != nil {
+			up = append(up, foreignKeyStatement(tableName, actualColumnName, *meta.Link), columnIndexStatement(tableName, actualColumnName))
+		}
+		recordMigration(requestSchemaChange(r), tableName, migrationAddColumn, up, []string{dropColumnStatement(tableName, actualColumnName)})
+
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
 			"message":          "Column added successfully",
 			"actualColumnName": actualColumnName,
+			"column":           meta,
+		})
+
+	case http.MethodPut, http.MethodPatch:
+		var columnData struct {
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			SQLType string `json:"sqlType"`
+			DryRun  bool   `json:"dryRun"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&columnData); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON")
+			return
+		}
+		dryRun := columnData.DryRun || r.URL.Query().Get("dryRun") == "true"
+
+		columnKey := r.URL.Query().Get("column")
+		if columnKey == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Column key is required")
+			return
+		}
+		if columnKey == "id" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Cannot modify ID column")
+			return
+		}
+		if err := validateColumnName(columnKey); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+			return
+		}
+		if !columnExists(tableName, columnKey) {
+			writeError(w, http.StatusNotFound, codeColumnNotFound, "Column not found")
+			return
+		}
+		system, err := store.SystemColumns(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if isSystemColumn(columnKey, system) {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Cannot modify system column '%s'", columnKey))
+			return
+		}
+
+		var change columnChange
+		if columnData.Name != "" {
+			change.NewName = sanitizeColumnName(columnData.Name)
+			if err := validateColumnName(change.NewName); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+				return
+			}
+			if change.NewName != columnKey && columnExists(tableName, change.NewName) {
+				writeError(w, http.StatusConflict, codeColumnExists, "Column already exists")
+				return
+			}
+		}
+
+		// A semantic type updates the catalog and implies its storage type unless an
+		// explicit sqlType is given
+		if columnData.Type != "" {
+			semanticType, err := normalizeSemanticType(columnData.Type)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+			metadata, err := store.ColumnMetadata(tableName)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			for _, meta := range metadata {
+				if meta.Key == columnKey {
+					meta.Type = semanticType
+					change.Meta = &meta
+				}
+			}
+			change.NewType = columnTypeForSemanticType(semanticType)
+		}
+		if columnData.SQLType != "" {
+			change.NewType = columnData.SQLType
+		}
+		if change.NewType != "" {
+			columnType, err := normalizeColumnType(change.NewType)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+			change.NewType = columnType
+		}
+
+		if change.NewName == "" && change.NewType == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Nothing to change: provide name, type or sqlType")
+			return
+		}
+
+		schema, err := store.TableSchema(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		previous, _ := schemaColumn(schema, columnKey)
+
+		report, err := store.AlterColumn(tableName, columnKey, change, dryRun)
+		if errors.Is(err, errConversionFailed) {
+			writeErrorDetails(w, http.StatusUnprocessableEntity, codeConversionFailed,
+				fmt.Sprintf("%d of %d values in '%s' cannot be converted to %s", report.Failed, report.Rows, columnKey, change.NewType), report)
+			return
+		} else if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		if dryRun {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"dryRun":      true,
+				"column":      columnKey,
+				"newName":     change.NewName,
+				"newType":     change.NewType,
+				"convertible": report.Failed == 0,
+				"conversion":  report,
+			})
+			return
+		}
+
+		up, down := alterColumnStatements(tableName, previous, change)
+		recordMigration(requestSchemaChange(r), tableName, migrationAlterColumn, up, down)
+
+		finalName := columnKey
+		if change.NewName != "" {
+			finalName = change.NewName
+		}
+		metadata, err := store.ColumnMetadata(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		var column ColumnMetadata
+		for _, meta := range metadata {
+			if meta.Key == finalName {
+				column = meta
+			}
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "Column updated successfully",
+			"column":     column,
+			"conversion": report,
 		})
 
 	case http.MethodDelete:
 		columnKey := r.URL.Query().Get("column")
 		if columnKey == "" {
-			http.Error(w, "Column key is required", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Column key is required")
 			return
 		}
 
 		if columnKey == "id" {
-			http.Error(w, "Cannot delete ID column", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, codeBadRequest, "Cannot delete ID column")
+			return
+		}
+		if err := validateColumnName(columnKey); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
 			return
 		}
 
 		if !columnExists(tableName, columnKey) {
-			http.Error(w, "Column not found", http.StatusNotFound)
+			writeError(w, http.StatusNotFound, codeColumnNotFound, "Column not found")
+			return
+		}
+		system, err := store.SystemColumns(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if isSystemColumn(columnKey, system) {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Cannot delete system column '%s'", columnKey))
 			return
 		}
 
-		query := fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, columnKey)
-		_, err = db.Exec(query)
+		schema, err := store.TableSchema(tableName)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error removing column: %v", err), http.StatusInternalServerError)
+			writeStoreError(w, err)
+			return
+		}
+		column, _ := schemaColumn(schema, columnKey)
+		if err := store.DropColumn(tableName, columnKey); err != nil {
+			writeStoreError(w, err)
 			return
 		}
+		up, down := dropColumnStatements(tableName, schema, column)
+		recordMigration(requestSchemaChange(r), tableName, migrationDropColumn, up, down)
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"message": "Column removed successfully"})
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Column removed successfully"})
 
 	case http.MethodGet:
-		columns, err := getTableColumns(tableName)
+		columns, err := store.ColumnMetadata(tableName)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get columns: %v", err), http.StatusInternalServerError)
+			writeStoreError(w, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(columns)
+		writeJSON(w, http.StatusOK, columns)
 
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 	}
 }
 
 // Helper function to check if a column exists in a table
 func columnExists(tableName, columnName string) bool {
-	query := `
-		SELECT COUNT(*) 
-		FROM information_schema.columns 
-		WHERE table_name = $1 AND column_name = $2
-	`
-	var count int
-	err := db.QueryRow(query, tableName, columnName).Scan(&count)
+	columns, err := store.Columns(tableName)
 	if err != nil {
 		return false
 	}
-	return count > 0
+	return containsString(columns, columnName)
 }
@@ -0,0 +1,1394 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer installs a fresh in-memory store with the default tables and returns the router
+func newTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	store = newMemoryStore()
+	initializeDefaultTables()
+	return newRouter(ServerConfig{CORSOrigins: []string{"*"}})
+}
+
+func doRequest(t *testing.T, h http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, target interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), target); err != nil {
+		t.Fatalf("decode body %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestTableLifecycle(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name":    "products",
+		"columns": map[string]string{"title": "VARCHAR(100)", "price": "decimal(10,2)"},
+	})
+	expectStatus(t, rec, http.StatusCreated)
+
+	rec = doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "products"})
+	expectStatus(t, rec, http.StatusConflict)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var tables []string
+	decodeBody(t, rec, &tables)
+	if !containsString(tables, "products") || !containsString(tables, "users") {
+		t.Fatalf("expected users and products in %v", tables)
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/tables/products", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if exists, _ := store.TableExists("products"); exists {
+		t.Fatal("products still exists after drop")
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/tables/users", nil)
+	expectStatus(t, rec, http.StatusForbidden)
+}
+
+func TestTableRejectsInvalidIdentifiers(t *testing.T) {
+	h := newTestServer(t)
+
+	cases := []map[string]interface{}{
+		{"name": "Robert'); DROP TABLE users;--"},
+		{"name": "select"},
+		{"name": "widgets", "columns": map[string]string{"name": "TEXT; DROP TABLE users"}},
+	}
+	for _, body := range cases {
+		rec := doRequest(t, h, http.MethodPost, "/tables", body)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestColumnLifecycle(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := doRequest(t, h, http.MethodPost, "/columns?table=users", map[string]interface{}{
+		"key":      "contact_email",
+		"label":    "Contact email",
+		"type":     "email",
+		"required": true,
+	})
+	expectStatus(t, rec, http.StatusCreated)
+
+	rec = doRequest(t, h, http.MethodPost, "/columns?table=users", map[string]interface{}{"key": "contact_email"})
+	expectStatus(t, rec, http.StatusConflict)
+
+	rec = doRequest(t, h, http.MethodGet, "/columns?table=users", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var columns []ColumnMetadata
+	decodeBody(t, rec, &columns)
+	if len(columns) != 3 {
+		t.Fatalf("expected id, %s and contact_email, got %+v", versionColumn, columns)
+	}
+	if meta := columns[2]; meta.Key != "contact_email" || meta.Type != semanticEmail || !meta.Required || meta.Label != "Contact email" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/columns?table=users&column=contact_email", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodDelete, "/columns?table=users&column=contact_email", nil)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = doRequest(t, h, http.MethodDelete, "/columns?table=users&column=id", nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestRecordCRUD(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "Ada", "age": 36})
+	expectStatus(t, rec, http.StatusCreated)
+	var created Record
+	decodeBody(t, rec, &created)
+	if created["id"] != float64(1) {
+		t.Fatalf("expected id 1, got %v", created["id"])
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records/1", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var fetched Record
+	decodeBody(t, rec, &fetched)
+	if fetched["name"] != "Ada" || fetched["age"] != float64(36) {
+		t.Fatalf("unexpected record %v", fetched)
+	}
+
+	rec = doRequest(t, h, http.MethodPut, "/records/1?table=users", map[string]interface{}{"age": 37})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodGet, "/records/users/1", nil)
+	expectStatus(t, rec, http.StatusOK)
+	decodeBody(t, rec, &fetched)
+	if fetched["age"] != float64(37) {
+		t.Fatalf("expected age 37 after update, got %v", fetched["age"])
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/tables/users/records/1", nil)
+	expectStatus(t, rec, http.StatusNoContent)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records/1", nil)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/missing/records", nil)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestRecordValidation(t *testing.T) {
+	h := newTestServer(t)
+
+	// Undeclared columns aren't validated by what their name looks like
+	rec := doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{
+		"hotel": "Ritz", "mailing_address": "1 Main St", "hourly_rate": 42, "email_verified": true,
+	})
+	expectStatus(t, rec, http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "nope"}), http.StatusUnprocessableEntity)
+
+	rec = doRequest(t, h, http.MethodPost, "/columns?table=users", map[string]interface{}{
+		"key":      "email",
+		"type":     "email",
+		"required": true,
+		"rules":    map[string]interface{}{"unique": true},
+	})
+	expectStatus(t, rec, http.StatusCreated)
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "No email"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "not-an-email"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	var body struct {
+		Error struct {
+			Code    string       `json:"code"`
+			Details []FieldError `json:"details"`
+		} `json:"error"`
+	}
+	decodeBody(t, rec, &body)
+	if body.Error.Code != codeValidationFailed {
+		t.Fatalf("expected %s, got %s", codeValidationFailed, body.Error.Code)
+	}
+	if errs := body.Error.Details; len(errs) != 1 || errs[0].Field != "email" || errs[0].Code != codeInvalidFormat {
+		t.Fatalf("unexpected errors %+v", errs)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "ada@example.com"})
+	expectStatus(t, rec, http.StatusCreated)
+	var ada Record
+	decodeBody(t, rec, &ada)
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "ada@example.com"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	decodeBody(t, rec, &body)
+	if errs := body.Error.Details; len(errs) != 1 || errs[0].Code != codeNotUnique {
+		t.Fatalf("expected NOT_UNIQUE, got %+v", errs)
+	}
+
+	// A trashed record doesn't hold on to its unique value
+	if _, err := store.EnableSoftDelete("users"); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodDelete, fmt.Sprintf("/tables/users/records/%v", ada["id"]), nil), http.StatusNoContent)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "ada@example.com"}), http.StatusCreated)
+
+	// Patterns are compiled once, when the rules are stored
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/columns?table=users", map[string]interface{}{
+		"key": "code", "type": "text", "rules": map[string]interface{}{"pattern": "^[A-Z]{3}$"},
+	}), http.StatusCreated)
+	metadata, _ := store.ColumnMetadata("users")
+	for _, meta := range metadata {
+		if meta.Key == "code" && meta.pattern == nil {
+			t.Fatal("expected the pattern to be compiled with the rules")
+		}
+	}
+	rec = doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "grace@example.com", "code": "abc"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	decodeBody(t, rec, &body)
+	if errs := body.Error.Details; len(errs) != 1 || errs[0].Code != codePatternMismatch {
+		t.Fatalf("expected PATTERN_MISMATCH, got %+v", errs)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"email": "grace@example.com", "code": "ABC"}), http.StatusCreated)
+}
+
+func TestListRecordsQuery(t *testing.T) {
+	h := newTestServer(t)
+
+	for _, row := range []map[string]interface{}{
+		{"name": "Ada", "age": 36},
+		{"name": "Grace", "age": 45},
+		{"name": "Linus", "age": 28},
+		{"name": "Barbara", "age": 45},
+	} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", row), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/users/records?sort=-age,name&limit=2", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if total := rec.Header().Get("X-Total-Count"); total != "4" {
+		t.Fatalf("expected X-Total-Count 4, got %q", total)
+	}
+	var records []Record
+	decodeBody(t, rec, &records)
+	if len(records) != 2 || records[0]["name"] != "Barbara" || records[1]["name"] != "Grace" {
+		t.Fatalf("unexpected page %v", records)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records?filter[age][gte]=36&filter[name][like]=%25r%25", nil)
+	expectStatus(t, rec, http.StatusOK)
+	decodeBody(t, rec, &records)
+	if len(records) != 2 || rec.Header().Get("X-Total-Count") != "2" {
+		t.Fatalf("expected Grace and Barbara, got %v", records)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records?limit=3", nil)
+	expectStatus(t, rec, http.StatusOK)
+	cursor := rec.Header().Get("X-Next-Cursor")
+	if cursor != "3" {
+		t.Fatalf("expected X-Next-Cursor 3, got %q", cursor)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records?limit=3&after="+cursor, nil)
+	expectStatus(t, rec, http.StatusOK)
+	decodeBody(t, rec, &records)
+	if len(records) != 1 || records[0]["name"] != "Barbara" {
+		t.Fatalf("unexpected second page %v", records)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records?limit=3&sort=-id", nil)
+	if cursor := rec.Header().Get("X-Next-Cursor"); cursor != "2" {
+		t.Fatalf("expected X-Next-Cursor 2 sorting by -id, got %q", cursor)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records?limit=3&sort=name", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if cursor := rec.Header().Get("X-Next-Cursor"); cursor != "" {
+		t.Fatalf("expected no cursor when sorting by name, got %q", cursor)
+	}
+
+	for _, query := range []string{"sort=nope", "filter[nope]=1", "filter[age][near]=1", "limit=0"} {
+		expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/users/records?"+query, nil), http.StatusBadRequest)
+	}
+}
+
+func TestBulkCreate(t *testing.T) {
+	h := newTestServer(t)
+
+	rows := []map[string]interface{}{
+		{"name": "Ada", "email": "ada@example.com"},
+		{"name": "Bad", "email": "nope"},
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "users", "records": rows})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	if _, total, _ := store.ListRecords("users", recordQuery{}); total != 0 {
+		t.Fatalf("atomic bulk insert committed %d rows", total)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "users", "mode": bulkModeBestEffort, "records": rows})
+	expectStatus(t, rec, http.StatusOK)
+	var body struct {
+		Committed bool            `json:"committed"`
+		Created   int             `json:"created"`
+		Failed    int             `json:"failed"`
+		Results   []bulkRowResult `json:"results"`
+	}
+	decodeBody(t, rec, &body)
+	if !body.Committed || body.Created != 1 || body.Failed != 1 || body.Results[0].ID == 0 || len(body.Results[1].Errors) == 0 {
+		t.Fatalf("unexpected best effort result %+v", body)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "users", "records": rows[:1]})
+	expectStatus(t, rec, http.StatusCreated)
+
+	// Keys that sanitize to the same column can't both be stored
+	colliding := []map[string]interface{}{{"First Name": "Ada", "first_name": "Grace", "name": "Ada"}}
+	rec = doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "users", "records": colliding})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	var rejected struct {
+		Results []bulkRowResult `json:"results"`
+	}
+	decodeBody(t, rec, &rejected)
+	if errs := rejected.Results[0].Errors; len(errs) != 1 || errs[0].Code != codeDuplicateField || errs[0].Field != "first_name" {
+		t.Fatalf("expected a duplicate field error for first_name, got %+v", rejected.Results)
+	}
+	if columns, _ := store.Columns("users"); containsString(columns, "first_name") {
+		t.Fatal("a rejected row must not add columns")
+	}
+}
+
+func TestBulkDeleteRequiresConfirmation(t *testing.T) {
+	h := newTestServer(t)
+
+	for _, name := range []string{"Ada", "Grace", "Linus"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": name}), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodDelete, "/tables/users/records?ids=1,2", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if _, total, _ := store.ListRecords("users", recordQuery{}); total != 1 {
+		t.Fatalf("expected 1 remaining record, got %d", total)
+	}
+
+	rec = doRequest(t, h, http.MethodDelete, "/tables/users/records?all=true", nil)
+	expectStatus(t, rec, http.StatusPreconditionRequired)
+	var challenge struct {
+		Error struct {
+			Code    string `json:"code"`
+			Details struct {
+				ConfirmationToken string `json:"confirmationToken"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	decodeBody(t, rec, &challenge)
+	if challenge.Error.Code != codeConfirmationRequired {
+		t.Fatalf("expected %s, got %s", codeConfirmationRequired, challenge.Error.Code)
+	}
+	token := challenge.Error.Details.ConfirmationToken
+
+	rec = doRequest(t, h, http.MethodDelete, "/tables/users/records?all=true&confirm="+token, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if _, total, _ := store.ListRecords("users", recordQuery{}); total != 0 {
+		t.Fatalf("expected empty table after truncate, got %d", total)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/audit?table=users&operation=truncate", nil)
+	var entries []AuditEntry
+	decodeBody(t, rec, &entries)
+	if len(entries) != 1 || entries[0].After["deleted"] != float64(1) {
+		t.Fatalf("expected the truncate in the audit log, got %+v", entries)
+	}
+
+	// Tokens are single use
+	rec = doRequest(t, h, http.MethodDelete, "/tables/users/records?all=true&confirm="+token, nil)
+	expectStatus(t, rec, http.StatusPreconditionRequired)
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := doRequest(t, h, http.MethodPatch, "/tables", nil)
+	expectStatus(t, rec, http.StatusMethodNotAllowed)
+	if allow := rec.Header().Get("Allow"); !strings.Contains(allow, http.MethodGet) || !strings.Contains(allow, http.MethodPost) {
+		t.Fatalf("expected Allow to list GET and POST, got %q", allow)
+	}
+
+	rec = doRequest(t, h, http.MethodOptions, "/tables/users/records", nil)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestAlterColumn(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name":    "people",
+		"columns": map[string]string{"years": "VARCHAR(255)"},
+	}), http.StatusCreated)
+	for _, years := range []string{"12", "abc", "40"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/people/records", map[string]interface{}{"years": years}), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodPatch, "/columns?table=people&column=years", map[string]interface{}{"sqlType": "integer", "dryRun": true})
+	expectStatus(t, rec, http.StatusOK)
+	var dryRun struct {
+		Convertible bool             `json:"convertible"`
+		Conversion  conversionReport `json:"conversion"`
+	}
+	decodeBody(t, rec, &dryRun)
+	if dryRun.Convertible || dryRun.Conversion.Rows != 3 || dryRun.Conversion.Failed != 1 || dryRun.Conversion.Failures[0].ID != 2 {
+		t.Fatalf("unexpected dry run report %+v", dryRun)
+	}
+
+	rec = doRequest(t, h, http.MethodPut, "/columns?table=people&column=years", map[string]interface{}{"sqlType": "INTEGER"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	if record, _ := store.GetRecord("people", 1); record["years"] != "12" {
+		t.Fatalf("failed conversion changed data: %v", record)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPut, "/tables/people/records/2", map[string]interface{}{"years": "13"}), http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodPatch, "/columns?table=people&column=years", map[string]interface{}{"name": "age", "type": "number", "sqlType": "INTEGER"})
+	expectStatus(t, rec, http.StatusOK)
+	var updated struct {
+		Column ColumnMetadata `json:"column"`
+	}
+	decodeBody(t, rec, &updated)
+	if updated.Column.Key != "age" || updated.Column.Type != semanticNumber {
+		t.Fatalf("unexpected column metadata %+v", updated.Column)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/people/records?sort=-age", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var records []Record
+	decodeBody(t, rec, &records)
+	if len(records) != 3 || records[0]["age"] != float64(40) || records[0]["years"] != nil {
+		t.Fatalf("expected converted and renamed values, got %v", records)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/columns?table=people&column=missing", map[string]interface{}{"name": "x"}), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/columns?table=people&column=id", map[string]interface{}{"name": "x"}), http.StatusBadRequest)
+}
+
+func TestTableRenameAndClone(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "staff"}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/columns?table=staff", map[string]interface{}{"key": "email", "type": "email", "required": true}), http.StatusCreated)
+	for _, email := range []string{"ada@example.com", "grace@example.com", "linus@example.org"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/staff/records", map[string]interface{}{"email": email}), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodPatch, "/tables/staff", map[string]string{"name": "employees"})
+	expectStatus(t, rec, http.StatusOK)
+	if exists, _ := store.TableExists("staff"); exists {
+		t.Fatal("staff still exists after rename")
+	}
+	rec = doRequest(t, h, http.MethodGet, "/columns?table=employees", nil)
+	var columns []ColumnMetadata
+	decodeBody(t, rec, &columns)
+	if len(columns) != 3 || columns[2].Type != semanticEmail || !columns[2].Required {
+		t.Fatalf("metadata not carried over by rename: %+v", columns)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/users", map[string]string{"name": "people"}), http.StatusForbidden)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/employees", map[string]string{"name": "users"}), http.StatusConflict)
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/employees/clone", map[string]interface{}{"name": "employees_template"})
+	expectStatus(t, rec, http.StatusCreated)
+	if _, total, _ := store.ListRecords("employees_template", recordQuery{}); total != 0 {
+		t.Fatalf("schema-only clone copied %d rows", total)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/tables/employees/clone?filter[email][like]=%25.com", map[string]interface{}{"name": "employees_com", "withData": true})
+	expectStatus(t, rec, http.StatusCreated)
+	var clone struct {
+		Rows int64 `json:"rows"`
+	}
+	decodeBody(t, rec, &clone)
+	if clone.Rows != 2 {
+		t.Fatalf("expected 2 copied rows, got %d", clone.Rows)
+	}
+
+	// The copy keeps its metadata and allocates ids after the copied rows
+	rec = doRequest(t, h, http.MethodPost, "/tables/employees_com/records", map[string]interface{}{"name": "no email"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	rec = doRequest(t, h, http.MethodPost, "/tables/employees_com/records", map[string]interface{}{"email": "new@example.com"})
+	expectStatus(t, rec, http.StatusCreated)
+	var created Record
+	decodeBody(t, rec, &created)
+	if created["id"] != float64(3) {
+		t.Fatalf("expected id 3 in clone, got %v", created["id"])
+	}
+	if _, total, _ := store.ListRecords("employees", recordQuery{}); total != 3 {
+		t.Fatalf("clone changed the source table: %d rows", total)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/employees/clone?filter[email]=x", map[string]interface{}{"name": "bad"}), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/missing/clone", map[string]interface{}{"name": "copy"}), http.StatusNotFound)
+}
+
+func TestTableSchema(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name":    "products",
+		"columns": map[string]string{"title": "VARCHAR(80)", "price": "DECIMAL(10,2)"},
+	}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/products/records", map[string]interface{}{"title": "Lamp", "price": 12.5}), http.StatusCreated)
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/products/schema", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var schema TableSchema
+	decodeBody(t, rec, &schema)
+
+	types := make(map[string]ColumnSchema)
+	for _, column := range schema.Columns {
+		types[column.Name] = column
+	}
+	if id := types["id"]; !id.PrimaryKey || id.Nullable || id.Position != 1 || id.Default == nil {
+		t.Fatalf("unexpected id column: %+v", id)
+	}
+	if title := types["title"]; title.Type != "character varying(80)" || !title.Nullable {
+		t.Fatalf("unexpected title column: %+v", title)
+	}
+	if price := types["price"]; price.Type != "numeric(10,2)" || price.DataType != "numeric" {
+		t.Fatalf("unexpected price column: %+v", price)
+	}
+	if len(schema.Indexes) != 1 || !schema.Indexes[0].Primary || schema.Indexes[0].Name != "products_pkey" {
+		t.Fatalf("expected the primary key index, got %+v", schema.Indexes)
+	}
+	if schema.RowEstimate != 1 {
+		t.Fatalf("expected row estimate 1, got %d", schema.RowEstimate)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/missing/schema", nil), http.StatusNotFound)
+}
+
+func TestIndexManagement(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name":    "accounts",
+		"columns": map[string]string{"email": "TEXT", "status": "TEXT", "bio": "TEXT", "age": "INTEGER"},
+	}), http.StatusCreated)
+	for _, row := range []map[string]interface{}{
+		{"email": "ada@example.com", "status": "active"},
+		{"email": "ada@example.com", "status": "closed"},
+		{"email": "grace@example.com", "status": "active"},
+	} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/records", row), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"columns": []string{"email"}, "unique": true})
+	envelope := expectError(t, rec, http.StatusConflict, codeDuplicateValues)
+	if len(envelope.Error.Details) != 1 {
+		t.Fatalf("expected one duplicate group, got %+v", envelope.Error.Details)
+	}
+
+	// Only active accounts need a unique email, which the existing rows satisfy
+	rec = doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{
+		"columns": []string{"email"},
+		"unique":  true,
+		"where":   map[string]interface{}{"status": map[string]interface{}{"eq": "active"}},
+	})
+	expectStatus(t, rec, http.StatusCreated)
+	var created struct {
+		Index IndexSchema `json:"index"`
+	}
+	decodeBody(t, rec, &created)
+	if created.Index.Name != "accounts_email_key" || created.Index.Predicate != `"status" = 'active'` {
+		t.Fatalf("unexpected index: %+v", created.Index)
+	}
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/accounts/records", map[string]interface{}{"email": "grace@example.com", "status": "active"}), http.StatusConflict, codeUniqueViolation)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/records", map[string]interface{}{"email": "grace@example.com", "status": "closed"}), http.StatusCreated)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"columns": []string{"status", "email"}}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"name": "accounts_bio_search", "columns": []string{"bio"}, "method": "gin"}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"columns": []string{"age"}, "method": "gin"}), http.StatusBadRequest)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"columns": []string{"status", "email"}}), http.StatusConflict, codeIndexExists)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/accounts/indexes", map[string]interface{}{"columns": []string{"nope"}}), http.StatusBadRequest, codeColumnNotFound)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/accounts/indexes", nil)
+	var indexes []IndexSchema
+	decodeBody(t, rec, &indexes)
+	if len(indexes) != 4 {
+		t.Fatalf("expected 4 indexes, got %+v", indexes)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/accounts/indexes/accounts_email_key", nil), http.StatusOK)
+	expectError(t, doRequest(t, h, http.MethodDelete, "/tables/accounts/indexes/accounts_email_key", nil), http.StatusNotFound, codeIndexNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/accounts/indexes/accounts_pkey", nil), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/accounts/records", map[string]interface{}{"email": "grace@example.com", "status": "active"}), http.StatusCreated)
+}
+
+func TestIndexPredicateMatchesWhereClause(t *testing.T) {
+	filters := []filterClause{
+		{Column: "email", Operator: "ilike", Value: "%@example.com"},
+		{Column: "age", Operator: "in", Value: "30,40"},
+		{Column: "status", Operator: "eq", Value: "it's"},
+		{Column: "bio", Operator: "null", Value: "false"},
+	}
+	want := `"email"::text ILIKE '%@example.com' AND "age"::text IN ('30', '40') AND "status" = 'it''s' AND "bio" IS NOT NULL`
+	if got := indexPredicate(filters); got != want {
+		t.Errorf("indexPredicate = %s, want %s", got, want)
+	}
+	where, _, err := recordQuery{Filters: filters}.whereClause(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ` WHERE "email"::text ILIKE $1 AND "age"::text IN ($2, $3) AND "status" = $4 AND "bio" IS NOT NULL`; where != want {
+		t.Errorf("whereClause = %s, want %s", where, want)
+	}
+}
+
+func TestLinkColumnsExpandAndInclude(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "customers", "columns": map[string]string{"name": "TEXT"}}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "orders", "columns": map[string]string{"total": "NUMERIC(10,2)"}}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/columns?table=orders", map[string]interface{}{
+		"key": "customer_id", "type": "link", "link": map[string]string{"table": "customers", "onDelete": "cascade"},
+	}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/columns?table=orders", map[string]interface{}{"key": "buyer_id", "type": "link"}), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/columns?table=orders", map[string]interface{}{
+		"key": "buyer_id", "type": "link", "link": map[string]string{"table": "customers", "onDelete": "explode"},
+	}), http.StatusBadRequest)
+
+	for _, name := range []string{"Ada", "Grace"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/customers/records", map[string]interface{}{"name": name}), http.StatusCreated)
+	}
+	for _, customer := range []int{1, 1, 2} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/orders/records", map[string]interface{}{"total": 10, "customer_id": customer}), http.StatusCreated)
+	}
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/orders/records", map[string]interface{}{"total": 10, "customer_id": 99}), http.StatusUnprocessableEntity, codeForeignKeyViolation)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/orders/records", map[string]interface{}{"total": 10, "customer_id": "abc"}), http.StatusUnprocessableEntity, codeValidationFailed)
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/orders/records?expand=customer_id", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var orders []struct {
+		Expand map[string]struct {
+			Name string `json:"name"`
+		} `json:"_expand"`
+	}
+	decodeBody(t, rec, &orders)
+	if len(orders) != 3 || orders[0].Expand["customer_id"].Name != "Ada" || orders[2].Expand["customer_id"].Name != "Grace" {
+		t.Fatalf("unexpected expanded orders: %+v", orders)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/customers/records/1?include=orders", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var customer struct {
+		Include map[string][]Record `json:"_include"`
+	}
+	decodeBody(t, rec, &customer)
+	if len(customer.Include["orders"]) != 2 {
+		t.Fatalf("expected 2 included orders, got %+v", customer.Include)
+	}
+
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/orders/records?expand=total", nil), http.StatusBadRequest, codeInvalidQuery)
+	expectError(t, doRequest(t, h, http.MethodGet, "/tables/customers/records?include=users", nil), http.StatusBadRequest, codeInvalidQuery)
+	expectError(t, doRequest(t, h, http.MethodDelete, "/tables/customers", nil), http.StatusConflict, codeTableReferenced)
+
+	// Deleting a customer cascades to their orders
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/customers/records/1", nil), http.StatusNoContent)
+	if _, total, _ := store.ListRecords("orders", recordQuery{}); total != 1 {
+		t.Fatalf("expected cascade to leave 1 order, got %d", total)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/columns?table=orders", nil)
+	var columns []ColumnMetadata
+	decodeBody(t, rec, &columns)
+	if link := columns[len(columns)-1].Link; link == nil || link.Table != "customers" || link.OnDelete != "CASCADE" {
+		t.Fatalf("expected link metadata, got %+v", columns[len(columns)-1])
+	}
+
+	// A clone keeps the foreign key along with the link metadata
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/orders/clone", map[string]interface{}{"name": "orders_copy", "withData": true}), http.StatusCreated)
+	expectError(t, doRequest(t, h, http.MethodPost, "/tables/orders_copy/records", map[string]interface{}{"total": 10, "customer_id": 99}), http.StatusUnprocessableEntity, codeForeignKeyViolation)
+	rec = doRequest(t, h, http.MethodGet, "/tables/orders_copy/schema", nil)
+	var schema TableSchema
+	decodeBody(t, rec, &schema)
+	if column, _ := schemaColumn(schema, "customer_id"); column.ForeignKey == nil || column.ForeignKey.Table != "customers" || column.ForeignKey.OnDelete != "CASCADE" {
+		t.Fatalf("expected the clone to keep the foreign key, got %+v", column)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/migrations?table=orders_copy", nil)
+	var migrations []Migration
+	decodeBody(t, rec, &migrations)
+	if len(migrations) != 1 || !strings.Contains(migrations[0].Up, `FOREIGN KEY ("customer_id") REFERENCES "customers" ("id") ON DELETE CASCADE`) {
+		t.Fatalf("expected the clone migration to add the foreign key, got %+v", migrations)
+	}
+}
+
+func TestSchemaModes(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "contacts", "columns": map[string]string{"name": "TEXT"}, "schemaMode": "strict",
+	}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "bad_mode", "schemaMode": "loose"}), http.StatusBadRequest)
+
+	rec := doRequest(t, h, http.MethodPost, "/tables/contacts/records", map[string]interface{}{"name": "Ada", "nmae": "typo"})
+	envelope := expectError(t, rec, http.StatusUnprocessableEntity, codeValidationFailed)
+	if len(envelope.Error.Details) != 1 || envelope.Error.Details[0].Field != "nmae" || envelope.Error.Details[0].Code != codeUnknownField {
+		t.Fatalf("expected the unknown field to be reported, got %+v", envelope.Error.Details)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPut, "/tables/contacts/records/1", map[string]interface{}{"nmae": "typo"}), http.StatusUnprocessableEntity)
+
+	rec = doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "contacts", "mode": bulkModeBestEffort, "records": []map[string]interface{}{
+		{"name": "Grace"}, {"name": "Linus", "extra": true},
+	}})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodPatch, "/tables/contacts", map[string]string{"schemaMode": "ignore"})
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/contacts/records", map[string]interface{}{"name": "Ada", "nmae": "typo"}), http.StatusCreated)
+	if columns, _ := store.Columns("contacts"); len(columns) != 3 {
+		t.Fatalf("ignore mode changed the columns: %v", columns)
+	}
+
+	// The mode travels with a rename
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/contacts", map[string]string{"name": "people"}), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/tables/people/schema", nil)
+	var schema TableSchema
+	decodeBody(t, rec, &schema)
+	if schema.SchemaMode != schemaModeIgnore {
+		t.Fatalf("expected ignore mode after rename, got %q", schema.SchemaMode)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/people", map[string]string{"schemaMode": "dynamic"}), http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/people/records", map[string]interface{}{"name": "Ada", "city": "London"}), http.StatusCreated)
+	if columns, _ := store.Columns("people"); !containsString(columns, "city") {
+		t.Fatalf("dynamic mode did not add the column: %v", columns)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/people", map[string]string{}), http.StatusBadRequest)
+}
+
+func doPatch(t *testing.T, h http.Handler, target, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRecordReplaceAndPatch(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{
+		"name": "Ada", "age": 36, "profile": map[string]interface{}{"city": "London", "langs": []string{"en"}},
+	})
+	expectStatus(t, rec, http.StatusCreated)
+	var record Record
+	decodeBody(t, rec, &record)
+	if record["id"] != float64(1) {
+		t.Fatalf("expected id 1, got %v", record["id"])
+	}
+
+	// PUT replaces the record; left out fields become null and are still emitted
+	expectStatus(t, doRequest(t, h, http.MethodPut, "/tables/users/records/1", map[string]interface{}{"name": "Ada Lovelace"}), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records/1", nil)
+	record = Record{}
+	decodeBody(t, rec, &record)
+	if age, ok := record["age"]; !ok || age != nil || record["name"] != "Ada Lovelace" {
+		t.Fatalf("expected age to be null after PUT, got %v", record)
+	}
+
+	// Merge patch: objects merge recursively and null clears a field
+	expectStatus(t, doRequest(t, h, http.MethodPut, "/tables/users/records/1", map[string]interface{}{
+		"name": "Ada", "age": 36, "profile": map[string]interface{}{"city": "London", "langs": []string{"en"}},
+	}), http.StatusOK)
+	rec = doPatch(t, h, "/tables/users/records/1", mediaTypeMergePatch, `{"age": null, "profile": {"city": "Paris"}}`)
+	expectStatus(t, rec, http.StatusOK)
+	record = Record{}
+	decodeBody(t, rec, &record)
+	profile, _ := record["profile"].(map[string]interface{})
+	if record["age"] != nil || profile["city"] != "Paris" || profile["langs"] == nil || record["name"] != "Ada" {
+		t.Fatalf("unexpected record after merge patch: %v", record)
+	}
+
+	// JSON Patch
+	rec = doPatch(t, h, "/records/users/1", mediaTypeJSONPatch, `[
+		{"op": "test", "path": "/name", "value": "Ada"},
+		{"op": "add", "path": "/profile/langs/-", "value": "fr"},
+		{"op": "copy", "from": "/name", "path": "/nickname"},
+		{"op": "remove", "path": "/profile/city"}
+	]`)
+	expectStatus(t, rec, http.StatusOK)
+	record = Record{}
+	decodeBody(t, rec, &record)
+	profile, _ = record["profile"].(map[string]interface{})
+	if langs, _ := profile["langs"].([]interface{}); len(langs) != 2 || langs[1] != "fr" {
+		t.Fatalf("expected fr to be appended, got %v", profile)
+	}
+	if _, ok := profile["city"]; ok || record["nickname"] != "Ada" {
+		t.Fatalf("unexpected record after JSON Patch: %v", record)
+	}
+
+	expectError(t, doPatch(t, h, "/records/users/1", mediaTypeJSONPatch, `[{"op": "test", "path": "/name", "value": "Grace"}]`), http.StatusConflict, codePatchTestFailed)
+	expectError(t, doPatch(t, h, "/records/users/1", mediaTypeJSONPatch, `[{"op": "replace", "path": "/missing", "value": 1}]`), http.StatusBadRequest, codeInvalidPatch)
+	expectError(t, doPatch(t, h, "/records/users/1", mediaTypeJSONPatch, `[{"op": "replace", "path": "/id", "value": 2}]`), http.StatusBadRequest, codeInvalidPatch)
+	expectError(t, doPatch(t, h, "/records/users/1", "text/plain", `name=Grace`), http.StatusUnsupportedMediaType, codeUnsupportedMediaType)
+	expectStatus(t, doPatch(t, h, "/records/users/99", mediaTypeMergePatch, `{"name": "Grace"}`), http.StatusNotFound)
+}
+
+func TestRecordWritesReturnRepresentation(t *testing.T) {
+	h := newTestServer(t)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "Ada", "age": 36}), http.StatusCreated)
+
+	rec := doRequest(t, h, http.MethodPut, "/tables/users/records/1", map[string]interface{}{"name": "Ada", "age": 37})
+	expectStatus(t, rec, http.StatusOK)
+	var record Record
+	decodeBody(t, rec, &record)
+	if record["id"] != float64(1) || record["age"] != float64(37) {
+		t.Fatalf("expected the updated record, got %v", record)
+	}
+
+	withPrefer := func(method, target, prefer string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", prefer)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = withPrefer(http.MethodPut, "/tables/users/records/1", "return=minimal", `{"name": "Ada", "age": 38}`)
+	expectStatus(t, rec, http.StatusNoContent)
+	if rec.Header().Get("Preference-Applied") != "return=minimal" || rec.Body.Len() != 0 {
+		t.Fatalf("expected an empty minimal response, got %q", rec.Body.String())
+	}
+
+	expectError(t, doRequest(t, h, http.MethodPut, "/tables/users/records/99", map[string]interface{}{"name": "Nobody"}), http.StatusNotFound, codeRecordNotFound)
+	expectError(t, doRequest(t, h, http.MethodDelete, "/tables/users/records/99", nil), http.StatusNotFound, codeRecordNotFound)
+
+	rec = withPrefer(http.MethodDelete, "/tables/users/records/1", "handling=strict, return=representation", "")
+	expectStatus(t, rec, http.StatusOK)
+	record = Record{}
+	decodeBody(t, rec, &record)
+	if record["age"] != float64(38) {
+		t.Fatalf("expected the deleted record, got %v", record)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/users/records/1", nil), http.StatusNotFound)
+}
+
+func TestRecordETags(t *testing.T) {
+	h := newTestServer(t)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "Ada"}), http.StatusCreated)
+
+	conditional := func(method, target, header, etag, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, etag)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/users/records/1", nil)
+	expectStatus(t, rec, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("expected ETag \"1\" for a new record, got %q", etag)
+	}
+	expectStatus(t, conditional(http.MethodGet, "/tables/users/records/1", "If-None-Match", "W/"+etag, ""), http.StatusNotModified)
+
+	// Both editors read version 1; the first write wins and bumps the version
+	rec = conditional(http.MethodPut, "/tables/users/records/1", "If-Match", etag, `{"name": "Ada Lovelace", "row_version": 40}`)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("expected ETag \"2\" after the update, got %q", rec.Header().Get("ETag"))
+	}
+	expectError(t, conditional(http.MethodPatch, "/tables/users/records/1", "If-Match", etag, `{"name": "Countess"}`), http.StatusPreconditionFailed, codePreconditionFailed)
+	expectError(t, conditional(http.MethodDelete, "/tables/users/records/1", "If-Match", etag, ""), http.StatusPreconditionFailed, codePreconditionFailed)
+	expectStatus(t, conditional(http.MethodGet, "/tables/users/records/1", "If-None-Match", etag, ""), http.StatusOK)
+
+	expectStatus(t, conditional(http.MethodPatch, "/tables/users/records/1", "If-Match", `"2"`, `{"name": "Countess"}`), http.StatusOK)
+	expectStatus(t, conditional(http.MethodDelete, "/tables/users/records/1", "If-Match", "*", ""), http.StatusNoContent)
+	expectStatus(t, conditional(http.MethodPut, "/tables/users/records/1", "If-Match", "*", `{"name": "Ada"}`), http.StatusNotFound)
+}
+
+func TestIfMatchOnUnversionedTable(t *testing.T) {
+	h := newTestServer(t)
+	store.(*memoryStore).tables["people"] = &memoryTable{columns: []memoryColumn{{name: "id", sqlType: "SERIAL"}}, rows: make(map[int64]Record), nextID: 1}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/people/records", map[string]interface{}{"name": "Ada"}), http.StatusCreated)
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/people/records/1", nil)
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"h`) {
+		t.Fatalf("expected a hash ETag without row_version, got %q", etag)
+	}
+
+	// The write can't check the hash atomically, so it is refused rather than the
+	// table being altered mid-request
+	conditional := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/tables/people/records/1", strings.NewReader(`{"name": "Ada Lovelace"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	envelope := expectError(t, conditional(etag), http.StatusPreconditionFailed, codePreconditionFailed)
+	if !strings.Contains(envelope.Error.Message, versionColumn) {
+		t.Errorf("expected the error to name %s, got %q", versionColumn, envelope.Error.Message)
+	}
+	expectError(t, conditional(`"hstale"`), http.StatusPreconditionFailed, codePreconditionFailed)
+	if columns, _ := store.Columns("people"); containsString(columns, versionColumn) {
+		t.Fatalf("a conditional write must not add %s, got columns %v", versionColumn, columns)
+	}
+
+	// Startup leaves the table alone too, and unconditional writes still work
+	initializeDefaultTables()
+	if columns, _ := store.Columns("people"); containsString(columns, versionColumn) {
+		t.Fatalf("startup must not add %s, got columns %v", versionColumn, columns)
+	}
+	expectStatus(t, doPatch(t, h, "/tables/people/records/1", "application/json", `{"name": "Ada Lovelace"}`), http.StatusOK)
+}
+
+func TestTimestampColumns(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "notes", "columns": map[string]string{"body": "TEXT"}, "timestamps": true,
+	}), http.StatusCreated)
+
+	req := httptest.NewRequest(http.MethodPost, "/tables/notes/records", strings.NewReader(`{"body": "first", "created_by": "mallory", "created_at": "2000-01-01T00:00:00Z"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, "ada")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusCreated)
+	var created Record
+	decodeBody(t, rec, &created)
+	if created[createdByColumn] != "ada" || created[updatedByColumn] != "ada" || created[createdAtColumn] == nil || created[createdAtColumn] == "2000-01-01T00:00:00Z" {
+		t.Fatalf("expected server maintained stamps, got %v", created)
+	}
+
+	rec = doRequest(t, h, http.MethodPatch, "/tables/notes/records/1", map[string]interface{}{"body": "edited"})
+	expectStatus(t, rec, http.StatusOK)
+	var updated Record
+	decodeBody(t, rec, &updated)
+	if updated[createdAtColumn] != created[createdAtColumn] || updated[createdByColumn] != "ada" || updated[updatedByColumn] != nil {
+		t.Fatalf("unexpected stamps after an anonymous update: %v", updated)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/notes/records?sort=-updated_at&filter[created_at][gt]=2001-01-01T00:00:00Z", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var records []Record
+	decodeBody(t, rec, &records)
+	if len(records) != 1 {
+		t.Fatalf("expected timestamps to be filterable, got %v", records)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/columns?table=notes&column=created_at", nil), http.StatusBadRequest)
+
+	// Retrofitting an existing table stamps the rows it already has
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "Ada"}), http.StatusCreated)
+	rec = doRequest(t, h, http.MethodPatch, "/tables/users", map[string]interface{}{"timestamps": true})
+	expectStatus(t, rec, http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/tables/users/records/1", nil)
+	var existing Record
+	decodeBody(t, rec, &existing)
+	if existing[createdAtColumn] == nil || existing[updatedAtColumn] == nil {
+		t.Fatalf("expected existing rows to get timestamps, got %v", existing)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/users", map[string]interface{}{"timestamps": false}), http.StatusBadRequest)
+
+	// Without timestamps or soft delete those names are ordinary columns
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "events", "columns": map[string]string{"created_at": "VARCHAR(50)"},
+	}), http.StatusCreated)
+	rec = doRequest(t, h, http.MethodPost, "/tables/events/records", map[string]interface{}{"created_at": "yesterday", "deleted_at": "never"})
+	expectStatus(t, rec, http.StatusCreated)
+	var event Record
+	decodeBody(t, rec, &event)
+	if event[createdAtColumn] != "yesterday" || event[deletedAtColumn] != "never" {
+		t.Fatalf("expected client values for ordinary columns, got %v", event)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/tables/events/records", nil)
+	var events []Record
+	decodeBody(t, rec, &events)
+	if len(events) != 1 {
+		t.Fatalf("expected a deleted_at column not to hide rows, got %v", events)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/events", map[string]interface{}{"timestamps": true}), http.StatusConflict)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/events", map[string]interface{}{"softDelete": true}), http.StatusConflict)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "logs", "columns": map[string]string{"created_at": "TEXT"}, "timestamps": true,
+	}), http.StatusBadRequest)
+}
+
+func TestCreateTableAppliesOptionsAtomically(t *testing.T) {
+	newTestServer(t)
+	options := tableOptions{SchemaMode: schemaModeStrict, Timestamps: true, SoftDelete: true}
+	if err := store.CreateTable("events", []columnDef{{Name: deletedAtColumn, Type: "TEXT"}}, options); err == nil {
+		t.Fatal("expected a clash with the deleted_at column")
+	}
+	if exists, _ := store.TableExists("events"); exists {
+		t.Fatal("a failed option must not leave the table behind")
+	}
+
+	if err := store.CreateTable("events", []columnDef{{Name: "name", Type: "TEXT"}}, options); err != nil {
+		t.Fatal(err)
+	}
+	mode, _ := store.SchemaMode("events")
+	system, _ := store.SystemColumns("events")
+	if mode != schemaModeStrict || !containsString(system, createdAtColumn) || !containsString(system, deletedAtColumn) {
+		t.Fatalf("expected every option to be applied, got mode %s and system columns %v", mode, system)
+	}
+}
+
+func TestSoftDeleteAndTrash(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "tasks", "columns": map[string]string{"title": "TEXT"}, "softDelete": true,
+	}), http.StatusCreated)
+	for _, title := range []string{"one", "two", "three"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/tasks/records", map[string]interface{}{"title": title}), http.StatusCreated)
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/tasks/records/1", nil), http.StatusNoContent)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/tasks/records/1", nil), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/tasks/records/1", map[string]interface{}{"title": "x"}), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/tasks/records?ids=2", nil), http.StatusOK)
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/tasks/records", nil)
+	if rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("expected deleted records to be hidden, got %s", rec.Body.String())
+	}
+	rec = doRequest(t, h, http.MethodGet, "/trash/records/tasks?sort=id", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var trashed []Record
+	decodeBody(t, rec, &trashed)
+	if len(trashed) != 2 || trashed[0][deletedAtColumn] == nil {
+		t.Fatalf("expected two trashed records, got %v", trashed)
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/trash/records/tasks/1/restore", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var restored Record
+	decodeBody(t, rec, &restored)
+	if restored["title"] != "one" || restored[deletedAtColumn] != nil {
+		t.Fatalf("unexpected restored record %v", restored)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/trash/records/tasks/1/restore", nil), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/tasks/records/1", nil), http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/trash/records/users", nil), http.StatusBadRequest)
+
+	// Purging respects the retention period
+	rec = doRequest(t, h, http.MethodPost, "/trash/purge", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var purged trashPurgeResult
+	decodeBody(t, rec, &purged)
+	if len(purged.Records) != 0 {
+		t.Fatalf("expected nothing older than the retention period, got %v", purged)
+	}
+	rec = doRequest(t, h, http.MethodPost, "/trash/purge?olderThan=0s", nil)
+	expectStatus(t, rec, http.StatusOK)
+	decodeBody(t, rec, &purged)
+	if purged.Records["tasks"] != 1 {
+		t.Fatalf("expected one purged record, got %v", purged)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/trash/records/tasks/2/restore", nil), http.StatusNotFound)
+
+	// Dropped tables are archived and can be restored, under another name if taken
+	rec = doRequest(t, h, http.MethodDelete, "/tables/tasks", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var dropped map[string]string
+	decodeBody(t, rec, &dropped)
+	archiveName := dropped["archivedAs"]
+	if exists, _ := store.TableExists("tasks"); exists || !strings.HasPrefix(archiveName, "tasks_") {
+		t.Fatalf("expected tasks to be archived, got %v", dropped)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "tasks"}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/trash/tables/"+archiveName+"/restore", nil), http.StatusConflict)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/trash/tables/"+archiveName+"/restore", map[string]string{"name": "old_tasks"}), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/tables/old_tasks/records", nil)
+	if rec.Header().Get("X-Total-Count") != "2" {
+		t.Fatalf("expected the restored table to keep its rows, got %s", rec.Body.String())
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/old_tasks", nil), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/trash/tables", nil)
+	var archived []ArchivedTable
+	decodeBody(t, rec, &archived)
+	if len(archived) != 1 || archived[0].Table != "old_tasks" {
+		t.Fatalf("unexpected archived tables %v", archived)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/trash/tables/"+archived[0].Name, nil), http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/trash/tables/"+archived[0].Name, nil), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/tasks?permanent=true", nil), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/trash/tables", nil)
+	decodeBody(t, rec, &archived)
+	if len(archived) != 0 {
+		t.Fatalf("expected a permanent drop to skip the trash, got %v", archived)
+	}
+
+	// Deleting all records of a soft-deleting table trashes them unless permanent=true
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{"name": "chores", "softDelete": true}), http.StatusCreated)
+	for _, title := range []string{"dishes", "laundry"} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/chores/records", map[string]interface{}{"title": title}), http.StatusCreated)
+	}
+	deleteAll := func(target string) {
+		t.Helper()
+		rec := doRequest(t, h, http.MethodDelete, target, nil)
+		expectStatus(t, rec, http.StatusPreconditionRequired)
+		var challenge struct {
+			Error struct {
+				Details struct {
+					ConfirmationToken string `json:"confirmationToken"`
+				} `json:"details"`
+			} `json:"error"`
+		}
+		decodeBody(t, rec, &challenge)
+		expectStatus(t, doRequest(t, h, http.MethodDelete, target+"&confirm="+challenge.Error.Details.ConfirmationToken, nil), http.StatusOK)
+	}
+	deleteAll("/tables/chores/records?all=true")
+	rec = doRequest(t, h, http.MethodGet, "/trash/records/chores", nil)
+	decodeBody(t, rec, &trashed)
+	if len(trashed) != 2 {
+		t.Fatalf("expected all=true to move both records to the trash, got %v", trashed)
+	}
+	deleteAll("/tables/chores/records?all=true&permanent=true")
+	rec = doRequest(t, h, http.MethodGet, "/trash/records/chores", nil)
+	decodeBody(t, rec, &trashed)
+	if len(trashed) != 0 {
+		t.Fatalf("expected permanent=true to truncate the trash as well, got %v", trashed)
+	}
+}
+
+func TestAuditHistoryAndRevert(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "contacts", "columns": map[string]string{"name": "TEXT", "email": "TEXT"}, "softDelete": true,
+	}), http.StatusCreated)
+
+	req := httptest.NewRequest(http.MethodPost, "/tables/contacts/records", strings.NewReader(`{"name": "Ada", "email": "ada@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, "grace")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/contacts/records/1", map[string]interface{}{"email": "ada@lovelace.dev"}), http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/contacts/records/1", map[string]interface{}{"name": "Ada L."}), http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/contacts/records/1/history", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var history []AuditEntry
+	decodeBody(t, rec, &history)
+	if len(history) != 3 || history[2].Operation != auditCreate || history[2].Actor != "grace" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if history[1].Before["email"] != "ada@example.com" || history[1].After["email"] != "ada@lovelace.dev" || len(history[1].After) != 1 {
+		t.Fatalf("expected the email change as a diff, got %+v", history[1])
+	}
+
+	// Going back to version 1 undoes both updates in one change
+	rec = doRequest(t, h, http.MethodPost, "/tables/contacts/records/1/revert", map[string]interface{}{"version": 1})
+	expectStatus(t, rec, http.StatusOK)
+	var reverted Record
+	decodeBody(t, rec, &reverted)
+	if reverted["name"] != "Ada" || reverted["email"] != "ada@example.com" {
+		t.Fatalf("unexpected reverted record %v", reverted)
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/contacts/records/1/revert", map[string]interface{}{"version": 42}), http.StatusNotFound)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/contacts/records/1/revert", nil), http.StatusBadRequest)
+
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/contacts/records/1", nil), http.StatusNoContent)
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/trash/records/contacts/1/restore", nil), http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodGet, "/audit?table=contacts&operation=revert", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var entries []AuditEntry
+	decodeBody(t, rec, &entries)
+	if len(entries) != 1 || entries[0].After["name"] != "Ada" {
+		t.Fatalf("unexpected revert entries %+v", entries)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/audit?actor=grace", nil)
+	if rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("expected one entry by grace, got %s", rec.Body.String())
+	}
+	rec = doRequest(t, h, http.MethodGet, "/audit?recordId=1&limit=2", nil)
+	decodeBody(t, rec, &entries)
+	if rec.Header().Get("X-Total-Count") != "6" || len(entries) != 2 || entries[0].Operation != auditRestore || entries[1].Operation != auditDelete {
+		t.Fatalf("unexpected audit page %s (total %s)", rec.Body.String(), rec.Header().Get("X-Total-Count"))
+	}
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/audit?operation=explode", nil), http.StatusBadRequest)
+
+	// Renaming the table keeps its history
+	expectStatus(t, doRequest(t, h, http.MethodPatch, "/tables/contacts", map[string]interface{}{"name": "people"}), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/records/people/1/history", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("X-Total-Count") != "6" {
+		t.Fatalf("expected history to follow the rename, got %s", rec.Body.String())
+	}
+
+	// A bulk insert gets one summary entry; bulk deletes get an entry per record with
+	// its old values, and only a truncation is summarized
+	rows := []map[string]interface{}{{"name": "Alan"}, {"name": "Linus"}, {"name": "Edsger"}}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "people", "records": rows}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/people/records?filter[name]=Linus", nil), http.StatusOK)
+	confirmed := func(target string) {
+		t.Helper()
+		rec := doRequest(t, h, http.MethodDelete, target, nil)
+		var challenge struct {
+			Error struct {
+				Details struct {
+					ConfirmationToken string `json:"confirmationToken"`
+				} `json:"details"`
+			} `json:"error"`
+		}
+		decodeBody(t, rec, &challenge)
+		expectStatus(t, doRequest(t, h, http.MethodDelete, target+"&confirm="+challenge.Error.Details.ConfirmationToken, nil), http.StatusOK)
+	}
+	confirmed("/tables/people/records?all=true")
+	confirmed("/tables/people/records?all=true&permanent=true")
+
+	rec = doRequest(t, h, http.MethodGet, "/audit?table=people&recordId=0", nil)
+	var summaries []AuditEntry
+	decodeBody(t, rec, &summaries)
+	if len(summaries) != 2 || summaries[0].Operation != auditTruncate || summaries[0].After["deleted"] != float64(4) ||
+		summaries[1].Operation != auditBulkCreate || summaries[1].After["created"] != float64(3) {
+		t.Fatalf("unexpected bulk audit entries %+v", summaries)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/audit?table=people&operation=delete&limit=4", nil)
+	var deletes []AuditEntry
+	decodeBody(t, rec, &deletes)
+	if len(deletes) != 4 || deletes[3].RecordID != 3 {
+		t.Fatalf("expected a delete entry per record, Linus's first, got %+v", deletes)
+	}
+	for _, entry := range deletes {
+		if entry.RecordID == 0 || entry.Before[deletedAtColumn] != nil || entry.After[deletedAtColumn] == nil {
+			t.Fatalf("expected trash entries with deleted_at set, got %+v", entry)
+		}
+	}
+
+	// Hard deletes keep the deleted values
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/users/records", map[string]interface{}{"name": "Barbara"}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/users/records?ids=1", nil), http.StatusOK)
+	rec = doRequest(t, h, http.MethodGet, "/audit?table=users&operation=delete", nil)
+	var hard []AuditEntry
+	decodeBody(t, rec, &hard)
+	if len(hard) != 1 || hard[0].RecordID != 1 || hard[0].Before["name"] != "Barbara" || len(hard[0].After) != 1 || hard[0].After["name"] != nil {
+		t.Fatalf("expected the deleted values in the audit entry, got %+v", hard)
+	}
+}
+
+func TestMigrationLog(t *testing.T) {
+	h := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/tables", strings.NewReader(`{"name": "products", "columns": {"name": "TEXT"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, "alice")
+	req.Header.Set(reasonHeader, "product catalog")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusCreated)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/products/records", map[string]interface{}{"name": "Lamp", "price": 12.5}), http.StatusCreated)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/columns?table=products&column=price", nil), http.StatusOK)
+	expectStatus(t, doRequest(t, h, http.MethodDelete, "/tables/products?permanent=true", nil), http.StatusOK)
+
+	rec = doRequest(t, h, http.MethodGet, "/migrations?table=products", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var migrations []Migration
+	decodeBody(t, rec, &migrations)
+	operations := []string{migrationCreateTable, migrationAddColumn, migrationDropColumn, migrationDropTable}
+	if len(migrations) != len(operations) {
+		t.Fatalf("expected %d migrations, got %+v", len(operations), migrations)
+	}
+	for i, operation := range operations {
+		if migrations[i].Operation != operation {
+			t.Fatalf("migration %d: expected %s, got %+v", i, operation, migrations[i])
+		}
+	}
+	if migrations[0].Actor != "alice" || migrations[0].Reason != "product catalog" || !strings.HasPrefix(migrations[0].Up, `CREATE TABLE "products"`) {
+		t.Fatalf("unexpected create migration %+v", migrations[0])
+	}
+	if !strings.Contains(migrations[1].Reason, "price") || !strings.Contains(migrations[1].Down, `DROP COLUMN "price"`) {
+		t.Fatalf("unexpected add column migration %+v", migrations[1])
+	}
+	if !strings.Contains(migrations[2].Down, `ADD COLUMN "price"`) || !strings.Contains(migrations[3].Down, `CREATE TABLE "products"`) {
+		t.Fatalf("expected drops to be reversible, got %+v and %+v", migrations[2], migrations[3])
+	}
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/migrations?operation=explode", nil), http.StatusBadRequest)
+
+	// The down script undoes the newest migration first
+	rec = doRequest(t, h, http.MethodGet, "/migrations/export?format=down&table=products", nil)
+	expectStatus(t, rec, http.StatusOK)
+	down := rec.Body.String()
+	if !strings.HasPrefix(down, fmt.Sprintf("-- Migration %d: drop_table", migrations[3].ID)) || strings.Index(down, "CREATE TABLE") > strings.Index(down, "DROP TABLE") {
+		t.Fatalf("unexpected down script %q", down)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/migrations/export?table=products", nil)
+	expectStatus(t, rec, http.StatusOK)
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	first := fmt.Sprintf("%04d_create_table_products.up.sql", migrations[0].ID)
+	if len(archive.File) != 8 || archive.File[0].Name != first {
+		t.Fatalf("expected 8 files starting with %s, got %d", first, len(archive.File))
+	}
+}
+
+func TestTableExport(t *testing.T) {
+	h := newTestServer(t)
+
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/tables", map[string]interface{}{
+		"name": "quotes", "columns": map[string]string{"author": "TEXT", "text": "TEXT", "year": "INTEGER"},
+	}), http.StatusCreated)
+	for _, row := range []map[string]interface{}{
+		{"author": "Ada", "text": "That brain of mine is \"more\" than merely mortal", "year": 1843},
+		{"author": "Grace", "text": "It's easier to ask forgiveness;\nthan permission", "year": 1986},
+		{"author": "Alan", "text": "We can only see a short distance ahead", "year": 1950},
+	} {
+		expectStatus(t, doRequest(t, h, http.MethodPost, "/tables/quotes/records", row), http.StatusCreated)
+	}
+
+	rec := doRequest(t, h, http.MethodGet, "/tables/quotes/export?format=csv&fields=author,text&sort=-year&filter[year][gt]=1900&delimiter=%3B", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+	expected := "author;text\r\nGrace;\"It's easier to ask forgiveness;\r\nthan permission\"\r\nAlan;We can only see a short distance ahead\r\n"
+	if rec.Body.String() != expected {
+		t.Fatalf("unexpected export %q", rec.Body.String())
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/tables/quotes/export?fields=text&filter[author]=Ada", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "text\r\n\"That brain of mine is \"\"more\"\" than merely mortal\"\r\n" {
+		t.Fatalf("expected quotes to be doubled, got %q", rec.Body.String())
+	}
+
+	// An empty result still has the header row
+	rec = doRequest(t, h, http.MethodGet, "/tables/quotes/export?fields=author,year&filter[year][lt]=0", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "author,year\r\n" {
+		t.Fatalf("unexpected empty export %q", rec.Body.String())
+	}
+
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/quotes/export?format=xlsx", nil), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/quotes/export?delimiter=%22", nil), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/quotes/export?fields=missing", nil), http.StatusBadRequest)
+	expectStatus(t, doRequest(t, h, http.MethodGet, "/tables/nothing/export", nil), http.StatusNotFound)
+
+	// An export spanning several flushes outlives the server's write timeout
+	var rows []map[string]interface{}
+	for i := 0; i < 2*exportFlushRows+1; i++ {
+		rows = append(rows, map[string]interface{}{"author": fmt.Sprintf("author %d", i), "year": i})
+	}
+	expectStatus(t, doRequest(t, h, http.MethodPost, "/records/bulk", map[string]interface{}{"table": "quotes", "records": rows}), http.StatusCreated)
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.WriteTimeout = time.Nanosecond
+	srv.Start()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/tables/quotes/export?fields=author&filter[year][lt]=1800")
+	if err != nil {
+		t.Fatalf("export request: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+	if len(lines) != len(rows)+1 || lines[len(lines)-1] != fmt.Sprintf("author %d", len(rows)-1) {
+		t.Fatalf("expected %d rows and a header, got %d lines", len(rows), len(lines))
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// maxConversionFailures caps the failing rows listed in a conversionReport
+const maxConversionFailures = 20
+
+// errConversionFailed is returned by AlterColumn when existing values can't be cast to the
+// new type; the accompanying conversionReport lists the offending rows
+var errConversionFailed = errors.New("existing values cannot be converted to the new type")
+
+// store is the persistence backend used by every handler. main installs a Postgres
+// store; tests install an in-memory one.
+var store Store
+
+// columnDef is a column to create along with a table
+type columnDef struct {
+	Name string
+	Type string
+}
+
+// tableOptions are the table settings a table is created with
+type tableOptions struct {
+	SchemaMode string // dynamic when empty
+	Timestamps bool
+	SoftDelete bool
+}
+
+// columnChange describes a rename and/or type change of an existing column
+type columnChange struct {
+	NewName string          // empty keeps the current name
+	NewType string          // normalized PostgreSQL type; empty keeps the current type
+	Meta    *ColumnMetadata // catalog entry saved under the final name when non-nil
+}
+
+// conversionFailure is a row whose value can't be cast to a column's new type
+type conversionFailure struct {
+	ID    int64  `json:"id"`
+	Value string `json:"value"`
+	Error string `json:"error"`
+}
+
+// conversionReport summarizes how the existing values of a column convert to a new type
+type conversionReport struct {
+	Rows     int                 `json:"rows"`
+	Failed   int                 `json:"failed"`
+	Failures []conversionFailure `json:"failures,omitempty"`
+}
+
+// Store holds the table, column and record operations the handlers depend on.
+// Implementations must return sql.ErrNoRows from GetRecord when the id doesn't exist or the
+// row is in the trash.
+type Store interface {
+	// Tables
+	TableExists(tableName string) (bool, error)
+	ListTables() ([]string, error)
+
+	// CreateTable creates a table with an id primary key and the versionColumn, followed
+	// by the given columns, and applies the options. Either all of it happens or none.
+	CreateTable(tableName string, columns []columnDef, options tableOptions) error
+	DropTable(tableName string) error
+
+	// RenameTable renames a table together with its id sequence, indexes and catalog
+	// entries. CloneTable creates newName with the same columns, foreign keys, indexes
+	// and catalog entries and, when withData is set, copies the rows matching the query's filters;
+	// it returns the number of rows copied.
+	RenameTable(tableName, newName string) error
+	CloneTable(tableName, newName string, withData bool, q recordQuery) (int64, error)
+
+	// SchemaMode returns how records with unknown fields are handled, dynamic by default
+	SchemaMode(tableName string) (string, error)
+	SetSchemaMode(tableName, mode string) error
+
+	// SystemColumns returns the systemColumns of a table: its row_version, and the
+	// timestamp and deleted_at columns once they have been enabled
+	SystemColumns(tableName string) ([]string, error)
+
+	// AddTimestampColumns enables timestamps: it adds the timestampColumns, filling the
+	// times of existing rows with the current time, and indexes the two times. It
+	// returns the columns it added, none when timestamps were already enabled, and fails
+	// like ADD COLUMN when the table has an ordinary column of the same name.
+	AddTimestampColumns(tableName string) ([]string, error)
+
+	// EnableSoftDelete adds the deletedAtColumn, and an index on it, unless soft delete is
+	// already enabled; it reports whether the column was added, and fails like ADD COLUMN
+	// when the table has an ordinary deleted_at column. From then on the record
+	// methods skip soft-deleted rows, DeleteRecord and DeleteRecords set deleted_at
+	// instead of removing rows, and ListRecords returns the trash when q.Trashed is set.
+	EnableSoftDelete(tableName string) (bool, error)
+
+	// ArchiveTable moves a table and its catalog entries into the archive schema under an
+	// archiveTableName instead of dropping it. RestoreTable moves it back as newName and
+	// PurgeTable drops it for good.
+	ArchiveTable(tableName string) (ArchivedTable, error)
+	ArchivedTables() ([]ArchivedTable, error)
+	RestoreTable(archiveName, newName string) error
+	PurgeTable(archiveName string) error
+
+	// TableSchema describes the table's columns, constraints, indexes and approximate size
+	TableSchema(tableName string) (TableSchema, error)
+
+	// CreateIndex builds the index and returns it as read back from the catalog. A unique
+	// index that fails on existing rows returns a *duplicateValuesError.
+	CreateIndex(tableName string, spec indexSpec) (IndexSchema, error)
+	// DropIndex drops the index, or the constraint it backs
+	DropIndex(tableName, indexName string, concurrently bool) error
+
+	// Columns. AddColumn records meta in the column catalog when it is non-nil;
+	// DropColumn removes the column together with its catalog entry.
+	Columns(tableName string) ([]string, error)
+	ColumnMetadata(tableName string) ([]ColumnMetadata, error)
+	AddColumn(tableName, columnName, columnType string, meta *ColumnMetadata) error
+	DropColumn(tableName, columnName string) error
+
+	// AlterColumn renames and/or retypes a column in one transaction, casting existing
+	// values with USING. A dry run only reports how the values would convert; otherwise
+	// any failing value aborts the change with errConversionFailed.
+	AlterColumn(tableName, columnName string, change columnChange, dryRun bool) (conversionReport, error)
+
+	// Records
+	ListRecords(tableName string, q recordQuery) ([]Record, int, error)
+	// StreamRecords visits the rows ListRecords would return, one at a time and in order,
+	// stopping at the first error visit returns
+	StreamRecords(tableName string, q recordQuery, visit func(Record) error) error
+	GetRecord(tableName string, id int) (Record, error)
+	InsertRecord(tableName string, recordData Record) (int, error)
+	InsertRecords(tableName string, rows []Record, results []bulkRowResult, atomic bool) (bool, error)
+
+	// UpdateRecord and DeleteRecord return the row as it is after the update, or as it was
+	// before the delete, and sql.ErrNoRows when no row has the id. A non-zero version
+	// makes the write conditional: errPreconditionFailed when the row has another version.
+	// DeleteRecords returns every row it deleted the same way.
+	UpdateRecord(tableName string, id int, recordData Record, version int64) (Record, error)
+	DeleteRecord(tableName string, id int, version int64) (Record, error)
+	DeleteRecords(tableName string, ids []int, q recordQuery) ([]Record, error)
+
+	// RestoreRecord takes a soft-deleted row out of the trash, returning sql.ErrNoRows when
+	// no trashed row has the id. PurgeRecords removes the rows trashed before the given
+	// time for good and returns how many there were.
+	RestoreRecord(tableName string, id int) (Record, error)
+	PurgeRecords(tableName string, before time.Time) (int64, error)
+	TruncateTable(tableName string, restartIdentity bool) (int64, error)
+
+	// ValueTaken reports whether a live row other than excludeID holds value in the column
+	ValueTaken(tableName, columnName string, value interface{}, excludeID int) (bool, error)
+
+	// Audit log. RecordAudit assigns the entry its id; AuditEntries returns one page of
+	// the matching entries, newest first, with the total number of matches. Entries follow
+	// their table through renames and stay after it is dropped.
+	RecordAudit(entry AuditEntry) error
+	AuditEntries(q auditQuery) ([]AuditEntry, int, error)
+
+	// Migration log. RecordMigration assigns the migration its id; Migrations returns one
+	// page of the matching migrations, oldest first, with the total number of matches.
+	// Unlike audit entries, migrations keep the table name they were recorded under.
+	RecordMigration(migration Migration) error
+	Migrations(q migrationQuery) ([]Migration, int, error)
+}
@@ -0,0 +1,1822 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// varcharPattern extracts the length limit of VARCHAR(n) and CHAR(n) columns
+var varcharPattern = regexp.MustCompile(`^(?:VARCHAR|CHAR)\((\d+)\)$`)
+
+type memoryColumn struct {
+	name    string
+	sqlType string
+	link    *ColumnLink
+}
+
+type memoryIndex struct {
+	name    string
+	columns []string
+	unique  bool
+	method  string
+	where   []filterClause
+}
+
+type memoryTable struct {
+	columns []memoryColumn
+	indexes []memoryIndex
+	rows    map[int64]Record
+	nextID  int64
+
+	// timestamps and softDelete record the features enabled on the table, which the
+	// Postgres store keeps in table_settings
+	timestamps bool
+	softDelete bool
+}
+
+// memoryStore implements Store in process memory. It mirrors the behaviour of the
+// Postgres store closely enough for handler tests and for running without a database.
+type memoryStore struct {
+	mu         sync.RWMutex
+	tables     map[string]*memoryTable
+	metadata   map[string]map[string]ColumnMetadata
+	modes      map[string]string
+	archived   map[string]memoryArchive
+	audit      []AuditEntry
+	migrations []Migration
+}
+
+// memoryArchive is a dropped table kept for the trash. Its catalog entries stay in
+// metadata and modes under the archive name, as they do in the Postgres catalog.
+type memoryArchive struct {
+	table *memoryTable
+	info  ArchivedTable
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tables:   make(map[string]*memoryTable),
+		metadata: make(map[string]map[string]ColumnMetadata),
+		modes:    make(map[string]string),
+		archived: make(map[string]memoryArchive),
+	}
+}
+
+func (m *memoryStore) table(tableName string) (*memoryTable, error) {
+	table, ok := m.tables[tableName]
+	if !ok {
+		return nil, &pq.Error{Code: "42P01", Message: fmt.Sprintf("relation \"%s\" does not exist", tableName)}
+	}
+	return table, nil
+}
+
+func (t *memoryTable) column(columnName string) (memoryColumn, bool) {
+	for _, col := range t.columns {
+		if col.name == columnName {
+			return col, true
+		}
+	}
+	return memoryColumn{}, false
+}
+
+func (t *memoryTable) columnNames() []string {
+	names := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// systemColumns returns the columns of the table maintained by the server
+func (t *memoryTable) systemColumns() []string {
+	return systemColumns(t.columnNames(), t.timestamps, t.softDelete)
+}
+
+// softDeletes reports whether deleting a row moves it to the trash
+func (t *memoryTable) softDeletes() bool {
+	return t.softDelete
+}
+
+// live reports whether a row is outside the trash
+func (t *memoryTable) live(row Record) bool {
+	return !t.softDeletes() || row[deletedAtColumn] == nil
+}
+
+func (t *memoryTable) clone() *memoryTable {
+	copied := &memoryTable{
+		columns: append([]memoryColumn(nil), t.columns...),
+		indexes: append([]memoryIndex(nil), t.indexes...),
+		rows:    make(map[int64]Record, len(t.rows)),
+		nextID:  t.nextID,
+
+		timestamps: t.timestamps,
+		softDelete: t.softDelete,
+	}
+	for id, row := range t.rows {
+		copied.rows[id] = row
+	}
+	return copied
+}
+
+func (m *memoryStore) TableExists(tableName string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.tables[tableName]
+	return ok, nil
+}
+
+func (m *memoryStore) ListTables() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tables := make([]string, 0, len(m.tables))
+	for name := range m.tables {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+func (m *memoryStore) CreateTable(tableName string, columns []columnDef, options tableOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tables[tableName]; ok {
+		return &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", tableName)}
+	}
+	table := &memoryTable{
+		columns: []memoryColumn{{name: "id", sqlType: "SERIAL"}, {name: versionColumn, sqlType: "INTEGER"}},
+		rows:    make(map[int64]Record),
+		nextID:  1,
+	}
+	for _, col := range columns {
+		if _, exists := table.column(col.Name); exists {
+			return &pq.Error{Code: "42701", Message: fmt.Sprintf("column \"%s\" specified more than once", col.Name)}
+		}
+		table.columns = append(table.columns, memoryColumn{name: col.Name, sqlType: col.Type})
+	}
+	// The table is only registered once every option has been applied
+	if options.Timestamps {
+		if _, err := m.enableTimestamps(table, tableName); err != nil {
+			return err
+		}
+	}
+	if options.SoftDelete {
+		if err := m.enableSoftDelete(table, tableName); err != nil {
+			return err
+		}
+	}
+	m.tables[tableName] = table
+	if options.SchemaMode != "" && options.SchemaMode != schemaModeDynamic {
+		m.modes[tableName] = options.SchemaMode
+	}
+	return nil
+}
+
+func (m *memoryStore) DropTable(tableName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkDependents(tableName); err != nil {
+		return err
+	}
+	delete(m.tables, tableName)
+	delete(m.metadata, tableName)
+	delete(m.modes, tableName)
+	return nil
+}
+
+// checkDependents fails like DROP TABLE when link columns of other tables point at tableName
+func (m *memoryStore) checkDependents(tableName string) error {
+	for _, ref := range m.references(tableName) {
+		if ref.table != tableName {
+			return &pq.Error{Code: "2BP01", Message: fmt.Sprintf("cannot drop table %s because other objects depend on it", tableName),
+				Detail: fmt.Sprintf("constraint %s_%s_fkey on table %s depends on table %s", ref.table, ref.column, ref.table, tableName)}
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ArchiveTable(tableName string) (ArchivedTable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return ArchivedTable{}, err
+	}
+	if err := m.checkDependents(tableName); err != nil {
+		return ArchivedTable{}, err
+	}
+
+	droppedAt := time.Now().UTC()
+	info := ArchivedTable{Name: archiveTableName(tableName, droppedAt), Table: tableName, DroppedAt: droppedAt}
+	if _, exists := m.archived[info.Name]; exists {
+		return ArchivedTable{}, &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", info.Name)}
+	}
+	m.archived[info.Name] = memoryArchive{table: table, info: info}
+	delete(m.tables, tableName)
+	m.moveCatalog(tableName, info.Name)
+	return info, nil
+}
+
+func (m *memoryStore) ArchivedTables() ([]ArchivedTable, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	archived := make([]ArchivedTable, 0, len(m.archived))
+	for _, archive := range m.archived {
+		archived = append(archived, archive.info)
+	}
+	sort.Slice(archived, func(i, j int) bool { return archived[i].DroppedAt.After(archived[j].DroppedAt) })
+	return archived, nil
+}
+
+func (m *memoryStore) RestoreTable(archiveName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	archive, ok := m.archived[archiveName]
+	if !ok {
+		return &pq.Error{Code: "42P01", Message: fmt.Sprintf("relation \"%s.%s\" does not exist", archiveSchema, archiveName)}
+	}
+	if _, exists := m.tables[newName]; exists {
+		return &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", newName)}
+	}
+	table := archive.table
+	for i, index := range table.indexes {
+		if strings.HasPrefix(index.name, archive.info.Table+"_") {
+			table.indexes[i].name = newName + strings.TrimPrefix(index.name, archive.info.Table)
+		}
+	}
+	m.tables[newName] = table
+	delete(m.archived, archiveName)
+	m.moveCatalog(archiveName, newName)
+	return nil
+}
+
+func (m *memoryStore) PurgeTable(archiveName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.archived[archiveName]; !ok {
+		return &pq.Error{Code: "42P01", Message: fmt.Sprintf("relation \"%s.%s\" does not exist", archiveSchema, archiveName)}
+	}
+	delete(m.archived, archiveName)
+	delete(m.metadata, archiveName)
+	delete(m.modes, archiveName)
+	return nil
+}
+
+// moveCatalog files a table's column metadata, schema mode and audit entries under
+// another name
+func (m *memoryStore) moveCatalog(tableName, newName string) {
+	for i := range m.audit {
+		if m.audit[i].Table == tableName {
+			m.audit[i].Table = newName
+		}
+	}
+	if metadata, ok := m.metadata[tableName]; ok {
+		m.metadata[newName] = metadata
+		delete(m.metadata, tableName)
+	}
+	if mode, ok := m.modes[tableName]; ok {
+		m.modes[newName] = mode
+		delete(m.modes, tableName)
+	}
+}
+
+func (m *memoryStore) RenameTable(tableName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return err
+	}
+	if _, exists := m.tables[newName]; exists {
+		return &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", newName)}
+	}
+	m.tables[newName] = table
+	delete(m.tables, tableName)
+	for _, other := range m.tables {
+		for i, col := range other.columns {
+			if col.link != nil && col.link.Table == tableName {
+				link := *col.link
+				link.Table = newName
+				other.columns[i].link = &link
+			}
+		}
+	}
+	for i, index := range table.indexes {
+		if strings.HasPrefix(index.name, tableName+"_") {
+			table.indexes[i].name = newName + strings.TrimPrefix(index.name, tableName)
+		}
+	}
+	m.moveCatalog(tableName, newName)
+	return nil
+}
+
+func (m *memoryStore) CloneTable(tableName, newName string, withData bool, q recordQuery) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	if _, exists := m.tables[newName]; exists {
+		return 0, &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", newName)}
+	}
+
+	clone := &memoryTable{
+		columns: append([]memoryColumn(nil), table.columns...),
+		rows:    make(map[int64]Record),
+		nextID:  1,
+
+		timestamps: table.timestamps,
+		softDelete: table.softDelete,
+	}
+	for i, col := range clone.columns {
+		if col.link != nil {
+			link := *col.link
+			clone.columns[i].link = &link
+		}
+	}
+	for _, index := range table.indexes {
+		index.name = defaultIndexName(newName, index.columns, index.unique)
+		clone.indexes = append(clone.indexes, index)
+	}
+	if withData {
+		matched, err := table.matchingRows(q.scoped(table.systemColumns()))
+		if err != nil {
+			return 0, err
+		}
+		for _, row := range matched {
+			copied := make(Record, len(row))
+			for key, value := range row {
+				copied[key] = value
+			}
+			id := row["id"].(int64)
+			clone.rows[id] = copied
+			if id >= clone.nextID {
+				clone.nextID = id + 1
+			}
+		}
+	}
+	m.tables[newName] = clone
+
+	if metadata, ok := m.metadata[tableName]; ok {
+		m.metadata[newName] = make(map[string]ColumnMetadata, len(metadata))
+		for key, meta := range metadata {
+			m.metadata[newName][key] = meta
+		}
+	}
+	if mode, ok := m.modes[tableName]; ok {
+		m.modes[newName] = mode
+	}
+	return int64(len(clone.rows)), nil
+}
+
+func (m *memoryStore) SchemaMode(tableName string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if mode, ok := m.modes[tableName]; ok {
+		return mode, nil
+	}
+	return schemaModeDynamic, nil
+}
+
+func (m *memoryStore) SetSchemaMode(tableName, mode string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.table(tableName); err != nil {
+		return err
+	}
+	m.modes[tableName] = mode
+	return nil
+}
+
+func (m *memoryStore) TableSchema(tableName string) (TableSchema, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return TableSchema{}, err
+	}
+
+	schema := TableSchema{Name: tableName, Columns: []ColumnSchema{}, RowEstimate: int64(len(table.rows))}
+	for i, col := range table.columns {
+		column := ColumnSchema{
+			Name:     col.name,
+			Type:     memoryFormatType(col.sqlType),
+			DataType: memoryDataType(col.sqlType),
+			Nullable: col.name != "id",
+			Position: i + 1,
+		}
+		for _, index := range table.indexes {
+			if index.unique && len(index.where) == 0 && len(index.columns) == 1 && index.columns[0] == col.name {
+				column.Unique = true
+			}
+		}
+		if col.link != nil {
+			column.ForeignKey = &ForeignKeySchema{Constraint: tableName + "_" + col.name + "_fkey", Table: col.link.Table, Column: "id", OnDelete: col.link.OnDelete}
+		}
+		if col.name == "id" {
+			seqDefault := fmt.Sprintf("nextval('%s_id_seq'::regclass)", tableName)
+			column.Default = &seqDefault
+			column.PrimaryKey = true
+			column.Unique = true
+		}
+		schema.Columns = append(schema.Columns, column)
+	}
+	schema.Indexes = []IndexSchema{{
+		Name:       tableName + "_pkey",
+		Columns:    []string{"id"},
+		Unique:     true,
+		Primary:    true,
+		Method:     "btree",
+		Definition: fmt.Sprintf("CREATE UNIQUE INDEX %s_pkey ON public.%s USING btree (id)", tableName, tableName),
+	}}
+	for _, index := range table.indexes {
+		schema.Indexes = append(schema.Indexes, table.indexSchema(tableName, index))
+	}
+	return schema, nil
+}
+
+func (t *memoryTable) indexSchema(tableName string, index memoryIndex) IndexSchema {
+	keys := make([]string, len(index.columns))
+	columns := append([]string(nil), index.columns...)
+	for i, name := range index.columns {
+		col, _ := t.column(name)
+		keys[i], _ = indexKey(ColumnSchema{Name: name, DataType: memoryDataType(col.sqlType)}, index.method)
+		if index.method == "gin" {
+			columns[i] = keys[i]
+		}
+	}
+	spec := indexSpec{Name: index.name, Unique: index.unique, Method: index.method, Where: index.where}
+	return IndexSchema{
+		Name:       index.name,
+		Columns:    columns,
+		Unique:     index.unique,
+		Method:     index.method,
+		Predicate:  indexPredicate(index.where),
+		Definition: strings.Replace(createIndexStatement(tableName, spec, keys), "ON ", "ON public.", 1),
+	}
+}
+
+func (m *memoryStore) CreateIndex(tableName string, spec indexSpec) (IndexSchema, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return IndexSchema{}, err
+	}
+	for name, other := range m.tables {
+		taken := name == spec.Name
+		for _, index := range other.indexes {
+			taken = taken || index.name == spec.Name
+		}
+		if taken || spec.Name == name+"_pkey" {
+			return IndexSchema{}, &pq.Error{Code: "42P07", Message: fmt.Sprintf("relation \"%s\" already exists", spec.Name)}
+		}
+	}
+	for _, name := range spec.Columns {
+		if _, ok := table.column(name); !ok {
+			return IndexSchema{}, &pq.Error{Code: "42703", Message: fmt.Sprintf("column \"%s\" does not exist", name)}
+		}
+	}
+
+	index := memoryIndex{name: spec.Name, columns: spec.Columns, unique: spec.Unique, method: spec.Method, where: spec.Where}
+	if index.unique {
+		conflicts, err := table.indexConflicts(index)
+		if err != nil {
+			return IndexSchema{}, err
+		}
+		if len(conflicts) > 0 {
+			return IndexSchema{}, &duplicateValuesError{Index: spec.Name, Conflicts: conflicts}
+		}
+	}
+	table.indexes = append(table.indexes, index)
+	return table.indexSchema(tableName, index), nil
+}
+
+func (m *memoryStore) DropIndex(tableName, indexName string, concurrently bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return err
+	}
+	for i, index := range table.indexes {
+		if index.name == indexName {
+			table.indexes = append(table.indexes[:i:i], table.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return &pq.Error{Code: "42704", Message: fmt.Sprintf("index \"%s\" does not exist", indexName)}
+}
+
+// indexConflicts groups the rows that would violate a unique index, ignoring rows with
+// a NULL in any index column and rows outside a partial index
+func (t *memoryTable) indexConflicts(index memoryIndex) ([]indexConflict, error) {
+	rows, err := t.matchingRows(recordQuery{Filters: index.where})
+	if err != nil {
+		return nil, err
+	}
+	t.sortRows(rows, nil)
+
+	groups := make(map[string]*indexConflict)
+	var order []string
+	for _, row := range rows {
+		key, covered, err := t.indexKeyOf(index, row)
+		if err != nil {
+			return nil, err
+		}
+		if !covered {
+			continue
+		}
+		group, ok := groups[key]
+		if !ok {
+			values := make(map[string]interface{}, len(index.columns))
+			for _, name := range index.columns {
+				values[name] = row[name]
+			}
+			group = &indexConflict{Values: values}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.Count++
+		if len(group.IDs) < maxIndexConflicts {
+			group.IDs = append(group.IDs, row["id"].(int64))
+		}
+	}
+
+	var conflicts []indexConflict
+	for _, key := range order {
+		if groups[key].Count > 1 && len(conflicts) < maxIndexConflicts {
+			conflicts = append(conflicts, *groups[key])
+		}
+	}
+	return conflicts, nil
+}
+
+// indexKeyOf returns the text key a row has in an index, and whether the index covers it
+func (t *memoryTable) indexKeyOf(index memoryIndex, row Record) (string, bool, error) {
+	if ok, err := t.matches(row, index.where); err != nil || !ok {
+		return "", false, err
+	}
+	parts := make([]string, len(index.columns))
+	for i, name := range index.columns {
+		if row[name] == nil {
+			return "", false, nil
+		}
+		col, _ := t.column(name)
+		parts[i] = memoryText(col, row[name])
+	}
+	return strings.Join(parts, "\x00"), true, nil
+}
+
+// checkUnique reports a unique violation when row collides with another row in any
+// unique index
+func (t *memoryTable) checkUnique(row Record, id int64) error {
+	for _, index := range t.indexes {
+		if !index.unique {
+			continue
+		}
+		key, covered, err := t.indexKeyOf(index, row)
+		if err != nil {
+			return err
+		}
+		if !covered {
+			continue
+		}
+		for otherID, other := range t.rows {
+			if otherID == id {
+				continue
+			}
+			if otherKey, ok, _ := t.indexKeyOf(index, other); ok && otherKey == key {
+				return &pq.Error{
+					Code:       "23505",
+					Message:    fmt.Sprintf("duplicate key value violates unique constraint \"%s\"", index.name),
+					Detail:     fmt.Sprintf("Key (%s)=(%s) already exists.", strings.Join(index.columns, ", "), strings.ReplaceAll(key, "\x00", ", ")),
+					Constraint: index.name,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dropIndexesOn removes the indexes that use a column, as DROP COLUMN does
+func (t *memoryTable) dropIndexesOn(columnName string) {
+	kept := t.indexes[:0:0]
+	for _, index := range t.indexes {
+		uses := false
+		for _, name := range index.columns {
+			uses = uses || name == columnName
+		}
+		for _, filter := range index.where {
+			uses = uses || filter.Column == columnName
+		}
+		if !uses {
+			kept = append(kept, index)
+		}
+	}
+	t.indexes = kept
+}
+
+// renameIndexColumn points the indexes that use a column at its new name
+func (t *memoryTable) renameIndexColumn(columnName, newName string) {
+	for i, index := range t.indexes {
+		columns := append([]string(nil), index.columns...)
+		for j, name := range columns {
+			if name == columnName {
+				columns[j] = newName
+			}
+		}
+		where := append([]filterClause(nil), index.where...)
+		for j, filter := range where {
+			if filter.Column == columnName {
+				where[j].Column = newName
+			}
+		}
+		t.indexes[i].columns = columns
+		t.indexes[i].where = where
+	}
+}
+
+func (m *memoryStore) Columns(tableName string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, ok := m.tables[tableName]
+	if !ok {
+		return nil, nil
+	}
+	columns := make([]string, len(table.columns))
+	for i, col := range table.columns {
+		columns[i] = col.name
+	}
+	return columns, nil
+}
+
+func (m *memoryStore) ColumnMetadata(tableName string) ([]ColumnMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, ok := m.tables[tableName]
+	if !ok {
+		return nil, nil
+	}
+
+	system := table.systemColumns()
+	metadata := make([]ColumnMetadata, 0, len(table.columns))
+	for i, col := range table.columns {
+		meta, ok := m.metadata[tableName][col.name]
+		if !ok {
+			meta = inferredColumnMetadata(col.name, memoryDataType(col.sqlType), i+1, system)
+			if col.link != nil {
+				meta.Type = semanticLink
+			}
+		}
+		meta.declared = ok || col.link != nil
+		meta.Link = col.link
+		metadata = append(metadata, meta)
+	}
+	sort.SliceStable(metadata, func(i, j int) bool { return metadata[i].Position < metadata[j].Position })
+	return metadata, nil
+}
+
+func (m *memoryStore) AddColumn(tableName, columnName, columnType string, meta *ColumnMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return err
+	}
+	if meta != nil && meta.Link != nil {
+		if _, err := m.table(meta.Link.Table); err != nil {
+			return err
+		}
+	}
+	if err := m.addColumn(table, tableName, columnName, columnType); err != nil {
+		return err
+	}
+	if meta != nil && meta.Link != nil {
+		link := *meta.Link
+		table.columns[len(table.columns)-1].link = &link
+		table.indexes = append(table.indexes, memoryIndex{name: defaultIndexName(tableName, []string{columnName}, false), columns: []string{columnName}, method: "btree"})
+	}
+	if meta != nil {
+		if m.metadata[tableName] == nil {
+			m.metadata[tableName] = make(map[string]ColumnMetadata)
+		}
+		stored := *meta
+		stored.compilePattern()
+		m.metadata[tableName][columnName] = stored
+	}
+	return nil
+}
+
+func (m *memoryStore) SystemColumns(tableName string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	return table.systemColumns(), nil
+}
+
+func (m *memoryStore) AddTimestampColumns(tableName string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if table.timestamps {
+		return nil, nil
+	}
+	return m.enableTimestamps(table, tableName)
+}
+
+// enableTimestamps adds the timestampColumns to a table that doesn't have them yet
+func (m *memoryStore) enableTimestamps(table *memoryTable, tableName string) ([]string, error) {
+	for _, col := range timestampColumns {
+		if _, exists := table.column(col.Name); exists {
+			return nil, &pq.Error{Code: "42701", Message: fmt.Sprintf("column \"%s\" of relation \"%s\" already exists", col.Name, tableName)}
+		}
+	}
+
+	now := time.Now().UTC()
+	var added []string
+	for _, col := range timestampColumns {
+		if err := m.addColumn(table, tableName, col.Name, col.Type); err != nil {
+			return nil, err
+		}
+		if col.Name == createdAtColumn || col.Name == updatedAtColumn {
+			for _, row := range table.rows {
+				row[col.Name] = now
+			}
+			table.indexes = append(table.indexes, memoryIndex{name: defaultIndexName(tableName, []string{col.Name}, false), columns: []string{col.Name}, method: "btree"})
+		}
+		added = append(added, col.Name)
+	}
+	table.timestamps = true
+	return added, nil
+}
+
+func (m *memoryStore) EnableSoftDelete(tableName string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return false, err
+	}
+	if table.softDeletes() {
+		return false, nil
+	}
+	if err := m.enableSoftDelete(table, tableName); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// enableSoftDelete adds the deletedAtColumn to a table that doesn't have it yet
+func (m *memoryStore) enableSoftDelete(table *memoryTable, tableName string) error {
+	if err := m.addColumn(table, tableName, deletedAtColumn, "TIMESTAMPTZ"); err != nil {
+		return err
+	}
+	table.indexes = append(table.indexes, memoryIndex{name: defaultIndexName(tableName, []string{deletedAtColumn}, false), columns: []string{deletedAtColumn}, method: "btree"})
+	table.softDelete = true
+	return nil
+}
+
+func (m *memoryStore) addColumn(table *memoryTable, tableName, columnName, columnType string) error {
+	if _, exists := table.column(columnName); exists {
+		return &pq.Error{Code: "42701", Message: fmt.Sprintf("column \"%s\" of relation \"%s\" already exists", columnName, tableName)}
+	}
+	table.columns = append(table.columns, memoryColumn{name: columnName, sqlType: columnType})
+	return nil
+}
+
+func (m *memoryStore) DropColumn(tableName, columnName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return err
+	}
+	for i, col := range table.columns {
+		if col.name != columnName {
+			continue
+		}
+		table.columns = append(table.columns[:i:i], table.columns[i+1:]...)
+		for _, row := range table.rows {
+			delete(row, columnName)
+		}
+		table.dropIndexesOn(columnName)
+		delete(m.metadata[tableName], columnName)
+		return nil
+	}
+	return &pq.Error{Code: "42703", Message: fmt.Sprintf("column \"%s\" of relation \"%s\" does not exist", columnName, tableName)}
+}
+
+func (m *memoryStore) AlterColumn(tableName, columnName string, change columnChange, dryRun bool) (conversionReport, error) {
+	var report conversionReport
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return report, err
+	}
+	index := -1
+	for i, col := range table.columns {
+		if col.name == columnName {
+			index = i
+		}
+	}
+	if index < 0 {
+		return report, &pq.Error{Code: "42703", Message: fmt.Sprintf("column \"%s\" of relation \"%s\" does not exist", columnName, tableName)}
+	}
+
+	converted := make(map[int64]interface{})
+	if change.NewType != "" {
+		ids := make([]int64, 0, len(table.rows))
+		for id := range table.rows {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		newColumn := memoryColumn{name: columnName, sqlType: change.NewType}
+		for _, id := range ids {
+			value := table.rows[id][columnName]
+			if value == nil {
+				continue
+			}
+			report.Rows++
+			coerced, err := coerceMemoryValue(newColumn, value)
+			if err != nil {
+				report.Failed++
+				if len(report.Failures) < maxConversionFailures {
+					message := err.Error()
+					if pqErr, ok := err.(*pq.Error); ok {
+						message = pqErr.Message
+					}
+					report.Failures = append(report.Failures, conversionFailure{ID: id, Value: memoryText(table.columns[index], value), Error: message})
+				}
+				continue
+			}
+			converted[id] = coerced
+		}
+		if dryRun {
+			return report, nil
+		}
+		if report.Failed > 0 {
+			return report, errConversionFailed
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	finalName := columnName
+	if change.NewName != "" {
+		finalName = change.NewName
+	}
+	if finalName != columnName {
+		if _, exists := table.column(finalName); exists {
+			return report, &pq.Error{Code: "42701", Message: fmt.Sprintf("column \"%s\" of relation \"%s\" already exists", finalName, tableName)}
+		}
+	}
+
+	if change.NewType != "" {
+		table.columns[index].sqlType = change.NewType
+		for id, value := range converted {
+			table.rows[id][columnName] = value
+		}
+	}
+	if finalName != columnName {
+		table.columns[index].name = finalName
+		table.renameIndexColumn(columnName, finalName)
+		for _, row := range table.rows {
+			if value, ok := row[columnName]; ok {
+				row[finalName] = value
+				delete(row, columnName)
+			}
+		}
+		if meta, ok := m.metadata[tableName][columnName]; ok {
+			meta.Key = finalName
+			m.metadata[tableName][finalName] = meta
+			delete(m.metadata[tableName], columnName)
+		}
+	}
+
+	if change.Meta != nil {
+		meta := *change.Meta
+		meta.Key = finalName
+		meta.compilePattern()
+		if m.metadata[tableName] == nil {
+			m.metadata[tableName] = make(map[string]ColumnMetadata)
+		}
+		m.metadata[tableName][finalName] = meta
+	}
+	return report, nil
+}
+
+func (m *memoryStore) ListRecords(tableName string, q recordQuery) ([]Record, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return table.page(q)
+}
+
+// StreamRecords hands the rows of the page to visit one by one. The store is locked for
+// reading until the last row has been visited.
+func (m *memoryStore) StreamRecords(tableName string, q recordQuery, visit func(Record) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return err
+	}
+	records, _, err := table.page(q)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := visit(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// page applies a listing query: the matching rows, sorted, paged and with the selected
+// fields, along with the number of matches ignoring the paging
+func (t *memoryTable) page(q recordQuery) ([]Record, int, error) {
+	matched, err := t.matchingRows(q.scoped(t.systemColumns()))
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(matched)
+	t.sortRows(matched, q.Sort)
+
+	if q.After != nil {
+		after := int64(*q.After)
+		var page []Record
+		for _, row := range matched {
+			id := row["id"].(int64)
+			if (q.descendingByID() && id < after) || (!q.descendingByID() && id > after) {
+				page = append(page, row)
+			}
+		}
+		matched = page
+	}
+	if q.Offset > 0 {
+		if q.Offset >= len(matched) {
+			matched = nil
+		} else {
+			matched = matched[q.Offset:]
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	records := make([]Record, len(matched))
+	for i, row := range matched {
+		if len(q.Fields) == 0 {
+			records[i] = t.output(row)
+			continue
+		}
+		records[i] = make(Record, len(q.Fields))
+		for _, field := range q.Fields {
+			records[i][field] = row[field]
+		}
+	}
+	return records, total, nil
+}
+
+func (m *memoryStore) GetRecord(tableName string, id int) (Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	row, ok := table.rows[int64(id)]
+	if !ok || !table.live(row) {
+		return nil, sql.ErrNoRows
+	}
+	return table.output(row), nil
+}
+
+func (m *memoryStore) InsertRecord(tableName string, recordData Record) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	id, err := table.insert(recordData, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.checkLinks(tableName, table, table.rows[id]); err != nil {
+		delete(table.rows, id)
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// insert coerces the fields of recordData that match columns and stores them as a new
+// row. keyColumns maps record keys to column names; nil means keys are column names.
+func (t *memoryTable) insert(recordData Record, keyColumns map[string]string) (int64, error) {
+	row := make(Record)
+	for key, value := range recordData {
+		columnName := key
+		if keyColumns != nil {
+			mapped, ok := keyColumns[key]
+			if !ok {
+				continue
+			}
+			columnName = mapped
+		}
+		col, ok := t.column(columnName)
+		if !ok || columnName == "id" || columnName == versionColumn {
+			continue
+		}
+		coerced, err := coerceMemoryValue(col, value)
+		if err != nil {
+			return 0, err
+		}
+		row[columnName] = coerced
+	}
+	if len(row) == 0 {
+		return 0, errNoFields
+	}
+	if err := t.checkUnique(row, 0); err != nil {
+		return 0, err
+	}
+
+	id := t.nextID
+	t.nextID++
+	row["id"] = id
+	if _, ok := t.column(versionColumn); ok {
+		row[versionColumn] = int64(1)
+	}
+	t.rows[id] = row
+	return id, nil
+}
+
+func (m *memoryStore) InsertRecords(tableName string, rows []Record, results []bulkRowResult, atomic bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	original, err := m.table(tableName)
+	if err != nil {
+		return false, err
+	}
+	table := original.clone()
+
+	existing := make([]string, len(table.columns))
+	for i, col := range table.columns {
+		existing[i] = col.name
+	}
+	keyColumns, _, newColumns, err := planBulkColumns(rows, results, existing)
+	if err != nil {
+		return false, err
+	}
+	for _, col := range newColumns {
+		if err := m.addColumn(table, tableName, col.Name, col.Type); err != nil {
+			return false, err
+		}
+	}
+
+	for _, index := range pendingBulkRows(rows, results, keyColumns) {
+		id, err := table.insert(rows[index], keyColumns)
+		if err == nil {
+			if err = m.checkLinks(tableName, table, table.rows[id]); err != nil {
+				delete(table.rows, id)
+			}
+		}
+		if err != nil {
+			results[index].Errors = []FieldError{{Code: codeInsertFailed, Message: err.Error()}}
+			continue
+		}
+		results[index].ID = int(id)
+	}
+
+	if atomic && bulkHasErrors(results) {
+		return false, nil
+	}
+	m.tables[tableName] = table
+	return true, nil
+}
+
+func (m *memoryStore) UpdateRecord(tableName string, id int, recordData Record, version int64) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(Record)
+	for key, value := range recordData {
+		col, ok := table.column(key)
+		if !ok || key == "id" || key == versionColumn {
+			continue
+		}
+		coerced, err := coerceMemoryValue(col, value)
+		if err != nil {
+			return nil, err
+		}
+		updates[key] = coerced
+	}
+	if len(updates) == 0 {
+		return nil, errNoFields
+	}
+
+	row, ok := table.rows[int64(id)]
+	if !ok || !table.live(row) {
+		return nil, sql.ErrNoRows
+	}
+	if err := table.checkVersion(row, version); err != nil {
+		return nil, err
+	}
+	updated := make(Record, len(row))
+	for key, value := range row {
+		updated[key] = value
+	}
+	for key, value := range updates {
+		updated[key] = value
+	}
+	if current, ok := updated[versionColumn].(int64); ok {
+		updated[versionColumn] = current + 1
+	}
+	if err := table.checkUnique(updated, int64(id)); err != nil {
+		return nil, err
+	}
+	if err := m.checkLinks(tableName, table, updated); err != nil {
+		return nil, err
+	}
+	table.rows[int64(id)] = updated
+	return table.output(updated), nil
+}
+
+func (m *memoryStore) DeleteRecord(tableName string, id int, version int64) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	row, ok := table.rows[int64(id)]
+	if !ok || !table.live(row) {
+		return nil, sql.ErrNoRows
+	}
+	if err := table.checkVersion(row, version); err != nil {
+		return nil, err
+	}
+	if table.softDeletes() {
+		trashed := table.withDeletedAt(row, time.Now().UTC())
+		table.rows[int64(id)] = trashed
+		return table.output(trashed), nil
+	}
+	deleted := table.output(row)
+	if err := m.deleteRows(tableName, []int64{int64(id)}); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (m *memoryStore) DeleteRecords(tableName string, ids []int, q recordQuery) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := table.matchingRows(q.scoped(table.systemColumns()))
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		wanted[int64(id)] = true
+	}
+
+	var doomed []int64
+	deleted := []Record{}
+	for _, row := range matched {
+		id := row["id"].(int64)
+		if len(ids) > 0 && !wanted[id] {
+			continue
+		}
+		doomed = append(doomed, id)
+	}
+	if table.softDeletes() {
+		now := time.Now().UTC()
+		for _, id := range doomed {
+			table.rows[id] = table.withDeletedAt(table.rows[id], now)
+			deleted = append(deleted, table.output(table.rows[id]))
+		}
+		return deleted, nil
+	}
+	for _, id := range doomed {
+		deleted = append(deleted, table.output(table.rows[id]))
+	}
+	if err := m.deleteRows(tableName, doomed); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (m *memoryStore) RestoreRecord(tableName string, id int) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	row, ok := table.rows[int64(id)]
+	if !ok || table.live(row) {
+		return nil, sql.ErrNoRows
+	}
+	restored := table.withDeletedAt(row, nil)
+	table.rows[int64(id)] = restored
+	return table.output(restored), nil
+}
+
+func (m *memoryStore) PurgeRecords(tableName string, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	var doomed []int64
+	for id, row := range table.rows {
+		if deletedAt, ok := row[deletedAtColumn].(time.Time); ok && deletedAt.Before(before) {
+			doomed = append(doomed, id)
+		}
+	}
+	if err := m.deleteRows(tableName, doomed); err != nil {
+		return 0, err
+	}
+	return int64(len(doomed)), nil
+}
+
+// withDeletedAt returns a copy of row moved into (a time) or out of (nil) the trash,
+// with its version bumped
+func (t *memoryTable) withDeletedAt(row Record, deletedAt interface{}) Record {
+	updated := make(Record, len(row))
+	for key, value := range row {
+		updated[key] = value
+	}
+	updated[deletedAtColumn] = deletedAt
+	if current, ok := updated[versionColumn].(int64); ok {
+		updated[versionColumn] = current + 1
+	}
+	return updated
+}
+
+func (m *memoryStore) TruncateTable(tableName string, restartIdentity bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	for _, ref := range m.references(tableName) {
+		if ref.table != tableName {
+			return 0, &pq.Error{Code: "0A000", Message: "cannot truncate a table referenced in a foreign key constraint",
+				Detail: fmt.Sprintf("Table \"%s\" references \"%s\".", ref.table, tableName)}
+		}
+	}
+	count := int64(len(table.rows))
+	table.rows = make(map[int64]Record)
+	if restartIdentity {
+		table.nextID = 1
+	}
+	return count, nil
+}
+
+// memoryReference is a link column pointing at a table
+type memoryReference struct {
+	table  string
+	column string
+	link   ColumnLink
+}
+
+// references lists the link columns that point at tableName
+func (m *memoryStore) references(tableName string) []memoryReference {
+	var refs []memoryReference
+	for name, table := range m.tables {
+		for _, col := range table.columns {
+			if col.link != nil && col.link.Table == tableName {
+				refs = append(refs, memoryReference{table: name, column: col.name, link: *col.link})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].table+"."+refs[i].column < refs[j].table+"."+refs[j].column })
+	return refs
+}
+
+// checkLinks fails like a foreign key violation when a link column of row points at a
+// record that doesn't exist. table is used for self references so uncommitted bulk rows
+// are visible.
+func (m *memoryStore) checkLinks(tableName string, table *memoryTable, row Record) error {
+	for _, col := range table.columns {
+		value := row[col.name]
+		if col.link == nil || value == nil {
+			continue
+		}
+		target := table
+		if col.link.Table != tableName {
+			target = m.tables[col.link.Table]
+		}
+		if _, ok := target.rows[value.(int64)]; !ok {
+			return &pq.Error{
+				Code:       "23503",
+				Message:    fmt.Sprintf("insert or update on table \"%s\" violates foreign key constraint \"%s_%s_fkey\"", tableName, tableName, col.name),
+				Detail:     fmt.Sprintf("Key (%s)=(%d) is not present in table \"%s\".", col.name, value, col.link.Table),
+				Column:     col.name,
+				Constraint: fmt.Sprintf("%s_%s_fkey", tableName, col.name),
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRows deletes rows and applies the ON DELETE action of every link pointing at
+// them. The full set of cascaded deletes is worked out first so a restricting reference
+// anywhere leaves every table untouched.
+func (m *memoryStore) deleteRows(tableName string, ids []int64) error {
+	type pending struct {
+		table string
+		id    int64
+	}
+	doomed := make(map[string]map[int64]bool)
+	queue := make([]pending, 0, len(ids))
+	for _, id := range ids {
+		queue = append(queue, pending{tableName, id})
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if doomed[next.table][next.id] {
+			continue
+		}
+		if doomed[next.table] == nil {
+			doomed[next.table] = make(map[int64]bool)
+		}
+		doomed[next.table][next.id] = true
+
+		for _, ref := range m.references(next.table) {
+			for id, row := range m.tables[ref.table].rows {
+				if row[ref.column] != next.id || doomed[ref.table][id] {
+					continue
+				}
+				if ref.link.OnDelete == "CASCADE" {
+					queue = append(queue, pending{ref.table, id})
+				}
+			}
+		}
+	}
+
+	for target, targetIDs := range doomed {
+		for _, ref := range m.references(target) {
+			if ref.link.OnDelete != "NO ACTION" && ref.link.OnDelete != "RESTRICT" {
+				continue
+			}
+			for id, row := range m.tables[ref.table].rows {
+				value, ok := row[ref.column].(int64)
+				if ok && targetIDs[value] && !doomed[ref.table][id] {
+					return &pq.Error{
+						Code:       "23503",
+						Message:    fmt.Sprintf("update or delete on table \"%s\" violates foreign key constraint \"%s_%s_fkey\" on table \"%s\"", target, ref.table, ref.column, ref.table),
+						Detail:     fmt.Sprintf("Key (id)=(%d) is still referenced from table \"%s\".", value, ref.table),
+						Constraint: fmt.Sprintf("%s_%s_fkey", ref.table, ref.column),
+					}
+				}
+			}
+		}
+	}
+
+	for target, targetIDs := range doomed {
+		for _, ref := range m.references(target) {
+			if ref.link.OnDelete != "SET NULL" {
+				continue
+			}
+			table := m.tables[ref.table]
+			for id, row := range table.rows {
+				if value, ok := row[ref.column].(int64); ok && targetIDs[value] && !doomed[ref.table][id] {
+					updated := make(Record, len(row))
+					for key, v := range row {
+						updated[key] = v
+					}
+					delete(updated, ref.column)
+					table.rows[id] = updated
+				}
+			}
+		}
+	}
+	for target, targetIDs := range doomed {
+		for id := range targetIDs {
+			delete(m.tables[target].rows, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ValueTaken(tableName, columnName string, value interface{}, excludeID int) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	table, err := m.table(tableName)
+	if err != nil {
+		return false, err
+	}
+	col, ok := table.column(columnName)
+	if !ok {
+		return false, &pq.Error{Code: "42703", Message: fmt.Sprintf("column \"%s\" does not exist", columnName)}
+	}
+	coerced, err := coerceMemoryValue(col, value)
+	if err != nil {
+		return false, err
+	}
+	for id, row := range table.rows {
+		if id != int64(excludeID) && table.live(row) && row[columnName] != nil && compareMemoryValues(row[columnName], coerced) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) RecordAudit(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = int64(len(m.audit) + 1)
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func (m *memoryStore) AuditEntries(q auditQuery) ([]AuditEntry, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []AuditEntry
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if q.matches(m.audit[i]) {
+			matched = append(matched, m.audit[i])
+		}
+	}
+	total := len(matched)
+	if q.Offset >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[q.Offset:]
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return append([]AuditEntry{}, matched...), total, nil
+}
+
+func (m *memoryStore) RecordMigration(migration Migration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	migration.ID = int64(len(m.migrations) + 1)
+	m.migrations = append(m.migrations, migration)
+	return nil
+}
+
+func (m *memoryStore) Migrations(q migrationQuery) ([]Migration, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matched []Migration
+	for _, migration := range m.migrations {
+		if q.matches(migration) {
+			matched = append(matched, migration)
+		}
+	}
+	total := len(matched)
+	if q.Offset >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[q.Offset:]
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return append([]Migration{}, matched...), total, nil
+}
+
+// matchingRows returns the rows that satisfy every filter of the query. The cursor,
+// limit and offset are applied by the caller.
+func (t *memoryTable) matchingRows(q recordQuery) ([]Record, error) {
+	var matched []Record
+	for _, row := range t.rows {
+		ok, err := t.matches(row, q.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+	return matched, nil
+}
+
+func (t *memoryTable) matches(row Record, filters []filterClause) (bool, error) {
+	for _, filter := range filters {
+		col, _ := t.column(filter.Column)
+		value := row[filter.Column]
+
+		switch filter.Operator {
+		case "null":
+			isNull, err := strconv.ParseBool(filter.Value)
+			if err != nil {
+				return false, fmt.Errorf("filter[%s][null] expects true or false", filter.Column)
+			}
+			if (value == nil) != isNull {
+				return false, nil
+			}
+			continue
+		}
+
+		if value == nil {
+			return false, nil
+		}
+
+		switch filter.Operator {
+		case "in":
+			if !containsString(strings.Split(filter.Value, ","), memoryText(col, value)) {
+				return false, nil
+			}
+		case "like", "ilike":
+			pattern := likePattern(filter.Value, filter.Operator == "ilike")
+			if !pattern.MatchString(memoryText(col, value)) {
+				return false, nil
+			}
+		default:
+			operand, err := coerceMemoryValue(col, filter.Value)
+			if err != nil {
+				return false, err
+			}
+			cmp := compareMemoryValues(value, operand)
+			var ok bool
+			switch filter.Operator {
+			case "eq":
+				ok = cmp == 0
+			case "neq":
+				ok = cmp != 0
+			case "gt":
+				ok = cmp > 0
+			case "gte":
+				ok = cmp >= 0
+			case "lt":
+				ok = cmp < 0
+			case "lte":
+				ok = cmp <= 0
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// sortRows orders rows like the SQL ORDER BY built by orderClause: NULLs sort last
+// ascending and first descending, and id breaks ties
+func (t *memoryTable) sortRows(rows []Record, fields []sortField) {
+	hasID := false
+	for _, field := range fields {
+		if field.Column == "id" {
+			hasID = true
+		}
+	}
+	if !hasID {
+		fields = append(append([]sortField(nil), fields...), sortField{Column: "id"})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, field := range fields {
+			a, b := rows[i][field.Column], rows[j][field.Column]
+			var cmp int
+			switch {
+			case a == nil && b == nil:
+				cmp = 0
+			case a == nil:
+				cmp = 1
+			case b == nil:
+				cmp = -1
+			default:
+				cmp = compareMemoryValues(a, b)
+			}
+			if field.Descending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
+
+// checkVersion fails a conditional write when the row has another version
+func (t *memoryTable) checkVersion(row Record, version int64) error {
+	if _, versioned := t.column(versionColumn); !versioned || version == 0 {
+		return nil
+	}
+	if current, _ := row[versionColumn].(int64); current != version {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// output copies a row in column order, with NULL columns as nil like scanRecords
+func (t *memoryTable) output(row Record) Record {
+	record := make(Record, len(row))
+	for _, col := range t.columns {
+		record[col.name] = row[col.name]
+	}
+	return record
+}
+
+// coerceMemoryValue converts a value to the Go type the Postgres driver would return for
+// the column, rejecting values Postgres would reject with the same SQLSTATE
+func coerceMemoryValue(col memoryColumn, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	sqlType := strings.ToUpper(col.sqlType)
+
+	switch {
+	case sqlType == "SERIAL" || sqlType == "SMALLINT" || sqlType == "INTEGER" || sqlType == "BIGINT":
+		number, ok := numericValue(value)
+		if !ok || number != math.Trunc(number) {
+			return nil, &pq.Error{Code: "22P02", Message: fmt.Sprintf("invalid input syntax for type integer: \"%v\"", value)}
+		}
+		return int64(number), nil
+	case sqlType == "REAL" || sqlType == "DOUBLE PRECISION" || strings.HasPrefix(sqlType, "NUMERIC") || strings.HasPrefix(sqlType, "DECIMAL"):
+		number, ok := numericValue(value)
+		if !ok {
+			return nil, &pq.Error{Code: "22P02", Message: fmt.Sprintf("invalid input syntax for type numeric: \"%v\"", value)}
+		}
+		return number, nil
+	case sqlType == "BOOLEAN":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		b, err := strconv.ParseBool(fmt.Sprint(value))
+		if err != nil {
+			return nil, &pq.Error{Code: "22P02", Message: fmt.Sprintf("invalid input syntax for type boolean: \"%v\"", value)}
+		}
+		return b, nil
+	case sqlType == "DATE" || strings.HasPrefix(sqlType, "TIMESTAMP"):
+		if t, ok := value.(time.Time); ok {
+			return t, nil
+		}
+		str := fmt.Sprint(value)
+		if t, err := time.Parse("2006-01-02", str); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return nil, &pq.Error{Code: "22007", Message: fmt.Sprintf("invalid input syntax for type date: \"%v\"", value)}
+		}
+		if sqlType == "DATE" {
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		return t, nil
+	case sqlType == "JSON" || sqlType == "JSONB":
+		return value, nil
+	}
+
+	str := memoryText(col, value)
+	if match := varcharPattern.FindStringSubmatch(sqlType); match != nil {
+		limit, _ := strconv.Atoi(match[1])
+		if len([]rune(str)) > limit {
+			return nil, &pq.Error{Code: "22001", Message: fmt.Sprintf("value too long for type character varying(%d)", limit)}
+		}
+	}
+	return str, nil
+}
+
+// memoryText renders a stored value the way Postgres casts it to text
+func memoryText(col memoryColumn, value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		if strings.EqualFold(col.sqlType, "DATE") {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+func compareMemoryValues(a, b interface{}) int {
+	_, aText := a.(string)
+	_, bText := b.(string)
+	if x, ok := numericValue(a); ok && !aText && !bText {
+		if y, ok := numericValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y)
+		}
+	}
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// likePattern translates a SQL LIKE pattern into an anchored regular expression
+func likePattern(pattern string, caseInsensitive bool) *regexp.Regexp {
+	var expr strings.Builder
+	if caseInsensitive {
+		expr.WriteString("(?i)")
+	}
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// memoryDataType maps a column type to the information_schema data_type Postgres reports
+// memoryFormatType renders a column type the way format_type() would
+func memoryFormatType(sqlType string) string {
+	upper := strings.ToUpper(sqlType)
+	dataType := memoryDataType(sqlType)
+	if open := strings.Index(upper, "("); open >= 0 && !strings.Contains(dataType, "(") {
+		return dataType + sqlType[open:]
+	}
+	return dataType
+}
+
+func memoryDataType(sqlType string) string {
+	sqlType = strings.ToUpper(sqlType)
+	switch {
+	case sqlType == "SERIAL" || sqlType == "INTEGER":
+		return "integer"
+	case sqlType == "SMALLINT":
+		return "smallint"
+	case sqlType == "BIGINT":
+		return "bigint"
+	case sqlType == "REAL":
+		return "real"
+	case sqlType == "DOUBLE PRECISION":
+		return "double precision"
+	case strings.HasPrefix(sqlType, "NUMERIC") || strings.HasPrefix(sqlType, "DECIMAL"):
+		return "numeric"
+	case sqlType == "BOOLEAN":
+		return "boolean"
+	case sqlType == "DATE":
+		return "date"
+	case sqlType == "TIMESTAMPTZ" || sqlType == "TIMESTAMP WITH TIME ZONE":
+		return "timestamp with time zone"
+	case sqlType == "TIMESTAMP":
+		return "timestamp without time zone"
+	case strings.HasPrefix(sqlType, "VARCHAR"):
+		return "character varying"
+	case strings.HasPrefix(sqlType, "CHAR"):
+		return "character"
+	}
+	return strings.ToLower(sqlType)
+}
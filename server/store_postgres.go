@@ -0,0 +1,1626 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore implements Store on top of a PostgreSQL database
+type postgresStore struct {
+	db      *sql.DB
+	schemas *schemaCache
+}
+
+// newPostgresStore wraps db and makes sure the column metadata catalog exists
+func newPostgresStore(db *sql.DB) (*postgresStore, error) {
+	if err := ensureMetadataCatalog(db); err != nil {
+		return nil, err
+	}
+	p := &postgresStore{db: db, schemas: newSchemaCache(schemaCacheTTL)}
+	if err := p.versionLegacyTables(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// versionLegacyTables gives row_version to the tables created before record versioning,
+// so every table can check If-Match in the write itself. Tables created since already
+// have the column, which makes this a no-op after the first upgraded start.
+func (p *postgresStore) versionLegacyTables() error {
+	rows, err := p.db.Query(`
+		SELECT t.table_name
+		FROM information_schema.tables t
+		WHERE t.table_schema = 'public' AND t.table_type = 'BASE TABLE'
+			AND NOT EXISTS (
+				SELECT 1 FROM information_schema.columns c
+				WHERE c.table_schema = 'public' AND c.table_name = t.table_name AND c.column_name = $1
+			)`, versionColumn)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, tableName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, tableName := range tables {
+		up := addColumnStatement(tableName, versionColumn, versionColumnType)
+		if _, err := p.db.Exec(up); err != nil {
+			return fmt.Errorf("failed to add column %s to table %s: %w", versionColumn, tableName, err)
+		}
+		migration := Migration{
+			Table:     tableName,
+			Operation: migrationAddColumn,
+			Up:        sqlScript([]string{up}),
+			Down:      sqlScript([]string{dropColumnStatement(tableName, versionColumn)}),
+			Reason:    "record versioning",
+			AppliedAt: time.Now().UTC(),
+		}
+		if err := p.RecordMigration(migration); err != nil {
+			log.Printf("Warning: Failed to record %s of table %s in the migration log: %v", migration.Operation, tableName, err)
+		}
+		fmt.Printf("Table '%s' %s column added\n", tableName, versionColumn)
+	}
+	return nil
+}
+
+// Get all tables in the database
+func (p *postgresStore) ListTables() ([]string, error) {
+	query := `
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = 'public' AND table_type = 'BASE TABLE'
+		ORDER BY table_name`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			return nil, err
+		}
+		tables = append(tables, tableName)
+	}
+
+	return tables, nil
+}
+
+func (p *postgresStore) TableExists(tableName string) (bool, error) {
+	var exists bool
+	query := `
+        SELECT EXISTS (
+            SELECT 1 FROM information_schema.tables
+            WHERE table_name = $1 AND table_schema = 'public'
+        )`
+	err := p.db.QueryRow(query, tableName).Scan(&exists)
+	return exists, err
+}
+
+func (p *postgresStore) CreateTable(tableName string, columns []columnDef, options tableOptions) error {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range createTableStatements(tableName, columns, options) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+	if options.SchemaMode != "" && options.SchemaMode != schemaModeDynamic {
+		if err := saveSchemaMode(tx, tableName, options.SchemaMode); err != nil {
+			return err
+		}
+	}
+	if options.Timestamps {
+		if err := enableTableSetting(tx, tableName, "timestamps"); err != nil {
+			return err
+		}
+	}
+	if options.SoftDelete {
+		if err := enableTableSetting(tx, tableName, "soft_delete"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *postgresStore) DropTable(tableName string) error {
+	defer p.schemas.invalidate(tableName)
+
+	_, err := p.db.Exec(dropTableStatement(tableName))
+	if err != nil {
+		return fmt.Errorf("failed to drop table: %w", err)
+	}
+
+	if err := deleteTableMetadata(p.db, tableName); err != nil {
+		log.Printf("Warning: Failed to remove column metadata for table %s: %v", tableName, err)
+	}
+	return nil
+}
+
+// RenameTable renames the table and, so later names stay predictable, its id sequence
+// and any index whose name is prefixed with the old table name
+func (p *postgresStore) RenameTable(tableName, newName string) error {
+	defer p.schemas.invalidate(tableName, newName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := renameTableObjects(tx, tableName, newName); err != nil {
+		return err
+	}
+	if err := renameTableMetadata(tx, tableName, newName); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// renameTableObjects renames a table of the public schema along with its id sequence and
+// the indexes named after it
+func renameTableObjects(tx *sql.Tx, tableName, newName string) error {
+	indexes, err := tableIndexNames(tx, tableName)
+	if err != nil {
+		return err
+	}
+	var sequence sql.NullString
+	if err := tx.QueryRow("SELECT pg_get_serial_sequence($1, 'id')", quoteIdentifier(tableName)).Scan(&sequence); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdentifier(tableName), quoteIdentifier(newName))); err != nil {
+		return err
+	}
+	if sequence.Valid {
+		if _, err := tx.Exec(fmt.Sprintf("ALTER SEQUENCE %s RENAME TO %s", sequence.String, quoteIdentifier(newName+"_id_seq"))); err != nil {
+			return err
+		}
+	}
+	for _, index := range indexes {
+		if !strings.HasPrefix(index, tableName+"_") {
+			continue
+		}
+		renamed := newName + strings.TrimPrefix(index, tableName)
+		if _, err := tx.Exec(fmt.Sprintf("ALTER INDEX %s RENAME TO %s", quoteIdentifier(index), quoteIdentifier(renamed))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ArchiveTable renames the table after the time it is dropped and moves it, with its
+// sequence and indexes, into the archive schema. Like DROP TABLE it refuses while other
+// tables have foreign keys to it.
+func (p *postgresStore) ArchiveTable(tableName string) (ArchivedTable, error) {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return ArchivedTable{}, err
+	}
+	defer tx.Rollback()
+
+	var dependent string
+	query := `
+		SELECT conrelid::regclass::text FROM pg_constraint
+		WHERE contype = 'f' AND confrelid = $1::regclass AND conrelid <> confrelid
+		LIMIT 1`
+	err = tx.QueryRow(query, quoteIdentifier(tableName)).Scan(&dependent)
+	if err == nil {
+		return ArchivedTable{}, &pq.Error{Code: "2BP01", Message: fmt.Sprintf("cannot drop table %s because other objects depend on it", tableName),
+			Detail: fmt.Sprintf("table %s has a foreign key to table %s", dependent, tableName)}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return ArchivedTable{}, err
+	}
+
+	droppedAt := time.Now().UTC()
+	archived := ArchivedTable{Name: archiveTableName(tableName, droppedAt), Table: tableName, DroppedAt: droppedAt}
+	if err := renameTableObjects(tx, tableName, archived.Name); err != nil {
+		return ArchivedTable{}, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s", quoteIdentifier(archived.Name), archiveSchema)); err != nil {
+		return ArchivedTable{}, err
+	}
+	if err := renameTableMetadata(tx, tableName, archived.Name); err != nil {
+		return ArchivedTable{}, err
+	}
+	query = fmt.Sprintf("INSERT INTO %s.archived_tables (archive_name, table_name, dropped_at) VALUES ($1, $2, $3)", metadataSchema)
+	if _, err := tx.Exec(query, archived.Name, archived.Table, archived.DroppedAt); err != nil {
+		return ArchivedTable{}, err
+	}
+	return archived, tx.Commit()
+}
+
+func (p *postgresStore) ArchivedTables() ([]ArchivedTable, error) {
+	query := fmt.Sprintf("SELECT archive_name, table_name, dropped_at FROM %s.archived_tables ORDER BY dropped_at DESC", metadataSchema)
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archived := []ArchivedTable{}
+	for rows.Next() {
+		var table ArchivedTable
+		if err := rows.Scan(&table.Name, &table.Table, &table.DroppedAt); err != nil {
+			return nil, err
+		}
+		archived = append(archived, table)
+	}
+	return archived, rows.Err()
+}
+
+func (p *postgresStore) RestoreTable(archiveName, newName string) error {
+	defer p.schemas.invalidate(newName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s.%s SET SCHEMA public", archiveSchema, quoteIdentifier(archiveName))); err != nil {
+		return err
+	}
+	if err := renameTableObjects(tx, archiveName, newName); err != nil {
+		return err
+	}
+	if err := renameTableMetadata(tx, archiveName, newName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s.archived_tables WHERE archive_name = $1", metadataSchema), archiveName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *postgresStore) PurgeTable(archiveName string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DROP TABLE %s.%s", archiveSchema, quoteIdentifier(archiveName))); err != nil {
+		return err
+	}
+	if err := deleteTableMetadata(tx, archiveName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s.archived_tables WHERE archive_name = $1", metadataSchema), archiveName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CloneTable copies the table definition with LIKE ... INCLUDING ALL, which brings the
+// defaults, constraints and indexes along, then gives the copy its own id sequence
+func (p *postgresStore) CloneTable(tableName, newName string, withData bool, q recordQuery) (int64, error) {
+	defer p.schemas.invalidate(newName)
+
+	schema, err := p.TableSchema(tableName)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range cloneTableStatements(schema, newName) {
+		if _, err := tx.Exec(statement); err != nil {
+			return 0, err
+		}
+	}
+
+	var copied int64
+	if withData {
+		system, err := p.systemColumns(tx, tableName)
+		if err != nil {
+			return 0, err
+		}
+		where, args, err := q.scoped(system).whereClause(1)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s%s ORDER BY id", quoteIdentifier(newName), quoteIdentifier(tableName), where), args...)
+		if err != nil {
+			return 0, err
+		}
+		if copied, err = result.RowsAffected(); err != nil {
+			return 0, err
+		}
+		query := fmt.Sprintf("SELECT setval(%s, COALESCE(MAX(id), 0) + 1, false) FROM %s", pq.QuoteLiteral(quoteIdentifier(newName+"_id_seq")), quoteIdentifier(newName))
+		if _, err := tx.Exec(query); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := copyTableMetadata(tx, tableName, newName); err != nil {
+		return 0, err
+	}
+	return copied, tx.Commit()
+}
+
+// tableIndexNames lists the indexes defined on a table
+func tableIndexNames(exec sqlExecutor, tableName string) ([]string, error) {
+	rows, err := exec.Query("SELECT indexname FROM pg_indexes WHERE schemaname = 'public' AND tablename = $1", tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+func (p *postgresStore) SchemaMode(tableName string) (string, error) {
+	return getSchemaMode(p.db, tableName)
+}
+
+func (p *postgresStore) SetSchemaMode(tableName, mode string) error {
+	return saveSchemaMode(p.db, tableName, mode)
+}
+
+// TableSchema introspects the table from information_schema and pg_catalog, serving
+// repeated requests from the schema cache
+func (p *postgresStore) TableSchema(tableName string) (TableSchema, error) {
+	if schema, ok := p.schemas.get(tableName); ok {
+		return schema, nil
+	}
+
+	schema := TableSchema{Name: tableName, Columns: []ColumnSchema{}, Indexes: []IndexSchema{}}
+	relation := quoteIdentifier(tableName)
+
+	rows, err := p.db.Query(`
+		SELECT c.column_name, c.data_type, format_type(a.atttypid, a.atttypmod),
+			c.is_nullable = 'YES', c.column_default, c.ordinal_position
+		FROM information_schema.columns c
+		JOIN pg_attribute a ON a.attrelid = $2::regclass AND a.attname = c.column_name
+		WHERE c.table_schema = 'public' AND c.table_name = $1
+		ORDER BY c.ordinal_position`, tableName, relation)
+	if err != nil {
+		return schema, err
+	}
+	columnIndex := make(map[string]int)
+	for rows.Next() {
+		var column ColumnSchema
+		var columnDefault sql.NullString
+		if err := rows.Scan(&column.Name, &column.DataType, &column.Type, &column.Nullable, &columnDefault, &column.Position); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		if columnDefault.Valid {
+			column.Default = &columnDefault.String
+		}
+		columnIndex[column.Name] = len(schema.Columns)
+		schema.Columns = append(schema.Columns, column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return schema, err
+	}
+
+	rows, err = p.db.Query(`
+		SELECT con.conname, con.contype, array_length(con.conkey, 1), a.attname,
+			COALESCE(ref.relname, ''), COALESCE(ra.attname, ''), con.confdeltype
+		FROM pg_constraint con
+		CROSS JOIN LATERAL unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		LEFT JOIN pg_class ref ON ref.oid = con.confrelid
+		LEFT JOIN pg_attribute ra ON ra.attrelid = con.confrelid AND ra.attnum = con.confkey[k.ord]
+		WHERE con.conrelid = $1::regclass AND con.contype IN ('p', 'u', 'f')`, relation)
+	if err != nil {
+		return schema, err
+	}
+	for rows.Next() {
+		var name, kind, column, refTable, refColumn, onDelete string
+		var columnCount int
+		if err := rows.Scan(&name, &kind, &columnCount, &column, &refTable, &refColumn, &onDelete); err != nil {
+			rows.Close()
+			return schema, err
+		}
+		i, ok := columnIndex[column]
+		if !ok {
+			continue
+		}
+		switch kind {
+		case "p":
+			schema.Columns[i].PrimaryKey = true
+		case "u":
+			schema.Columns[i].Unique = schema.Columns[i].Unique || columnCount == 1
+		case "f":
+			schema.Columns[i].ForeignKey = &ForeignKeySchema{Constraint: name, Table: refTable, Column: refColumn, OnDelete: foreignKeyAction(onDelete)}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return schema, err
+	}
+
+	if schema.Indexes, err = tableIndexes(p.db, tableName); err != nil {
+		return schema, err
+	}
+	for _, index := range schema.Indexes {
+		// A single-column unique index enforces uniqueness just like a constraint
+		if index.Unique && index.Predicate == "" && len(index.Columns) == 1 {
+			if i, ok := columnIndex[index.Columns[0]]; ok {
+				schema.Columns[i].Unique = true
+			}
+		}
+	}
+
+	// reltuples is -1 until the table has been analyzed; fall back to counting
+	if err := p.db.QueryRow("SELECT reltuples::bigint FROM pg_class WHERE oid = $1::regclass", relation).Scan(&schema.RowEstimate); err != nil {
+		return schema, err
+	}
+	if schema.RowEstimate < 0 {
+		if err := p.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", relation)).Scan(&schema.RowEstimate); err != nil {
+			return schema, err
+		}
+	}
+
+	p.schemas.put(tableName, schema)
+	return schema, nil
+}
+
+// tableIndexes lists the indexes of a table with their key columns or expressions
+func tableIndexes(exec sqlExecutor, tableName string) ([]IndexSchema, error) {
+	rows, err := exec.Query(`
+		SELECT i.relname, ix.indisunique, ix.indisprimary, am.amname,
+			COALESCE(pg_get_expr(ix.indpred, ix.indrelid), ''), pg_get_indexdef(ix.indexrelid),
+			ARRAY(SELECT pg_get_indexdef(ix.indexrelid, k, true) FROM generate_series(1, ix.indnkeyatts) AS k ORDER BY k)
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_am am ON am.oid = i.relam
+		WHERE ix.indrelid = $1::regclass
+		ORDER BY i.relname`, quoteIdentifier(tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := []IndexSchema{}
+	for rows.Next() {
+		var index IndexSchema
+		if err := rows.Scan(&index.Name, &index.Unique, &index.Primary, &index.Method, &index.Predicate, &index.Definition, pq.Array(&index.Columns)); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, rows.Err()
+}
+
+// CreateIndex builds the index. Concurrent builds run outside a transaction and leave an
+// invalid index behind when they fail, so that is dropped before returning the error.
+func (p *postgresStore) CreateIndex(tableName string, spec indexSpec) (IndexSchema, error) {
+	defer p.schemas.invalidate(tableName)
+
+	schema, err := p.TableSchema(tableName)
+	if err != nil {
+		return IndexSchema{}, err
+	}
+	columns := make(map[string]ColumnSchema, len(schema.Columns))
+	for _, column := range schema.Columns {
+		columns[column.Name] = column
+	}
+	keys := make([]string, len(spec.Columns))
+	for i, name := range spec.Columns {
+		key, ok := indexKey(columns[name], spec.Method)
+		if !ok {
+			return IndexSchema{}, fmt.Errorf("column %s can't be used in a %s index", name, spec.Method)
+		}
+		keys[i] = key
+	}
+
+	if _, err := p.db.Exec(createIndexStatement(tableName, spec, keys)); err != nil {
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code.Name() == "duplicate_table" {
+			return IndexSchema{}, err
+		}
+		if spec.Concurrently {
+			if _, dropErr := p.db.Exec(fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", quoteIdentifier(spec.Name))); dropErr != nil {
+				log.Printf("Warning: Failed to drop invalid index %s: %v", spec.Name, dropErr)
+			}
+		}
+		if pqErr.Code.Name() == "unique_violation" {
+			conflicts, findErr := p.indexConflicts(tableName, spec)
+			if findErr != nil {
+				return IndexSchema{}, findErr
+			}
+			return IndexSchema{}, &duplicateValuesError{Index: spec.Name, Conflicts: conflicts}
+		}
+		return IndexSchema{}, err
+	}
+
+	indexes, err := tableIndexes(p.db, tableName)
+	if err != nil {
+		return IndexSchema{}, err
+	}
+	for _, index := range indexes {
+		if index.Name == spec.Name {
+			return index, nil
+		}
+	}
+	return IndexSchema{}, fmt.Errorf("index %s not found after creation", spec.Name)
+}
+
+// indexConflicts groups the rows that share values in the index columns. Rows with a
+// NULL in any of them never conflict.
+func (p *postgresStore) indexConflicts(tableName string, spec indexSpec) ([]indexConflict, error) {
+	var pairs, conditions []string
+	for _, column := range spec.Columns {
+		pairs = append(pairs, pq.QuoteLiteral(column), quoteIdentifier(column))
+		conditions = append(conditions, fmt.Sprintf("%s IS NOT NULL", quoteIdentifier(column)))
+	}
+	if len(spec.Where) > 0 {
+		conditions = append(conditions, indexPredicate(spec.Where))
+	}
+	query := fmt.Sprintf(`
+		SELECT json_build_object(%s)::text, COUNT(*), (array_agg(id ORDER BY id))[1:%d]
+		FROM %s WHERE %s
+		GROUP BY %s HAVING COUNT(*) > 1
+		ORDER BY MIN(id) LIMIT %d`,
+		strings.Join(pairs, ", "), maxIndexConflicts, quoteIdentifier(tableName),
+		strings.Join(conditions, " AND "), quoteIdentifiers(spec.Columns), maxIndexConflicts)
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []indexConflict
+	for rows.Next() {
+		var values string
+		var conflict indexConflict
+		if err := rows.Scan(&values, &conflict.Count, pq.Array(&conflict.IDs)); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(values), &conflict.Values); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// DropIndex drops an index, going through ALTER TABLE when it backs a constraint
+func (p *postgresStore) DropIndex(tableName, indexName string, concurrently bool) error {
+	defer p.schemas.invalidate(tableName)
+
+	var constraint string
+	err := p.db.QueryRow("SELECT conname FROM pg_constraint WHERE conrelid = $1::regclass AND conindid = $2::regclass",
+		quoteIdentifier(tableName), quoteIdentifier(indexName)).Scan(&constraint)
+	switch {
+	case err == nil:
+		_, err = p.db.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", quoteIdentifier(tableName), quoteIdentifier(constraint)))
+		return err
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	statement := "DROP INDEX %s"
+	if concurrently {
+		statement = "DROP INDEX CONCURRENTLY %s"
+	}
+	_, err = p.db.Exec(fmt.Sprintf(statement, quoteIdentifier(indexName)))
+	return err
+}
+
+func (p *postgresStore) Columns(tableName string) ([]string, error) {
+	return getTableColumns(p.db, tableName)
+}
+
+func getTableColumns(exec sqlExecutor, tableName string) ([]string, error) {
+	query := `
+        SELECT column_name
+        FROM information_schema.columns
+        WHERE table_name = $1 AND table_schema = 'public'
+        ORDER BY ordinal_position`
+
+	rows, err := exec.Query(query, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func (p *postgresStore) ColumnMetadata(tableName string) ([]ColumnMetadata, error) {
+	return getColumnMetadata(p.db, tableName)
+}
+
+// AddColumn adds the column and its catalog entry in one transaction. Link columns also
+// get their foreign key.
+func (p *postgresStore) AddColumn(tableName, columnName, columnType string, meta *ColumnMetadata) error {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addColumnWithType(tx, tableName, columnName, columnType); err != nil {
+		return err
+	}
+	if meta != nil && meta.Link != nil {
+		// Index the link column as well, since expanding includes looks rows up by it
+		statements := []string{foreignKeyStatement(tableName, columnName, *meta.Link), columnIndexStatement(tableName, columnName)}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+	}
+	if meta != nil {
+		if err := saveColumnMetadata(tx, tableName, *meta); err != nil {
+			return fmt.Errorf("failed to save column metadata: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *postgresStore) SystemColumns(tableName string) ([]string, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	return getSystemColumns(p.db, tableName, columns)
+}
+
+func (p *postgresStore) AddTimestampColumns(tableName string) ([]string, error) {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	system, err := p.systemColumns(tx, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if containsString(system, createdAtColumn) {
+		return nil, nil
+	}
+	var added []string
+	for _, col := range timestampColumns {
+		for _, statement := range timestampColumnStatements(tableName, col) {
+			if _, err := tx.Exec(statement); err != nil {
+				return nil, fmt.Errorf("failed to add column %s to table %s: %w", col.Name, tableName, err)
+			}
+		}
+		added = append(added, col.Name)
+	}
+	if err := enableTableSetting(tx, tableName, "timestamps"); err != nil {
+		return nil, err
+	}
+	return added, tx.Commit()
+}
+
+func (p *postgresStore) EnableSoftDelete(tableName string) (bool, error) {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	system, err := p.systemColumns(tx, tableName)
+	if err != nil {
+		return false, err
+	}
+	if containsString(system, deletedAtColumn) {
+		return false, nil
+	}
+	for _, statement := range softDeleteStatements(tableName) {
+		if _, err := tx.Exec(statement); err != nil {
+			return false, fmt.Errorf("failed to add column %s to table %s: %w", deletedAtColumn, tableName, err)
+		}
+	}
+	if err := enableTableSetting(tx, tableName, "soft_delete"); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// systemColumns reads the systemColumns of a table through exec, which may be a
+// transaction
+func (p *postgresStore) systemColumns(exec sqlExecutor, tableName string) ([]string, error) {
+	columns, err := getTableColumns(exec, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return getSystemColumns(exec, tableName, columns)
+}
+
+// addColumnWithType adds a column with an explicit PostgreSQL type using the given
+// executor, which may be a transaction
+func addColumnWithType(exec sqlExecutor, tableName, columnName, columnType string) error {
+	if _, err := exec.Exec(addColumnStatement(tableName, columnName, columnType)); err != nil {
+		return fmt.Errorf("failed to add column %s to table %s: %w", columnName, tableName, err)
+	}
+	return nil
+}
+
+func (p *postgresStore) DropColumn(tableName, columnName string) error {
+	defer p.schemas.invalidate(tableName)
+
+	if _, err := p.db.Exec(dropColumnStatement(tableName, columnName)); err != nil {
+		return err
+	}
+
+	if err := deleteColumnMetadata(p.db, tableName, columnName); err != nil {
+		log.Printf("Warning: Failed to remove metadata for column %s in table %s: %v", columnName, tableName, err)
+	}
+	return nil
+}
+
+// AlterColumn locks the table, checks every existing value against the new type and then
+// applies the type change and rename. Values are checked one distinct value at a time under
+// a savepoint, casting through the column's current type exactly like the USING clause.
+func (p *postgresStore) AlterColumn(tableName, columnName string, change columnChange, dryRun bool) (conversionReport, error) {
+	defer p.schemas.invalidate(tableName)
+
+	var report conversionReport
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", quoteIdentifier(tableName))); err != nil {
+		return report, err
+	}
+
+	if change.NewType != "" {
+		report, err = checkColumnConversion(tx, tableName, columnName, change.NewType)
+		if err != nil {
+			return report, err
+		}
+		if dryRun {
+			return report, nil
+		}
+		if report.Failed > 0 {
+			return report, errConversionFailed
+		}
+
+		if _, err := tx.Exec(alterColumnTypeStatement(tableName, columnName, change.NewType)); err != nil {
+			return report, err
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	finalName := columnName
+	if change.NewName != "" && change.NewName != columnName {
+		if _, err := tx.Exec(renameColumnStatement(tableName, columnName, change.NewName)); err != nil {
+			return report, err
+		}
+		if err := renameColumnMetadata(tx, tableName, columnName, change.NewName); err != nil {
+			return report, err
+		}
+		finalName = change.NewName
+	}
+
+	if change.Meta != nil {
+		meta := *change.Meta
+		meta.Key = finalName
+		if err := saveColumnMetadata(tx, tableName, meta); err != nil {
+			return report, fmt.Errorf("failed to save column metadata: %w", err)
+		}
+	}
+
+	return report, tx.Commit()
+}
+
+// checkColumnConversion reports which non-NULL values of a column fail to cast to newType
+func checkColumnConversion(tx *sql.Tx, tableName, columnName, newType string) (conversionReport, error) {
+	var report conversionReport
+
+	var currentType string
+	err := tx.QueryRow(`
+		SELECT format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = $1::regclass AND a.attname = $2 AND NOT a.attisdropped`,
+		quoteIdentifier(tableName), columnName).Scan(&currentType)
+	if err != nil {
+		return report, err
+	}
+
+	query := fmt.Sprintf("SELECT id, %s::text FROM %s WHERE %s IS NOT NULL ORDER BY id",
+		quoteIdentifier(columnName), quoteIdentifier(tableName), quoteIdentifier(columnName))
+	rows, err := tx.Query(query)
+	if err != nil {
+		return report, err
+	}
+	idsByValue := make(map[string][]int64)
+	var values []string
+	for rows.Next() {
+		var id int64
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if _, seen := idsByValue[value]; !seen {
+			values = append(values, value)
+		}
+		idsByValue[value] = append(idsByValue[value], id)
+		report.Rows++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	// currentType comes from format_type and newType from normalizeColumnType, so both
+	// are safe to interpolate
+	castQuery := fmt.Sprintf("SELECT $1::%s::%s", currentType, newType)
+	for _, value := range values {
+		if _, err := tx.Exec("SAVEPOINT column_cast"); err != nil {
+			return report, err
+		}
+		var discard interface{}
+		castErr := tx.QueryRow(castQuery, value).Scan(&discard)
+		if castErr == nil {
+			if _, err := tx.Exec("RELEASE SAVEPOINT column_cast"); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT column_cast"); err != nil {
+			return report, err
+		}
+
+		message := castErr.Error()
+		if pqErr, ok := castErr.(*pq.Error); ok {
+			message = pqErr.Message
+		}
+		for _, id := range idsByValue[value] {
+			report.Failed++
+			if len(report.Failures) < maxConversionFailures {
+				report.Failures = append(report.Failures, conversionFailure{ID: id, Value: value, Error: message})
+			}
+		}
+	}
+	return report, nil
+}
+
+// ListRecords returns one page of records matching the query along with the total
+// number of matching rows ignoring limit, offset and cursor
+func (p *postgresStore) ListRecords(tableName string, q recordQuery) ([]Record, int, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, 0, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, 0, err
+	}
+	q = q.scoped(system)
+
+	countQuery := q
+	countQuery.After = nil
+	countWhere, countArgs, err := countQuery.whereClause(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	err = p.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s%s", quoteIdentifier(tableName), countWhere), countArgs...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query, args, err := selectRecordsQuery(tableName, columns, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	return records, total, err
+}
+
+// StreamRecords runs the same query as ListRecords and hands each row to visit as it is
+// read, so only one row is held in memory at a time
+func (p *postgresStore) StreamRecords(tableName string, q recordQuery, visit func(Record) error) error {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return err
+	}
+	query, args, err := selectRecordsQuery(tableName, columns, q.scoped(system))
+	if err != nil {
+		return err
+	}
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		record, err := scanRecord(rows, columnTypes)
+		if err != nil {
+			return err
+		}
+		if err := visit(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// selectRecordsQuery builds the SELECT of a listing: the selected columns of the rows
+// matching the (already scoped) query, sorted and paged
+func selectRecordsQuery(tableName string, columns []string, q recordQuery) (string, []interface{}, error) {
+	where, args, err := q.whereClause(1)
+	if err != nil {
+		return "", nil, err
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s%s", quoteIdentifiers(q.selectColumns(columns)), quoteIdentifier(tableName), where, q.orderClause(), q.limitClause())
+	return query, args, nil
+}
+
+func (p *postgresStore) GetRecord(tableName string, id int) (Record, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id=$1%s", quoteIdentifiers(columns), quoteIdentifier(tableName), liveCondition(system))
+	return p.queryRecord(query, id)
+}
+
+// liveCondition is the WHERE condition, with a leading AND, that hides the trashed rows
+// of a soft-deleting table
+func liveCondition(system []string) string {
+	if !containsString(system, deletedAtColumn) {
+		return ""
+	}
+	return fmt.Sprintf(" AND %s IS NULL", quoteIdentifier(deletedAtColumn))
+}
+
+// trashAssignments sets deleted_at to value, now() or NULL, and bumps the row version
+func trashAssignments(system []string, value string) string {
+	assignments := fmt.Sprintf("%s=%s", quoteIdentifier(deletedAtColumn), value)
+	if containsString(system, versionColumn) {
+		assignments += fmt.Sprintf(", %[1]s=%[1]s+1", quoteIdentifier(versionColumn))
+	}
+	return assignments
+}
+
+// scanRecords reads every row into a Record. Every column is present, with NULL as nil.
+// NUMERIC, JSON and text values, which lib/pq returns as raw bytes, are converted so they
+// encode as JSON numbers, documents and strings.
+func scanRecords(rows *sql.Rows) ([]Record, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for rows.Next() {
+		record, err := scanRecord(rows, columnTypes)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// scanRecord reads the current row into a Record
+func scanRecord(rows *sql.Rows, columnTypes []*sql.ColumnType) (Record, error) {
+	values := make([]interface{}, len(columnTypes))
+	valuePtrs := make([]interface{}, len(columnTypes))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	if err := rows.Scan(valuePtrs...); err != nil {
+		return nil, err
+	}
+
+	record := make(Record)
+	for i, columnType := range columnTypes {
+		record[columnType.Name()] = normalizeScannedValue(columnType.DatabaseTypeName(), values[i])
+	}
+	return record, nil
+}
+
+func normalizeScannedValue(databaseType string, value interface{}) interface{} {
+	raw, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+	switch databaseType {
+	case "NUMERIC":
+		if number, err := strconv.ParseFloat(string(raw), 64); err == nil {
+			return number
+		}
+	case "JSON", "JSONB":
+		var document interface{}
+		if err := json.Unmarshal(raw, &document); err == nil {
+			return document
+		}
+	}
+	return string(raw)
+}
+
+// columnValue prepares a decoded JSON value for a bind parameter: objects and arrays,
+// which the driver can't send, are encoded as JSON text for json and jsonb columns
+func columnValue(value interface{}) interface{} {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		if encoded, err := json.Marshal(value); err == nil {
+			return string(encoded)
+		}
+	}
+	return value
+}
+
+// InsertRecord inserts the fields of recordData that match existing columns
+func (p *postgresStore) InsertRecord(tableName string, recordData Record) (int, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return 0, err
+	}
+
+	// Filter out id column for insert
+	var insertColumns []string
+	var values []interface{}
+	var placeholders []string
+	placeholderIndex := 1
+
+	for _, col := range columns {
+		if col == "id" {
+			continue
+		}
+		if value, exists := recordData[col]; exists {
+			insertColumns = append(insertColumns, col)
+			values = append(values, columnValue(value))
+			placeholders = append(placeholders, fmt.Sprintf("$%d", placeholderIndex))
+			placeholderIndex++
+		}
+	}
+
+	if len(insertColumns) == 0 {
+		return 0, errNoFields
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s(%s) VALUES(%s) RETURNING id",
+		quoteIdentifier(tableName),
+		quoteIdentifiers(insertColumns),
+		strings.Join(placeholders, ", "),
+	)
+
+	var newID int
+	err = p.db.QueryRow(query, values...).Scan(&newID)
+	return newID, err
+}
+
+// InsertRecords inserts the rows without errors using multi-row INSERT statements inside
+// one transaction, creating missing columns once for the union of keys
+func (p *postgresStore) InsertRecords(tableName string, rows []Record, results []bulkRowResult, atomic bool) (bool, error) {
+	defer p.schemas.invalidate(tableName)
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	keyColumns, insertColumns, err := prepareBulkColumns(tx, tableName, rows, results)
+	if err != nil {
+		return false, err
+	}
+
+	pending := pendingBulkRows(rows, results, keyColumns)
+	if len(insertColumns) > 0 {
+		chunkSize := maxBulkParams / len(insertColumns)
+		if chunkSize > maxBulkChunkRows {
+			chunkSize = maxBulkChunkRows
+		}
+		for start := 0; start < len(pending); start += chunkSize {
+			end := start + chunkSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			if err := insertBulkChunk(tx, tableName, insertColumns, keyColumns, rows, pending[start:end], results); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if atomic && bulkHasErrors(results) {
+		return false, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *postgresStore) UpdateRecord(tableName string, id int, recordData Record, version int64) (Record, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	var setClauses []string
+	var values []interface{}
+	placeholderIndex := 1
+
+	for _, col := range columns {
+		if col == "id" || col == versionColumn {
+			continue
+		}
+		if value, exists := recordData[col]; exists {
+			setClauses = append(setClauses, fmt.Sprintf("%s=$%d", quoteIdentifier(col), placeholderIndex))
+			values = append(values, columnValue(value))
+			placeholderIndex++
+		}
+	}
+
+	if len(setClauses) == 0 {
+		return nil, errNoFields
+	}
+
+	versioned := containsString(columns, versionColumn)
+	if versioned {
+		setClauses = append(setClauses, fmt.Sprintf("%[1]s=%[1]s+1", quoteIdentifier(versionColumn)))
+	}
+	values = append(values, id)
+	where := fmt.Sprintf("id=$%d", placeholderIndex) + liveCondition(system)
+	if versioned && version > 0 {
+		values = append(values, version)
+		where += fmt.Sprintf(" AND %s=$%d", quoteIdentifier(versionColumn), placeholderIndex+1)
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s RETURNING %s",
+		quoteIdentifier(tableName),
+		strings.Join(setClauses, ", "),
+		where,
+		quoteIdentifiers(columns),
+	)
+	record, err := p.queryRecord(query, values...)
+	if errors.Is(err, sql.ErrNoRows) && versioned && version > 0 {
+		return nil, p.missingOrChanged(tableName, id, system)
+	}
+	return record, err
+}
+
+func (p *postgresStore) DeleteRecord(tableName string, id int, version int64) (Record, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	conditional := version > 0 && containsString(columns, versionColumn)
+	args := []interface{}{id}
+	where := "id=$1" + liveCondition(system)
+	if conditional {
+		args = append(args, version)
+		where += fmt.Sprintf(" AND %s=$2", quoteIdentifier(versionColumn))
+	}
+	statement := fmt.Sprintf("DELETE FROM %s", quoteIdentifier(tableName))
+	if containsString(system, deletedAtColumn) {
+		statement = fmt.Sprintf("UPDATE %s SET %s", quoteIdentifier(tableName), trashAssignments(system, "now()"))
+	}
+	query := fmt.Sprintf("%s WHERE %s RETURNING %s", statement, where, quoteIdentifiers(columns))
+	record, err := p.queryRecord(query, args...)
+	if errors.Is(err, sql.ErrNoRows) && conditional {
+		return nil, p.missingOrChanged(tableName, id, system)
+	}
+	return record, err
+}
+
+// RestoreRecord clears deleted_at of a trashed row
+func (p *postgresStore) RestoreRecord(tableName string, id int) (Record, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(system, deletedAtColumn) {
+		return nil, sql.ErrNoRows
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id=$1 AND %s IS NOT NULL RETURNING %s",
+		quoteIdentifier(tableName), trashAssignments(system, "NULL"), quoteIdentifier(deletedAtColumn), quoteIdentifiers(columns))
+	return p.queryRecord(query, id)
+}
+
+// PurgeRecords deletes the rows trashed before the given time
+func (p *postgresStore) PurgeRecords(tableName string, before time.Time) (int64, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return 0, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return 0, err
+	}
+	if !containsString(system, deletedAtColumn) {
+		return 0, nil
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s < $1", quoteIdentifier(tableName), quoteIdentifier(deletedAtColumn))
+	result, err := p.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// missingOrChanged explains why a conditional write matched no row: errPreconditionFailed
+// when the row exists with another version, sql.ErrNoRows when it doesn't exist
+func (p *postgresStore) missingOrChanged(tableName string, id int, system []string) error {
+	var exists bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE id=$1%s)", quoteIdentifier(tableName), liveCondition(system))
+	if err := p.db.QueryRow(query, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return errPreconditionFailed
+	}
+	return sql.ErrNoRows
+}
+
+// queryRecord runs a statement returning at most one row, giving sql.ErrNoRows when
+// nothing matched
+func (p *postgresStore) queryRecord(query string, args ...interface{}) (Record, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return records[0], nil
+}
+
+// DeleteRecords deletes, or for a soft-deleting table trashes, the rows matching the ids
+// and filters in one transaction
+func (p *postgresStore) DeleteRecords(tableName string, ids []int, q recordQuery) ([]Record, error) {
+	columns, err := p.Columns(tableName)
+	if err != nil {
+		return nil, err
+	}
+	system, err := getSystemColumns(p.db, tableName, columns)
+	if err != nil {
+		return nil, err
+	}
+	where, args, err := q.scoped(system).whereClause(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		condition := fmt.Sprintf("id = ANY($%d)", len(args)+1)
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
+		}
+		args = append(args, pq.Array(ids))
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	statement := fmt.Sprintf("DELETE FROM %s", quoteIdentifier(tableName))
+	if containsString(system, deletedAtColumn) {
+		statement = fmt.Sprintf("UPDATE %s SET %s", quoteIdentifier(tableName), trashAssignments(system, "now()"))
+	}
+	rows, err := tx.Query(statement+where+" RETURNING "+quoteIdentifiers(columns), args...)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := scanRecords(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// TruncateTable removes every row from a table and returns how many rows were removed
+func (p *postgresStore) TruncateTable(tableName string, restartIdentity bool) (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", quoteIdentifier(tableName))); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteIdentifier(tableName))).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	statement := fmt.Sprintf("TRUNCATE TABLE %s", quoteIdentifier(tableName))
+	if restartIdentity {
+		statement += " RESTART IDENTITY"
+	}
+	if _, err := tx.Exec(statement); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ValueTaken reports whether another live row already holds value in the column; rows in
+// the trash don't count
+func (p *postgresStore) ValueTaken(tableName, columnName string, value interface{}, excludeID int) (bool, error) {
+	system, err := p.systemColumns(p.db, tableName)
+	if err != nil {
+		return false, err
+	}
+	var taken bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE %s = $1 AND id <> $2%s)",
+		quoteIdentifier(tableName), quoteIdentifier(columnName), liveCondition(system))
+	err = p.db.QueryRow(query, value, excludeID).Scan(&taken)
+	return taken, err
+}
+
+func (p *postgresStore) RecordAudit(entry AuditEntry) error {
+	before, err := json.Marshal(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(entry.After)
+	if err != nil {
+		return err
+	}
+	var actor sql.NullString
+	if entry.Actor != "" {
+		actor = sql.NullString{String: entry.Actor, Valid: true}
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s.audit_log (table_name, record_id, operation, version, before_values, after_values, actor, changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, metadataSchema)
+	_, err = p.db.Exec(query, entry.Table, entry.RecordID, entry.Operation, entry.Version, string(before), string(after), actor, entry.ChangedAt)
+	return err
+}
+
+func (p *postgresStore) AuditEntries(q auditQuery) ([]AuditEntry, int, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if q.Table != "" {
+		add("table_name = $%d", q.Table)
+	}
+	if q.RecordID != nil {
+		add("record_id = $%d", *q.RecordID)
+	}
+	if q.Operation != "" {
+		add("operation = $%d", q.Operation)
+	}
+	if q.Actor != "" {
+		add("actor = $%d", q.Actor)
+	}
+	if !q.Since.IsZero() {
+		add("changed_at >= $%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		add("changed_at < $%d", q.Until)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := p.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s.audit_log%s", metadataSchema, where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, table_name, record_id, operation, version, before_values, after_values, actor, changed_at
+		FROM %s.audit_log%s
+		ORDER BY id DESC`, metadataSchema, where)
+	query += recordQuery{Limit: q.Limit, Offset: q.Offset}.limitClause()
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var version sql.NullInt64
+		var before, after []byte
+		var actor sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Table, &entry.RecordID, &entry.Operation, &version, &before, &after, &actor, &entry.ChangedAt); err != nil {
+			return nil, 0, err
+		}
+		if version.Valid {
+			entry.Version = &version.Int64
+		}
+		if err := json.Unmarshal(before, &entry.Before); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(after, &entry.After); err != nil {
+			return nil, 0, err
+		}
+		entry.Actor = actor.String
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+func (p *postgresStore) RecordMigration(migration Migration) error {
+	var actor, reason sql.NullString
+	if migration.Actor != "" {
+		actor = sql.NullString{String: migration.Actor, Valid: true}
+	}
+	if migration.Reason != "" {
+		reason = sql.NullString{String: migration.Reason, Valid: true}
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s.schema_migrations (table_name, operation, up_sql, down_sql, actor, reason, applied_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, metadataSchema)
+	_, err := p.db.Exec(query, migration.Table, migration.Operation, migration.Up, migration.Down, actor, reason, migration.AppliedAt)
+	return err
+}
+
+func (p *postgresStore) Migrations(q migrationQuery) ([]Migration, int, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if q.Table != "" {
+		add("table_name = $%d", q.Table)
+	}
+	if q.Operation != "" {
+		add("operation = $%d", q.Operation)
+	}
+	if q.Actor != "" {
+		add("actor = $%d", q.Actor)
+	}
+	if !q.Since.IsZero() {
+		add("applied_at >= $%d", q.Since)
+	}
+	if !q.Until.IsZero() {
+		add("applied_at < $%d", q.Until)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := p.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s.schema_migrations%s", metadataSchema, where), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, table_name, operation, up_sql, down_sql, actor, reason, applied_at
+		FROM %s.schema_migrations%s
+		ORDER BY id`, metadataSchema, where)
+	query += recordQuery{Limit: q.Limit, Offset: q.Offset}.limitClause()
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	migrations := []Migration{}
+	for rows.Next() {
+		var migration Migration
+		var actor, reason sql.NullString
+		if err := rows.Scan(&migration.ID, &migration.Table, &migration.Operation, &migration.Up, &migration.Down, &actor, &reason, &migration.AppliedAt); err != nil {
+			return nil, 0, err
+		}
+		migration.Actor = actor.String
+		migration.Reason = reason.String
+		migrations = append(migrations, migration)
+	}
+	return migrations, total, rows.Err()
+}
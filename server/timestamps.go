@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Optional system columns recording when and by whom a row was created and last changed
+const (
+	createdAtColumn = "created_at"
+	updatedAtColumn = "updated_at"
+	createdByColumn = "created_by"
+	updatedByColumn = "updated_by"
+)
+
+// timestampColumns are added together, at table creation or later through PATCH /tables
+var timestampColumns = []columnDef{
+	{Name: createdAtColumn, Type: "TIMESTAMPTZ"},
+	{Name: updatedAtColumn, Type: "TIMESTAMPTZ"},
+	{Name: createdByColumn, Type: "VARCHAR(255)"},
+	{Name: updatedByColumn, Type: "VARCHAR(255)"},
+}
+
+func isTimestampColumn(name string) bool {
+	for _, col := range timestampColumns {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// timestampColumnStatements add one of the timestampColumns. created_at and updated_at
+// default to now() and are indexed, since listings sort by them.
+func timestampColumnStatements(tableName string, col columnDef) []string {
+	if col.Name != createdAtColumn && col.Name != updatedAtColumn {
+		return []string{addColumnStatement(tableName, col.Name, col.Type)}
+	}
+	return []string{
+		addColumnStatement(tableName, col.Name, col.Type+" NOT NULL DEFAULT now()"),
+		columnIndexStatement(tableName, col.Name),
+	}
+}
+
+// actorHeader names the caller for created_by and updated_by until there is authentication
+const actorHeader = "X-User"
+
+// requestActor returns who a write is made by, or "" when the request doesn't say
+func requestActor(r *http.Request) string {
+	actor := strings.TrimSpace(r.Header.Get(actorHeader))
+	if len(actor) > 255 {
+		actor = actor[:255]
+	}
+	return actor
+}
+
+// stampRecord sets updated_at and updated_by on every write, and created_at and created_by
+// on inserts, when the table has timestamps enabled. An unknown actor is stored as NULL.
+func stampRecord(recordData Record, system []string, actor string, created bool) {
+	now := time.Now().UTC()
+	var by interface{}
+	if actor != "" {
+		by = actor
+	}
+
+	stamps := map[string]interface{}{updatedAtColumn: now, updatedByColumn: by}
+	if created {
+		stamps[createdAtColumn] = now
+		stamps[createdByColumn] = by
+	}
+	for column, value := range stamps {
+		if containsString(system, column) {
+			recordData[column] = value
+		}
+	}
+}
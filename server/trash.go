@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deletedAtColumn marks a table as soft-deleting: DELETE sets it instead of removing the
+// row, and rows where it is set are only visible through /trash
+const deletedAtColumn = "deleted_at"
+
+// softDeleteStatements add the deleted_at column and the index the trash is read through
+func softDeleteStatements(tableName string) []string {
+	return []string{
+		addColumnStatement(tableName, deletedAtColumn, "TIMESTAMPTZ"),
+		columnIndexStatement(tableName, deletedAtColumn),
+	}
+}
+
+// archiveSchema holds dropped tables until they are restored or purged
+const archiveSchema = "mock2_archive"
+
+// trashRetention is how long trashed records and archived tables are kept before a purge
+// removes them. main sets it from the configuration.
+var trashRetention = 30 * 24 * time.Hour
+
+// ArchivedTable is a dropped table waiting in the archive schema
+type ArchivedTable struct {
+	Name      string    `json:"name"`
+	Table     string    `json:"table"`
+	DroppedAt time.Time `json:"droppedAt"`
+}
+
+// archiveTableName names the archived copy of a table after the time it was dropped,
+// shortening the table name so the result stays a valid identifier
+func archiveTableName(tableName string, droppedAt time.Time) string {
+	suffix := "_" + strconv.FormatInt(droppedAt.UnixMilli(), 10)
+	if len(tableName)+len(suffix) > 63 {
+		tableName = tableName[:63-len(suffix)]
+	}
+	return tableName + suffix
+}
+
+// softDeletes reports whether deleting a record of the table moves it to the trash
+func softDeletes(tableName string) (bool, error) {
+	system, err := store.SystemColumns(tableName)
+	if err != nil {
+		return false, err
+	}
+	return containsString(system, deletedAtColumn), nil
+}
+
+// archiveTable moves a table to the archive schema instead of dropping it
+func archiveTable(tableName string, change schemaChange) (ArchivedTable, error) {
+	if tableName == "users" {
+		return ArchivedTable{}, fmt.Errorf("cannot drop the default 'users' table")
+	}
+	if err := validateTableName(tableName); err != nil {
+		return ArchivedTable{}, err
+	}
+
+	schema, err := store.TableSchema(tableName)
+	if err != nil {
+		return ArchivedTable{}, err
+	}
+	archived, err := store.ArchiveTable(tableName)
+	if err != nil {
+		return ArchivedTable{}, err
+	}
+	archive, restore := archiveStatements(archived.Name, tableName, renamedIndexes(indexNames(schema), tableName, archived.Name))
+	recordMigration(change, tableName, migrationArchiveTable, archive, restore)
+	fmt.Printf("Table '%s' moved to trash as '%s'\n", tableName, archived.Name)
+	return archived, nil
+}
+
+// findArchivedTable looks up an archived table by its archive name
+func findArchivedTable(archiveName string) (ArchivedTable, bool, error) {
+	archived, err := store.ArchivedTables()
+	if err != nil {
+		return ArchivedTable{}, false, err
+	}
+	for _, table := range archived {
+		if table.Name == archiveName {
+			return table, true, nil
+		}
+	}
+	return ArchivedTable{}, false, nil
+}
+
+// trashPurgeResult lists what a purge removed
+type trashPurgeResult struct {
+	Before  time.Time        `json:"before"`
+	Records map[string]int64 `json:"records"`
+	Tables  []string         `json:"tables"`
+}
+
+// purgeTrash permanently removes the records trashed and the tables dropped before cutoff
+func purgeTrash(before time.Time, change schemaChange) (trashPurgeResult, error) {
+	result := trashPurgeResult{Before: before, Records: map[string]int64{}, Tables: []string{}}
+
+	tables, err := store.ListTables()
+	if err != nil {
+		return result, err
+	}
+	for _, tableName := range tables {
+		soft, err := softDeletes(tableName)
+		if err != nil {
+			return result, err
+		}
+		if !soft {
+			continue
+		}
+		purged, err := store.PurgeRecords(tableName, before)
+		if err != nil {
+			return result, err
+		}
+		if purged > 0 {
+			result.Records[tableName] = purged
+			fmt.Printf("Table '%s' purged %d deleted records\n", tableName, purged)
+		}
+	}
+
+	archived, err := store.ArchivedTables()
+	if err != nil {
+		return result, err
+	}
+	for _, table := range archived {
+		if !table.DroppedAt.Before(before) {
+			continue
+		}
+		if err := purgeArchivedTable(table, change); err != nil {
+			return result, err
+		}
+		result.Tables = append(result.Tables, table.Name)
+		fmt.Printf("Table '%s' purged from trash\n", table.Name)
+	}
+	return result, nil
+}
+
+// purgeArchivedTable drops an archived table for good; the migration log records it as
+// irreversible
+func purgeArchivedTable(archived ArchivedTable, change schemaChange) error {
+	if err := store.PurgeTable(archived.Name); err != nil {
+		return err
+	}
+	recordMigration(change, archived.Table, migrationPurgeTable, []string{"DROP TABLE " + archivedTableName(archived.Name)}, nil)
+	return nil
+}
+
+// purgeTrashPeriodically purges whatever has outlived trashRetention every interval
+func purgeTrashPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := purgeTrash(time.Now().Add(-trashRetention), schemaChange{Reason: "trash retention"}); err != nil {
+			log.Printf("Warning: Failed to purge trash: %v", err)
+		}
+	}
+}
+
+// trashHandler serves GET /trash: the archived tables and, for every soft-deleting
+// table, how many of its records are in the trash
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	archived, err := store.ArchivedTables()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	type trashedRecords struct {
+		Table string `json:"table"`
+		Count int    `json:"count"`
+	}
+	records := []trashedRecords{}
+	tables, err := store.ListTables()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	for _, tableName := range tables {
+		soft, err := softDeletes(tableName)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if !soft {
+			continue
+		}
+		_, total, err := store.ListRecords(tableName, recordQuery{Limit: 1, Trashed: true})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		records = append(records, trashedRecords{Table: tableName, Count: total})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tables":    archived,
+		"records":   records,
+		"retention": trashRetention.String(),
+	})
+}
+
+// trashTablesHandler serves GET /trash/tables
+func trashTablesHandler(w http.ResponseWriter, r *http.Request) {
+	archived, err := store.ArchivedTables()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, archived)
+}
+
+// trashTableHandler restores an archived table (POST .../restore, optionally under a new
+// name given as {"name": ...}) or drops it for good (DELETE)
+func trashTableHandler(w http.ResponseWriter, r *http.Request) {
+	archiveName := r.PathValue("name")
+	if err := validateTableName(archiveName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+	archived, found, err := findArchivedTable(archiveName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found in trash")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := purgeArchivedTable(archived, requestSchemaChange(r)); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		fmt.Printf("Table '%s' purged from trash\n", archiveName)
+		writeJSON(w, http.StatusOK, map[string]string{
+			"message": fmt.Sprintf("Table '%s' permanently deleted", archived.Table),
+			"name":    archiveName,
+		})
+		return
+	}
+
+	var restoreRequest struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&restoreRequest); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON: "+err.Error())
+			return
+		}
+	}
+	newName := archived.Table
+	if restoreRequest.Name != "" {
+		newName = restoreRequest.Name
+	}
+	if err := validateTableName(newName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return
+	}
+	exists, err := store.TableExists(newName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if exists {
+		writeError(w, http.StatusConflict, codeTableExists, fmt.Sprintf("Table '%s' already exists: restore it under another name", newName))
+		return
+	}
+
+	if err := store.RestoreTable(archiveName, newName); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if schema, err := store.TableSchema(newName); err != nil {
+		log.Printf("Warning: Failed to record restore of table %s in the migration log: %v", newName, err)
+	} else {
+		archive, restore := archiveStatements(archiveName, newName, renamedIndexes(indexNames(schema), newName, archiveName))
+		recordMigration(requestSchemaChange(r), newName, migrationRestoreTable, restore, archive)
+	}
+	fmt.Printf("Table '%s' restored from trash as '%s'\n", archiveName, newName)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("Table '%s' restored", newName),
+		"name":    newName,
+	})
+}
+
+// trashRecordsHandler serves GET /trash/records/{table}, listing the deleted records of a
+// soft-deleting table with the same paging, sorting and filters as GET /records
+func trashRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	tableName, ok := trashRecordTable(w, r)
+	if !ok {
+		return
+	}
+
+	columns, err := store.Columns(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	query, err := parseRecordQuery(r.URL.Query(), columns)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	query.Trashed = true
+
+	records, total, err := store.ListRecords(tableName, query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, records)
+}
+
+// trashRecordRestoreHandler serves POST /trash/records/{table}/{id}/restore
+func trashRecordRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	tableName, ok := trashRecordTable(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid record ID")
+		return
+	}
+
+	trashed, _, err := store.ListRecords(tableName, recordQuery{
+		Filters: []filterClause{{Column: "id", Operator: "eq", Value: strconv.Itoa(id)}},
+		Trashed: true,
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if len(trashed) == 0 {
+		writeError(w, http.StatusNotFound, codeRecordNotFound, "Record not found in trash")
+		return
+	}
+
+	record, err := store.RestoreRecord(tableName, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, codeRecordNotFound, "Record not found in trash")
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	auditRecordChange(tableName, int64(id), auditRestore, trashed[0], record, requestActor(r))
+	fmt.Printf("Table '%s' record %d restored from trash\n", tableName, id)
+	w.Header().Set("ETag", recordETag(record))
+	writeJSON(w, http.StatusOK, record)
+}
+
+// trashRecordTable validates the table of a /trash/records request, which must exist
+// and soft delete
+func trashRecordTable(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tableName := r.PathValue("table")
+	if err := validateTableName(tableName); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidIdentifier, err.Error())
+		return "", false
+	}
+	exists, err := store.TableExists(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return "", false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, codeTableNotFound, "Table not found")
+		return "", false
+	}
+	soft, err := softDeletes(tableName)
+	if err != nil {
+		writeStoreError(w, err)
+		return "", false
+	}
+	if !soft {
+		writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Table '%s' doesn't use soft delete", tableName))
+		return "", false
+	}
+	return tableName, true
+}
+
+// trashPurgeHandler serves POST /trash/purge. Everything trashed longer ago than the
+// olderThan duration, the configured retention by default, is removed for good.
+func trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	retention := trashRetention
+	if olderThan := r.URL.Query().Get("olderThan"); olderThan != "" {
+		parsed, err := time.ParseDuration(olderThan)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidQuery, fmt.Sprintf("invalid olderThan '%s': use a duration such as 72h", olderThan))
+			return
+		}
+		retention = parsed
+	}
+
+	result, err := purgeTrash(time.Now().Add(-retention), requestSchemaChange(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
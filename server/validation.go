@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validation error codes returned to clients
+const (
+	codeRequired        = "REQUIRED"
+	codeInvalidFormat   = "INVALID_FORMAT"
+	codePatternMismatch = "PATTERN_MISMATCH"
+	codeBelowMinimum    = "BELOW_MINIMUM"
+	codeAboveMaximum    = "ABOVE_MAXIMUM"
+	codeTooShort        = "TOO_SHORT"
+	codeTooLong         = "TOO_LONG"
+	codeNotAllowed      = "NOT_ALLOWED"
+	codeNotUnique       = "NOT_UNIQUE"
+	codeNoFields        = "NO_FIELDS"
+	codeInsertFailed    = "INSERT_FAILED"
+	codeInvalidLink     = "INVALID_LINK"
+	codeUnknownField    = "UNKNOWN_FIELD"
+	codeDuplicateField  = "DUPLICATE_FIELD"
+)
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ()./-]{5,20}$`)
+
+// ColumnRules are the declarative validation rules configured for a column
+type ColumnRules struct {
+	Pattern   string   `json:"pattern,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Enum      []string `json:"enum,omitempty"`
+	Unique    bool     `json:"unique,omitempty"`
+}
+
+// FieldError describes a single validation failure
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError carries every field error found for a record
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Message
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// typeValidator checks a non-blank value against a semantic type and returns a message on failure
+type typeValidator func(value interface{}) string
+
+// ruleValidator checks a non-blank value against one of the column's rules
+type ruleValidator func(meta ColumnMetadata, value interface{}) *FieldError
+
+var typeValidators = map[string]typeValidator{}
+
+// ruleValidators run in order for every non-blank value
+var ruleValidators []ruleValidator
+
+// registerTypeValidator installs the validator used for a semantic type
+func registerTypeValidator(semanticType string, validator typeValidator) {
+	typeValidators[semanticType] = validator
+}
+
+// registerRuleValidator appends a validator that runs for every column
+func registerRuleValidator(validator ruleValidator) {
+	ruleValidators = append(ruleValidators, validator)
+}
+
+func init() {
+	registerTypeValidator(semanticEmail, func(value interface{}) string {
+		if !emailPattern.MatchString(fmt.Sprint(value)) {
+			return "must be a valid email address"
+		}
+		return ""
+	})
+	registerTypeValidator(semanticPhone, func(value interface{}) string {
+		if !phonePattern.MatchString(fmt.Sprint(value)) {
+			return "must be a valid phone number"
+		}
+		return ""
+	})
+	registerTypeValidator(semanticURL, func(value interface{}) string {
+		if parsed, err := url.ParseRequestURI(fmt.Sprint(value)); err != nil || parsed.Host == "" {
+			return "must be a valid URL"
+		}
+		return ""
+	})
+	registerTypeValidator(semanticDate, func(value interface{}) string {
+		str := fmt.Sprint(value)
+		if _, err := time.Parse("2006-01-02", str); err != nil {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return "must be a date in YYYY-MM-DD format"
+			}
+		}
+		return ""
+	})
+	registerTypeValidator(semanticNumber, func(value interface{}) string {
+		if _, ok := numericValue(value); !ok {
+			return "must be a number"
+		}
+		return ""
+	})
+	registerTypeValidator(semanticBoolean, func(value interface{}) string {
+		if _, ok := value.(bool); ok {
+			return ""
+		}
+		if _, err := strconv.ParseBool(fmt.Sprint(value)); err != nil {
+			return "must be true or false"
+		}
+		return ""
+	})
+
+	registerTypeValidator(semanticLink, func(value interface{}) string {
+		if id, ok := numericValue(value); !ok || id < 1 || id != math.Trunc(id) {
+			return "must be the id of a linked record"
+		}
+		return ""
+	})
+
+	registerRuleValidator(validatePattern)
+	registerRuleValidator(validateRange)
+	registerRuleValidator(validateLength)
+	registerRuleValidator(validateEnum)
+}
+
+// compilePattern caches the compiled pattern rule on the metadata, so validatePattern
+// doesn't compile it again for every value
+func (meta *ColumnMetadata) compilePattern() {
+	meta.pattern = nil
+	if meta.Rules.Pattern != "" {
+		meta.pattern, _ = regexp.Compile(meta.Rules.Pattern)
+	}
+}
+
+func validatePattern(meta ColumnMetadata, value interface{}) *FieldError {
+	if meta.Rules.Pattern == "" {
+		return nil
+	}
+	if meta.pattern == nil {
+		return &FieldError{Field: meta.Key, Code: codePatternMismatch, Message: fmt.Sprintf("%s has an invalid pattern configured", meta.Label)}
+	}
+	if !meta.pattern.MatchString(fmt.Sprint(value)) {
+		return &FieldError{Field: meta.Key, Code: codePatternMismatch, Message: fmt.Sprintf("%s does not match the required format", meta.Label)}
+	}
+	return nil
+}
+
+func validateRange(meta ColumnMetadata, value interface{}) *FieldError {
+	if meta.Rules.Min == nil && meta.Rules.Max == nil {
+		return nil
+	}
+	number, ok := numericValue(value)
+	if !ok {
+		return &FieldError{Field: meta.Key, Code: codeInvalidFormat, Message: fmt.Sprintf("%s must be a number", meta.Label)}
+	}
+	if meta.Rules.Min != nil && number < *meta.Rules.Min {
+		return &FieldError{Field: meta.Key, Code: codeBelowMinimum, Message: fmt.Sprintf("%s must be at least %v", meta.Label, *meta.Rules.Min)}
+	}
+	if meta.Rules.Max != nil && number > *meta.Rules.Max {
+		return &FieldError{Field: meta.Key, Code: codeAboveMaximum, Message: fmt.Sprintf("%s must be at most %v", meta.Label, *meta.Rules.Max)}
+	}
+	return nil
+}
+
+func validateLength(meta ColumnMetadata, value interface{}) *FieldError {
+	length := len([]rune(fmt.Sprint(value)))
+	if meta.Rules.MinLength != nil && length < *meta.Rules.MinLength {
+		return &FieldError{Field: meta.Key, Code: codeTooShort, Message: fmt.Sprintf("%s must be at least %d characters", meta.Label, *meta.Rules.MinLength)}
+	}
+	if meta.Rules.MaxLength != nil && length > *meta.Rules.MaxLength {
+		return &FieldError{Field: meta.Key, Code: codeTooLong, Message: fmt.Sprintf("%s must be at most %d characters", meta.Label, *meta.Rules.MaxLength)}
+	}
+	return nil
+}
+
+func validateEnum(meta ColumnMetadata, value interface{}) *FieldError {
+	if len(meta.Rules.Enum) == 0 {
+		return nil
+	}
+	if containsString(meta.Rules.Enum, fmt.Sprint(value)) {
+		return nil
+	}
+	return &FieldError{Field: meta.Key, Code: codeNotAllowed, Message: fmt.Sprintf("%s must be one of: %s", meta.Label, strings.Join(meta.Rules.Enum, ", "))}
+}
+
+// checkColumnRules reports problems with a rule configuration before it is saved
+func checkColumnRules(rules ColumnRules) error {
+	if rules.Pattern != "" {
+		if _, err := regexp.Compile(rules.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	if rules.Min != nil && rules.Max != nil && *rules.Min > *rules.Max {
+		return fmt.Errorf("min cannot be greater than max")
+	}
+	if rules.MinLength != nil && rules.MaxLength != nil && *rules.MinLength > *rules.MaxLength {
+		return fmt.Errorf("minLength cannot be greater than maxLength")
+	}
+	return nil
+}
+
+// validateValue runs the type validator and rule validators for a single non-blank value
+func validateValue(meta ColumnMetadata, value interface{}) []FieldError {
+	var errors []FieldError
+	if validator, ok := typeValidators[meta.Type]; ok {
+		if message := validator(value); message != "" {
+			errors = append(errors, FieldError{Field: meta.Key, Code: codeInvalidFormat, Message: fmt.Sprintf("%s %s", meta.Label, message)})
+			return errors
+		}
+	}
+	for _, validator := range ruleValidators {
+		if fieldErr := validator(meta, value); fieldErr != nil {
+			errors = append(errors, *fieldErr)
+		}
+	}
+	return errors
+}
+
+// validateRecord checks a record against the column metadata. On create every required
+// column must be present; on update only the supplied fields are checked. Only columns
+// declared in the catalog are validated, plus the legacy email key, which must hold a valid
+// address whenever it has no catalog entry. excludeID is the record being updated and is
+// ignored by uniqueness checks.
+func validateRecord(tableName string, metadata []ColumnMetadata, recordData Record, isCreate bool, excludeID int) []FieldError {
+	var errors []FieldError
+	known := make(map[string]bool, len(metadata))
+
+	for _, meta := range metadata {
+		if meta.Key == "id" || !meta.declared {
+			continue
+		}
+		known[meta.Key] = true
+		value, exists := recordData[meta.Key]
+		if isBlank(value) {
+			if meta.Required && (isCreate || exists) {
+				errors = append(errors, FieldError{Field: meta.Key, Code: codeRequired, Message: fmt.Sprintf("%s is required", meta.Label)})
+			}
+			continue
+		}
+
+		valueErrors := validateValue(meta, value)
+		if len(valueErrors) == 0 && meta.Rules.Unique {
+			taken, err := store.ValueTaken(tableName, meta.Key, value, excludeID)
+			if err != nil {
+				valueErrors = append(valueErrors, FieldError{Field: meta.Key, Code: codeNotUnique, Message: fmt.Sprintf("%s could not be checked for uniqueness: %v", meta.Label, err)})
+			} else if taken {
+				valueErrors = append(valueErrors, FieldError{Field: meta.Key, Code: codeNotUnique, Message: fmt.Sprintf("%s must be unique", meta.Label)})
+			}
+		}
+		errors = append(errors, valueErrors...)
+	}
+
+	// Undeclared columns are only checked for the legacy email key
+	if value, ok := recordData["email"].(string); ok && !known["email"] && !isBlank(value) {
+		meta := ColumnMetadata{Key: "email", Label: defaultColumnLabel("email"), Type: semanticEmail}
+		errors = append(errors, validateValue(meta, value)...)
+	}
+
+	return errors
+}
+
+// writeValidationError responds with 422 and the field errors as the envelope details
+func writeValidationError(w http.ResponseWriter, validationErr *ValidationError) {
+	writeErrorDetails(w, http.StatusUnprocessableEntity, codeValidationFailed, "Validation failed", validationErr.Errors)
+}
+
+// numericValue converts JSON numbers and numeric strings to float64
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func isBlank(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if str, ok := value.(string); ok {
+		return strings.TrimSpace(str) == ""
+	}
+	return false
+}